@@ -1,63 +1,294 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/joho/godotenv"
 	"github.com/ufcg-lsd/arrebol-pb-worker/utils"
 	"github.com/ufcg-lsd/arrebol-pb-worker/worker"
-	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 const (
 	ConfFilePathKey   = "CONF_FILE_PATH"
 	ServerEndpointKey = "SERVER_ENDPOINT"
+	// Period the running tasks have to finish once the worker is asked to shut down
+	ShutdownGracePeriodKey     = "SHUTDOWN_GRACE_PERIOD"
+	DefaultShutdownGracePeriod = 30 * time.Second
 )
 
-func generateKeys(workerId string) {
-	log.Println("Starting to gen rsa key pair with workerid: " + workerId)
-	utils.GenAccessKeys(workerId)
+// It makes sure the worker has its key pair, reusing the existing one.
+func ensureKeys(workerId string) {
+	if _, err := utils.EnsureAccessKeys(workerId); err != nil {
+		utils.Log().WithError(err).Fatal("Error on generating the access keys")
+	}
 }
 
 func main() {
+	//the secrets handled by the worker are redacted from every log line
+	utils.SetLogOutput(os.Stderr)
 	err := godotenv.Load()
 
 	if err != nil {
-		log.Println("No .env file found")
+		utils.Log().Info("No .env file found")
+	}
+
+	if err := utils.ConfigureLoggingFromEnv(); err != nil {
+		utils.Log().WithError(err).Fatal("Error on configuring the logging")
 	}
 
-	startWorker()
+	if err := startWorker(); err != nil {
+		os.Exit(1)
+	}
 }
 
-func startWorker() {
+// It runs the worker until it is asked to shut down.
+// It returns an error if the worker has stopped because it couldn't go on fetching tasks,
+// in which case the running tasks have been shut down as well.
+func startWorker() error {
 	// This is the default work behavior implementation.
-	// Its core stands for executing one task at a time.
-	log.Println("Starting reading configuration process")
+	// Its core stands for executing one task per slot, so a new task is only
+	// fetched when some slot has room for it.
+	utils.Log().Info("Starting reading configuration process")
 	file, err := os.Open(os.Getenv(ConfFilePathKey))
 
 	if err != nil {
-		log.Fatal("Error on opening configuration file", err.Error())
+		utils.Log().WithError(err).Fatal("Error on opening configuration file")
 	}
 
 	defer file.Close()
 
 	workerInstance := worker.ParseWorkerConfiguration(file)
 
+	if err := utils.ConfigureRedaction(workerInstance.Redaction); err != nil {
+		utils.Log().WithError(err).Fatal("Error on configuring the logs redaction")
+	}
+
 	serverEndpoint := os.Getenv(ServerEndpointKey)
 
-	//before join the server, the worker must generate the keys
-	generateKeys(workerInstance.Id)
+	//before join the server, the worker must have its keys
+	ensureKeys(workerInstance.Id)
+
+	// The token the server assigns on join is verified against its trusted keys
+	tokenVerifier, err := worker.TokenVerifierFromEnv()
+
+	if err != nil {
+		utils.Log().WithError(err).Fatal("Error on configuring the server token verification")
+	}
+
+	worker.ConfigureTokenVerifier(tokenVerifier)
+
+	docker, err := utils.NewDockerClient(utils.DockerConfigFromEnv(os.Getenv(worker.WorkerNodeAddressKey)))
+
+	if err != nil {
+		utils.Log().WithError(err).Fatal("Error on creating the docker client")
+	}
+
+	// The daemon reachability is monitored until the worker shuts down
+	monitorCtx, stopMonitor := context.WithCancel(context.Background())
+	defer stopMonitor()
+	go docker.Monitor(monitorCtx, utils.DurationFromEnv(utils.DockerPingIntervalKey, utils.DefaultDockerPingInterval))
+
+	scheduler, err := worker.NewScheduler(workerInstance, docker)
+
+	if err != nil {
+		utils.Log().WithError(err).Fatal("Error on creating the slots scheduler")
+	}
+
+	apiServers := serveAPIs(worker.NewStatusHandler(workerInstance, scheduler))
+
+	pollingBackoff := utils.NewBackoffFromEnv()
+	joinBackoff := utils.NewBackoffFromEnv()
+
+	// The fetching is stopped as soon as a termination signal arrives,
+	// while the running tasks are only aborted after the grace period, or as soon as a second one arrives.
+	fetchCtx, stopFetching := context.WithCancel(context.Background())
+	tasksCtx, abortTasks := context.WithCancel(context.Background())
+	go stopOnSignal(stopFetching, abortTasks)
+	go rotateKeysOnSignal(workerInstance, serverEndpoint)
+
+	// The token is kept fresh until the running tasks have been reported, even while shutting down
+	refreshMargin := utils.DurationFromEnv(worker.TokenRefreshMarginKey, worker.DefaultTokenRefreshMargin)
+	go workerInstance.KeepTokenFresh(monitorCtx, serverEndpoint, refreshMargin, utils.NewBackoffFromEnv())
+
+	// The error that has stopped the fetching, if it hasn't been a termination signal
+	var fetchErr error
+
+	for fetchCtx.Err() == nil {
+		slot, err := scheduler.Acquire(fetchCtx)
+
+		if err != nil {
+			break
+		}
+
+		if err := waitForDocker(fetchCtx, docker); err != nil {
+			scheduler.Release(slot)
+			break
+		}
 
-	for {
-		task, err := workerInstance.GetTask(serverEndpoint)
+		task, err := workerInstance.WaitForTask(fetchCtx, serverEndpoint, pollingBackoff)
 
 		if err != nil {
-			//it will force the worker to Join again, if the error has occurred because of
-			//authentication issues. This is a work arround while the system doesn't have
-			//its own Error module that will allow it to identify the error type.
-			workerInstance.Join(serverEndpoint)
+			scheduler.Release(slot)
+
+			if err := handleGetTaskError(fetchCtx, err, workerInstance, serverEndpoint, pollingBackoff, joinBackoff); err != nil {
+				utils.Log().WithError(err).Error("No more tasks will be fetched")
+				fetchErr = err
+				break
+			}
+
+			continue
+		}
+
+		scheduler.Run(slot, func(slot *worker.Slot) {
+			workerInstance.ExecTask(tasksCtx, task, slot, serverEndpoint)
+		})
+	}
+
+	shutdown(scheduler, abortTasks)
+
+	for _, server := range apiServers {
+		server.Close()
+	}
+
+	return fetchErr
+}
+
+// It serves the local APIs, the metrics and the status ones, at the addresses set
+// in the environment. The APIs that share an address are served together, and the
+// ones without an address are not served. The worker keeps running if they fail.
+func serveAPIs(status http.Handler) []*http.Server {
+	routes := []struct {
+		address string
+		path    string
+		handler http.Handler
+	}{
+		{os.Getenv(utils.MetricsAddressKey), utils.MetricsPath, utils.MetricsHandler()},
+		{os.Getenv(worker.StatusAddressKey), "/", status},
+	}
+
+	muxes := make(map[string]*http.ServeMux)
+	servers := make([]*http.Server, 0)
+
+	for _, route := range routes {
+		if route.address == "" {
 			continue
 		}
 
-		workerInstance.ExecTask(task, serverEndpoint)
+		mux, ok := muxes[route.address]
+
+		if !ok {
+			mux = http.NewServeMux()
+			muxes[route.address] = mux
+			servers = append(servers, &http.Server{Addr: route.address, Handler: mux})
+		}
+
+		mux.Handle(route.path, route.handler)
+	}
+
+	for _, server := range servers {
+		go func(server *http.Server) {
+			utils.Log().With("address", server.Addr).Info("Serving the local APIs")
+
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				utils.Log().WithError(err).Error("Error on serving the local APIs")
+			}
+		}(server)
+	}
+
+	return servers
+}
+
+// It blocks until the docker daemon is reachable, so no task is fetched while it is down.
+func waitForDocker(ctx context.Context, docker *utils.DockerClient) error {
+	if !docker.Reachable() {
+		utils.Log().Warn("Waiting for the docker daemon to fetch tasks")
+	}
+
+	return docker.WaitReachable(ctx)
+}
+
+// It stops the fetching on the first termination signal, and aborts the running tasks on the second one.
+func stopOnSignal(stopFetching, abortTasks context.CancelFunc) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	utils.Log().With("signal", sig).Info("No more tasks will be fetched")
+	stopFetching()
+
+	// A second signal means the operator doesn't want to wait for the grace period,
+	// and from then on the signals are left to their default behavior, which kills the worker
+	sig = <-signals
+	utils.Log().With("signal", sig).Warn("Aborting the running tasks")
+	signal.Stop(signals)
+	abortTasks()
+}
+
+// It rotates the worker's keys each time the operator sends the rotation signal (SIGUSR1).
+func rotateKeysOnSignal(workerInstance *worker.Worker, serverEndpoint string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+
+	for range signals {
+		utils.Log().Info("Rotating the keys")
+
+		if err := workerInstance.RotateKeys(serverEndpoint); err != nil {
+			utils.Log().WithError(err).Error("Error on rotating the keys")
+		}
+	}
+}
+
+// It waits for the running tasks up to the grace period. The ones that are still
+// running after that are aborted, which stops and removes their containers.
+func shutdown(scheduler *worker.Scheduler, abortTasks context.CancelFunc) {
+	gracePeriod := utils.DurationFromEnv(ShutdownGracePeriodKey, DefaultShutdownGracePeriod)
+	utils.Log().With("grace_period", gracePeriod).Info("Waiting for the running tasks")
+
+	if !scheduler.WaitTimeout(gracePeriod) {
+		utils.Log().Warn("Grace period expired; aborting the running tasks")
+		abortTasks()
+		scheduler.Wait()
+	}
+
+	utils.Log().Info("Worker shut down")
+}
+
+// It decides what to do when the worker fails to get a task, depending on the error type.
+// The worker joins the server again only if its credentials are missing or expired,
+// since joining again doesn't help a worker the server has forbidden.
+// The empty queue and the server unavailability are handled by the polling backoff,
+// which also spaces out the fetches of the tasks that can't be read.
+// It returns an error if the worker can't go on fetching tasks, so it must shut down.
+func handleGetTaskError(ctx context.Context, err error, workerInstance *worker.Worker, serverEndpoint string, pollingBackoff, joinBackoff *utils.Backoff) error {
+	switch {
+	case ctx.Err() != nil:
+		return nil
+	case errors.Is(err, worker.ErrNotJoined), errors.Is(err, utils.ErrUnauthorized):
+		utils.Log().WithError(err).Info("Joining the server")
+
+		if err := workerInstance.JoinWithRetry(ctx, serverEndpoint, joinBackoff); err != nil && ctx.Err() == nil {
+			return fmt.Errorf("Giving up on joining the server: %w", err)
+		}
+
+		return nil
+	case errors.Is(err, utils.ErrMalformedPayload):
+		interval := pollingBackoff.Next()
+		utils.Log().WithError(err).With("retry_in", interval).Warn("Ignoring the task")
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(interval):
+		}
+
+		return nil
+	case errors.Is(err, utils.ErrForbidden):
+		return fmt.Errorf("The worker isn't allowed to get tasks: %w", err)
+	default:
+		return fmt.Errorf("Giving up on getting tasks: %w", err)
 	}
 }
@@ -0,0 +1,251 @@
+package utils
+
+//This module builds and extracts the tar archives exchanged with the docker
+//archive API, which is the way files and directories are copied to and from
+//the containers. The archives keep the files' permissions.
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+//It archives a single file with the given content.
+//Params:
+//name - the file path inside the archive
+//content - the file content
+//mode - the file permissions
+//It returns:
+//1. nil and an error if the archive couldn't be written
+//2. the archive and nil otherwise
+func ArchiveContent(name string, content []byte, mode os.FileMode) (io.Reader, error) {
+	var buf bytes.Buffer
+	archive := tar.NewWriter(&buf)
+
+	header := &tar.Header{
+		Name:     name,
+		Mode:     int64(mode.Perm()),
+		Size:     int64(len(content)),
+		Typeflag: tar.TypeReg,
+	}
+
+	if err := archive.WriteHeader(header); err != nil {
+		return nil, err
+	}
+
+	if _, err := archive.Write(content); err != nil {
+		return nil, err
+	}
+
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+
+	return &buf, nil
+}
+
+//It archives the src file or directory of the worker host, recursively.
+//The archive is written while it is read, so big directories are not held in memory.
+//Params:
+//src - the file or directory path in the worker host
+//name - the path of src inside the archive
+//It returns a reader of the archive. The errors faced while archiving are returned by its Read.
+func ArchivePath(src, name string) io.ReadCloser {
+	reader, writer := io.Pipe()
+
+	go func() {
+		archive := tar.NewWriter(writer)
+		err := filepath.Walk(src, func(filePath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			rel, err := filepath.Rel(src, filePath)
+
+			if err != nil {
+				return err
+			}
+
+			return archiveFile(archive, filePath, path.Join(name, filepath.ToSlash(rel)), info)
+		})
+
+		if err == nil {
+			err = archive.Close()
+		}
+
+		writer.CloseWithError(err)
+	}()
+
+	return reader
+}
+
+func archiveFile(archive *tar.Writer, filePath, name string, info os.FileInfo) error {
+	link := ""
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(filePath)
+
+		if err != nil {
+			return err
+		}
+
+		link = target
+	}
+
+	header, err := tar.FileInfoHeader(info, link)
+
+	if err != nil {
+		return err
+	}
+
+	header.Name = name
+
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	file, err := os.Open(filePath)
+
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(archive, file)
+	return err
+}
+
+//It extracts the archive into the dest path of the worker host.
+//The archive root entry, as the ones built by the docker archive API,
+//is renamed to dest; the entries that would escape dest are refused, as well
+//as the ones that would be written through a link, which may point anywhere.
+//Params:
+//reader - the archive
+//dest - the path in which the archive root entry will be extracted
+//It returns:
+//1. an error if the archive is invalid or couldn't be extracted
+//2. nil otherwise
+func ExtractArchive(reader io.Reader, dest string) error {
+	archive := tar.NewReader(reader)
+	dest = filepath.Clean(dest)
+	root := ""
+
+	for {
+		header, err := archive.Next()
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		name := path.Clean(header.Name)
+
+		if root == "" {
+			root = name
+		}
+
+		rel := strings.TrimPrefix(strings.TrimPrefix(name, root), "/")
+
+		if name != root && !strings.HasPrefix(name, root+"/") || strings.HasPrefix(rel, "..") {
+			return errors.New("The archive entry [" + header.Name + "] is out of its root")
+		}
+
+		target := filepath.Join(dest, filepath.FromSlash(rel))
+
+		if err := checkNoLinks(dest, target); err != nil {
+			return err
+		}
+
+		if err := extractEntry(archive, header, dest, target); err != nil {
+			return err
+		}
+	}
+}
+
+//It checks that neither the target nor its parents below dest are links, since
+//the links an archive has created could make its next entries escape dest.
+//It returns an error if some of them is a link, or couldn't be checked.
+func checkNoLinks(dest, target string) error {
+	rel, err := filepath.Rel(dest, target)
+
+	if err != nil {
+		return err
+	}
+
+	current := dest
+
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		if part == "." {
+			continue
+		}
+
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			return errors.New("The archive entry [" + target + "] would be written through the link [" + current + "]")
+		}
+	}
+
+	return nil
+}
+
+func extractEntry(archive *tar.Reader, header *tar.Header, dest, target string) error {
+	mode := os.FileMode(header.Mode).Perm()
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(target, mode); err != nil {
+			return err
+		}
+
+		return os.Chmod(target, mode)
+	case tar.TypeReg, tar.TypeRegA:
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+
+		file, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		if _, err := io.Copy(file, archive); err != nil {
+			return err
+		}
+
+		return os.Chmod(target, mode)
+	case tar.TypeSymlink:
+		linked := filepath.Join(filepath.Dir(target), header.Linkname)
+
+		if filepath.IsAbs(header.Linkname) || (linked != dest && !strings.HasPrefix(linked, dest+string(filepath.Separator))) {
+			return errors.New("The archive link [" + header.Name + "] points out of its root")
+		}
+
+		return os.Symlink(header.Linkname, target)
+	default:
+		//other entries, such as devices, are not extracted
+		return nil
+	}
+}
@@ -0,0 +1,123 @@
+package utils
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestArchivePathAndExtract(t *testing.T) {
+	//setup
+	src, _ := ioutil.TempDir("", "archive-src")
+	dest, _ := ioutil.TempDir("", "archive-dest")
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dest)
+
+	os.MkdirAll(filepath.Join(src, "bin"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "bin", "run.sh"), []byte("#!/bin/bash\necho 'it''s arrebol'\n"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "data.bin"), []byte{0, 1, 2, 255}, 0600)
+
+	//exercise
+	archive := ArchivePath(src, "arrebol/task")
+	err := ExtractArchive(archive, filepath.Join(dest, "task"))
+
+	//verification
+	if err != nil {
+		t.Fatal("Error on extracting the archive: " + err.Error())
+	}
+
+	script, err := os.Stat(filepath.Join(dest, "task", "bin", "run.sh"))
+
+	if err != nil || script.Mode().Perm() != 0755 {
+		t.Errorf("The script permissions must be kept")
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dest, "task", "data.bin"))
+
+	if err != nil || !bytes.Equal(data, []byte{0, 1, 2, 255}) {
+		t.Errorf("The binary content must be kept")
+	}
+}
+
+func TestArchiveContent(t *testing.T) {
+	//setup
+	dest, _ := ioutil.TempDir("", "archive-dest")
+	defer os.RemoveAll(dest)
+	content := []byte("echo 'quotes' \"and\" $(special) `chars`\n")
+
+	//exercise
+	archive, err := ArchiveContent("arrebol/task-id.ts", content, 0644)
+
+	if err != nil {
+		t.Fatal("Error on archiving the content: " + err.Error())
+	}
+
+	err = ExtractArchive(archive, filepath.Join(dest, "task-id.ts"))
+
+	//verification
+	if err != nil {
+		t.Fatal("Error on extracting the archive: " + err.Error())
+	}
+
+	extracted, _ := ioutil.ReadFile(filepath.Join(dest, "task-id.ts"))
+
+	if !bytes.Equal(extracted, content) {
+		t.Errorf("The extracted content is different from the archived one: %s", extracted)
+	}
+}
+
+func TestExtractArchiveOutOfRoot(t *testing.T) {
+	//setup
+	dest, _ := ioutil.TempDir("", "archive-dest")
+	defer os.RemoveAll(dest)
+
+	var buf bytes.Buffer
+	archive := tar.NewWriter(&buf)
+	archive.WriteHeader(&tar.Header{Name: "outputs", Mode: 0755, Typeflag: tar.TypeDir})
+	archive.WriteHeader(&tar.Header{Name: "outputs/../../escaped", Mode: 0644, Typeflag: tar.TypeReg})
+	archive.Close()
+
+	//exercise
+	err := ExtractArchive(&buf, filepath.Join(dest, "outputs"))
+
+	//verification
+	if err == nil {
+		t.Errorf("The entries out of the archive root must be refused")
+	}
+
+	if _, err := os.Stat(filepath.Join(dest, "..", "escaped")); !os.IsNotExist(err) {
+		t.Errorf("The entry out of the archive root has been extracted")
+	}
+}
+
+func TestExtractArchiveThroughLinks(t *testing.T) {
+	//setup
+	parent, _ := ioutil.TempDir("", "archive-parent")
+	defer os.RemoveAll(parent)
+	dest := filepath.Join(parent, "outputs")
+
+	var buf bytes.Buffer
+	archive := tar.NewWriter(&buf)
+	archive.WriteHeader(&tar.Header{Name: "root", Mode: 0755, Typeflag: tar.TypeDir})
+	//each link points into dest by itself, but they escape it once chained
+	archive.WriteHeader(&tar.Header{Name: "root/deep", Linkname: ".", Mode: 0777, Typeflag: tar.TypeSymlink})
+	archive.WriteHeader(&tar.Header{Name: "root/deep/x", Linkname: "..", Mode: 0777, Typeflag: tar.TypeSymlink})
+	archive.WriteHeader(&tar.Header{Name: "root/deep/x/evil", Mode: 0644, Size: 4, Typeflag: tar.TypeReg})
+	archive.Write([]byte("evil"))
+	archive.Close()
+
+	//exercise
+	err := ExtractArchive(&buf, dest)
+
+	//verification
+	if err == nil {
+		t.Errorf("The entries written through a link must be refused")
+	}
+
+	if _, err := os.Stat(filepath.Join(parent, "evil")); !os.IsNotExist(err) {
+		t.Errorf("The entry written through the links has escaped the dest")
+	}
+}
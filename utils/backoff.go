@@ -0,0 +1,87 @@
+package utils
+
+//This module implements the exponential backoff used by the worker to space out
+//retries against the server (e.g polling an empty queue or joining an unavailable server).
+//Each call to Next returns a longer interval, randomized by the jitter and capped by
+//the max interval, until Reset is called after a successful attempt.
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+const (
+	PollingInitialIntervalKey = "POLLING_INITIAL_INTERVAL"
+	PollingMaxIntervalKey     = "POLLING_MAX_INTERVAL"
+	PollingMultiplierKey      = "POLLING_MULTIPLIER"
+	PollingJitterKey          = "POLLING_JITTER"
+
+	DefaultInitialInterval = 1 * time.Second
+	DefaultMaxInterval     = 1 * time.Minute
+	DefaultMultiplier      = 2
+	DefaultJitter          = 0.2
+)
+
+type Backoff struct {
+	//The interval returned by the first call to Next
+	InitialInterval time.Duration
+	//The upper bound of the returned intervals
+	MaxInterval time.Duration
+	//The factor by which the interval grows on each attempt
+	Multiplier float64
+	//The fraction, ranging from 0 to 1, by which the interval is randomized
+	//(e.g 0.2 makes a 10s interval range from 8s to 12s)
+	Jitter   float64
+	attempts int
+}
+
+func NewBackoff(initial, max time.Duration, multiplier, jitter float64) *Backoff {
+	return &Backoff{
+		InitialInterval: initial,
+		MaxInterval:     max,
+		Multiplier:      multiplier,
+		Jitter:          jitter,
+	}
+}
+
+//Creates a backoff whose settings are read from the environment,
+//falling back to the default ones if they are not set or invalid.
+//The multiplier must be at least 1, so the intervals don't shrink, and the jitter
+//must range from 0 to 1, so the intervals aren't negative.
+//The intervals are durations such as "500ms" or "2m".
+func NewBackoffFromEnv() *Backoff {
+	return NewBackoff(
+		DurationFromEnv(PollingInitialIntervalKey, DefaultInitialInterval),
+		DurationFromEnv(PollingMaxIntervalKey, DefaultMaxInterval),
+		floatFromEnv(PollingMultiplierKey, DefaultMultiplier, 1, math.MaxFloat64),
+		floatFromEnv(PollingJitterKey, DefaultJitter, 0, 1),
+	)
+}
+
+//It returns the interval to be waited before the next attempt.
+//The settings out of range are clamped, so the intervals neither shrink nor get negative.
+func (b *Backoff) Next() time.Duration {
+	multiplier := math.Max(b.Multiplier, 1)
+	jitter := math.Min(math.Max(b.Jitter, 0), 1)
+	interval := float64(b.InitialInterval) * math.Pow(multiplier, float64(b.attempts))
+	max := float64(b.MaxInterval)
+
+	if interval > max {
+		interval = max
+	} else {
+		b.attempts++
+	}
+
+	interval += interval * jitter * (2*rand.Float64() - 1)
+
+	if interval > max {
+		interval = max
+	}
+
+	return time.Duration(interval)
+}
+
+//It makes the next interval be the initial one again.
+func (b *Backoff) Reset() {
+	b.attempts = 0
+}
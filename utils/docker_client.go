@@ -0,0 +1,228 @@
+package utils
+
+//This module implements the long-lived docker client of the worker, which is shared
+//by every slot. It is configured from the worker settings, never from the process
+//environment, and it supports unix-socket and tcp hosts, with or without TLS.
+//The daemon is pinged periodically, so the worker knows whether it is reachable:
+//once it becomes unreachable, e.g because it is restarting, the client is recreated,
+//dropping its stale connections, and the worker waits for the daemon to be back.
+import (
+	"context"
+	"errors"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/sockets"
+	"github.com/docker/go-connections/tlsconfig"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DockerCertPathKey     = "DOCKER_CERT_PATH"
+	DockerTLSVerifyKey    = "DOCKER_TLS_VERIFY"
+	DockerAPIVersionKey   = "DOCKER_API_VERSION"
+	DockerPingIntervalKey = "DOCKER_PING_INTERVAL"
+
+	DefaultDockerPingInterval = 10 * time.Second
+)
+
+//This struct represents how the worker connects to the docker daemon.
+type DockerConfig struct {
+	//The daemon address (e.g unix:///var/run/docker.sock or tcp://127.0.0.1:2376).
+	//An address without scheme is a tcp one. The default is the local unix socket.
+	Host string
+	//The directory with the ca.pem, cert.pem and key.pem files. If it is set, TLS is used.
+	CertPath string
+	//Whether the daemon certificate is verified against the ca.pem
+	TLSVerify bool
+	//The API version. The default is the client's one.
+	APIVersion string
+}
+
+//It returns the config of the daemon at the host, whose TLS and API
+//version settings are read from the environment.
+func DockerConfigFromEnv(host string) DockerConfig {
+	return DockerConfig{
+		Host:       host,
+		CertPath:   os.Getenv(DockerCertPathKey),
+		TLSVerify:  os.Getenv(DockerTLSVerifyKey) != "",
+		APIVersion: os.Getenv(DockerAPIVersionKey),
+	}
+}
+
+//It is the docker client of the worker, which keeps track of the daemon reachability.
+type DockerClient struct {
+	config DockerConfig
+	//It guards the fields below, which are changed by the pings
+	lock      sync.RWMutex
+	cli       *client.Client
+	transport *http.Transport
+	reachable bool
+	//It is closed while the daemon is reachable
+	ready chan struct{}
+}
+
+//Creates the docker client of the daemon. No connection is made until the client is used.
+//The daemon is not taken as reachable until it answers a ping.
+//It returns:
+//1. nil and an error if the host or the TLS files are invalid
+//2. the client and nil otherwise
+func NewDockerClient(config DockerConfig) (*DockerClient, error) {
+	cli, transport, err := config.newClient()
+
+	if err != nil {
+		return nil, err
+	}
+
+	Log().With("docker_host", config.Host).Info("Starting docker client")
+	return &DockerClient{config: config, cli: cli, transport: transport, ready: make(chan struct{})}, nil
+}
+
+//It creates a client of the daemon, along with the transport of its connections.
+func (config DockerConfig) newClient() (*client.Client, *http.Transport, error) {
+	host := config.Host
+
+	if host == "" {
+		host = client.DefaultDockerHost
+	} else if !strings.Contains(host, "://") {
+		host = "tcp://" + host
+	}
+
+	proto, addr, _, err := client.ParseHost(host)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if proto != "unix" && proto != "tcp" {
+		return nil, nil, errors.New("The docker host [" + host + "] must be a unix or tcp address")
+	}
+
+	transport := new(http.Transport)
+
+	if err := sockets.ConfigureTransport(transport, proto, addr); err != nil {
+		return nil, nil, err
+	}
+
+	if config.CertPath != "" {
+		tlsConfig, err := tlsconfig.Client(tlsconfig.Options{
+			CAFile:             filepath.Join(config.CertPath, "ca.pem"),
+			CertFile:           filepath.Join(config.CertPath, "cert.pem"),
+			KeyFile:            filepath.Join(config.CertPath, "key.pem"),
+			InsecureSkipVerify: !config.TLSVerify,
+		})
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	version := config.APIVersion
+
+	if version == "" {
+		version = client.DefaultVersion
+	}
+
+	cli, err := client.NewClient(host, version, &http.Client{Transport: transport}, nil)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cli, transport, nil
+}
+
+//It returns the current client of the daemon, which is replaced when the daemon becomes unreachable.
+func (d *DockerClient) Client() *client.Client {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.cli
+}
+
+//It returns whether the daemon has answered the last ping.
+func (d *DockerClient) Reachable() bool {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.reachable
+}
+
+//It pings the daemon, updating its reachability. If the daemon has become
+//unreachable, the client is recreated, so the next requests use new connections.
+//It returns:
+//1. an error if the daemon hasn't answered the ping
+//2. nil otherwise
+func (d *DockerClient) Ping(ctx context.Context) error {
+	err := Ping(ctx, d.Client())
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	switch {
+	case err == nil && !d.reachable:
+		Log().Info("The docker daemon is reachable")
+		d.reachable = true
+		close(d.ready)
+	case err != nil && d.reachable:
+		Log().WithError(err).Warn("The docker daemon is unreachable; reconnecting")
+		d.reachable = false
+		d.ready = make(chan struct{})
+		d.reconnect()
+	}
+
+	return err
+}
+
+//It replaces the client by a new one. The lock must be held by the caller.
+//The slots may still be using the old client, so it isn't closed; only its idle
+//connections are, while the busy ones are kept until their requests are done.
+func (d *DockerClient) reconnect() {
+	cli, transport, err := d.config.newClient()
+
+	if err != nil {
+		Log().WithError(err).Error("Error on recreating the docker client")
+		return
+	}
+
+	d.transport.CloseIdleConnections()
+	d.cli, d.transport = cli, transport
+}
+
+//It blocks until the daemon is reachable.
+//It returns:
+//1. the context error, if the context is done before that
+//2. nil otherwise
+func (d *DockerClient) WaitReachable(ctx context.Context) error {
+	d.lock.RLock()
+	ready := d.ready
+	d.lock.RUnlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//It pings the daemon right away and then once per interval, until the context is done.
+func (d *DockerClient) Monitor(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		pingCtx, cancel := context.WithTimeout(ctx, interval)
+		d.Ping(pingCtx)
+		cancel()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
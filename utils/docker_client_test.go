@@ -0,0 +1,102 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewDockerClient(t *testing.T) {
+	//setup
+	hosts := []string{"", "unix:///var/run/docker.sock", "tcp://127.0.0.1:2376", "127.0.0.1:5555"}
+
+	for _, host := range hosts {
+		//exercise
+		docker, err := NewDockerClient(DockerConfig{Host: host})
+
+		//verification
+		if err != nil || docker.Client() == nil {
+			t.Errorf("The client of the host [%s] must be created, got [%v]", host, err)
+		}
+	}
+}
+
+func TestNewDockerClientWithInvalidConfig(t *testing.T) {
+	//setup
+	configs := []DockerConfig{
+		{Host: "ftp://127.0.0.1:2376"},
+		{Host: "tcp://127.0.0.1:2376", CertPath: "/nonexistent/certs", TLSVerify: true},
+	}
+
+	for _, config := range configs {
+		//exercise
+		docker, err := NewDockerClient(config)
+
+		//verification
+		if err == nil || docker != nil {
+			t.Errorf("The client of the config %+v must not be created", config)
+		}
+	}
+}
+
+func TestDockerClient_PingAndReconnect(t *testing.T) {
+	//setup
+	var down int32
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&down) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Write([]byte("OK"))
+	}))
+	defer daemon.Close()
+
+	docker, err := NewDockerClient(DockerConfig{Host: strings.TrimPrefix(daemon.URL, "http://")})
+
+	if err != nil {
+		t.Fatalf("Error on creating the docker client: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	//exercise
+	if docker.Reachable() || docker.WaitReachable(ctx) == nil {
+		t.Fatal("The daemon must not be reachable before answering a ping")
+	}
+
+	if err := docker.Ping(context.Background()); err != nil || !docker.Reachable() {
+		t.Fatalf("The daemon must be reachable, got [%v]", err)
+	}
+
+	if err := docker.WaitReachable(context.Background()); err != nil {
+		t.Errorf("The wait must return while the daemon is reachable, got [%v]", err)
+	}
+
+	previous := docker.Client()
+	atomic.StoreInt32(&down, 1)
+
+	//verification
+	if err := docker.Ping(context.Background()); err == nil || docker.Reachable() {
+		t.Fatal("The daemon must be unreachable")
+	}
+
+	if docker.Client() == previous {
+		t.Error("The client must be recreated once the daemon becomes unreachable")
+	}
+
+	atomic.StoreInt32(&down, 0)
+
+	if err := docker.Ping(context.Background()); err != nil || !docker.Reachable() {
+		t.Errorf("The daemon must be reachable again, got [%v]", err)
+	}
+
+	if err := Ping(context.Background(), previous); err != nil {
+		t.Errorf("The old client must be kept usable by the slots that still hold it, got [%v]", err)
+	}
+}
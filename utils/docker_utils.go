@@ -3,53 +3,63 @@ package utils
 //This file implements some functions that are usually called in sequence
 //to achieve some common results, some of them are listed below:
 //Create a container and let it ready: CheckImage; Pull; CreateContainer; StartContainer.
-//Copy a file from the host to the container: Copy.
-//To write some array of content to a file inside the container: Write.
-//To run a valid command inside the container: Exec
-//To kill/remove the container: StopContainer; RemoveContainer.
+//Copy a file or directory from the host to the container, or the other way around: Copy; CopyFrom.
+//To write some array of content to a file inside the container: Write; or WriteFile, for raw content.
+//To read a file inside the container: Read; or ReadLimited, to bound its size.
+//To archive a file or directory inside the container: ReadArchive.
+//To run a valid command inside the container: Exec; or ExecWait, to wait for its end;
+//or ExecWithInput, to send it some content, such as a secret, through its stdin.
+//To kill/remove the container: StopContainer or KillContainer; RemoveContainer.
 //Note that the sequence above is usually ran to use the container for the most common purposes.
 import (
+	"archive/tar"
 	"context"
+	"errors"
 	"fmt"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/client"
+	"github.com/docker/go-units"
 	"io"
 	"io/ioutil"
-	"log"
-	"net"
 	"os"
+	"path"
 	"strings"
 	"time"
 )
 
+const (
+	//Period between two checks of a running command
+	ExecPollingInterval = 500 * time.Millisecond
+)
+
+var (
+	//The content read from the container is bigger than the allowed size
+	ErrSizeLimitExceeded = errors.New("size limit exceeded")
+)
+
 type ContainerConfig struct {
 	Name   string
 	Image  string
 	Mounts []mount.Mount
+	//The CPU time (in microseconds) the container can use in each CPUPeriod.
+	//Zero means no limit.
+	CPUQuota  int64
+	CPUPeriod int64
+	//The memory limit (in bytes). Zero means no limit.
+	Memory int64
+	//The memory plus swap limit (in bytes). -1 means unlimited swap.
+	MemorySwap int64
+	//The maximum number of processes inside the container. Zero means no limit.
+	PidsLimit int64
+	Ulimits   []*units.Ulimit
+	//The environment variables of the container, as NAME=value
+	Env []string
 }
 
-//Creates a new docker client
-//Params:
-//host - the host address in which the client
-//will be created. (e.g 127.0.0.1:5555)
-//It returns:
-//1. nil if the host pattern is invalid
-//2. a docker client otherwise
-func NewDockerClient(host string) *client.Client {
-	if err := os.Setenv("DOCKER_HOST", host); err != nil {
-		log.Print(err)
-		return nil
-	}
-	log.Println("Starting docker client in host: " + host)
-	cli, err := client.NewEnvClient()
-
-	if err != nil {
-		log.Println(err)
-	}
-
-	return cli
+func containerLog(id string) *Logger {
+	return Log().With(ContainerIdField, id)
 }
 
 //Creates a container
@@ -62,21 +72,30 @@ func NewDockerClient(host string) *client.Client {
 //(e.g a already used container name)
 //2. the container id and nil otherwise.
 func CreateContainer(cli *client.Client, config ContainerConfig) (string, error) {
-	log.Printf("Creating Container [%s]", config.Name)
+	Log().With("container_name", config.Name).With("image", config.Image).Info("Creating container")
 	ctx := context.Background()
 	hostConfig := container.HostConfig{
 		Mounts: config.Mounts,
+		Resources: container.Resources{
+			CPUQuota:   config.CPUQuota,
+			CPUPeriod:  config.CPUPeriod,
+			Memory:     config.Memory,
+			MemorySwap: config.MemorySwap,
+			PidsLimit:  config.PidsLimit,
+			Ulimits:    config.Ulimits,
+		},
 	}
 
 	dconfig := container.Config{
 		Image: config.Image,
 		Tty:   true,
+		Env:   config.Env,
 	}
 
 	b, err := cli.ContainerCreate(ctx, &dconfig, &hostConfig, nil, config.Name)
 
 	if err != nil {
-		log.Println(err)
+		Log().With("container_name", config.Name).WithError(err).Error("Error on creating container")
 	}
 
 	return b.ID, err
@@ -90,7 +109,7 @@ func CreateContainer(cli *client.Client, config ContainerConfig) (string, error)
 //1. an error if the passed id doesn't exists
 //2. nil otherwise.
 func StartContainer(cli *client.Client, id string) error {
-	log.Printf("Starting Container [%s]", id)
+	containerLog(id).Info("Starting container")
 	return cli.ContainerStart(context.Background(), id, types.ContainerStartOptions{})
 }
 
@@ -102,11 +121,44 @@ func StartContainer(cli *client.Client, id string) error {
 //1. an error if the passed id doesn't exists
 //2. nil otherwise.
 func StopContainer(cli *client.Client, id string) error {
-	log.Printf("Stopping Container [%s]", id)
+	containerLog(id).Info("Stopping container")
 	var timeout = 5 * time.Second
 	return cli.ContainerStop(context.Background(), id, &timeout)
 }
 
+//Kills a container, which doesn't give its processes the chance to stop gracefully
+//Params:
+//cli - the docker client
+//id - the container id
+//It returns:
+//1. an error if the passed id doesn't exists
+//2. nil otherwise.
+func KillContainer(cli *client.Client, id string) error {
+	containerLog(id).Info("Killing container")
+	return cli.ContainerKill(context.Background(), id, "SIGKILL")
+}
+
+//Checks if some process of the container has been killed for running out of memory
+//Params:
+//cli - the docker client
+//id - the container id
+//It returns:
+//1. false and an error if the passed id doesn't exists
+//2. whether the container has been OOM killed and nil otherwise.
+func IsOOMKilled(cli *client.Client, id string) (bool, error) {
+	info, err := cli.ContainerInspect(context.Background(), id)
+
+	if err != nil {
+		return false, err
+	}
+
+	if info.ContainerJSONBase == nil || info.State == nil {
+		return false, nil
+	}
+
+	return info.State.OOMKilled, nil
+}
+
 //Removes a container
 //Params:
 //cli - the docker client
@@ -115,13 +167,13 @@ func StopContainer(cli *client.Client, id string) error {
 //1. an error if the passed id doesn't exists
 //2. nil otherwise.
 func RemoveContainer(cli *client.Client, id string) error {
-	log.Printf("Removing Container [%s]", id)
+	containerLog(id).Info("Removing container")
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	defer cancel()
 	return cli.ContainerRemove(ctx, id, types.ContainerRemoveOptions{})
 }
 
-//Iterates over the content and write each one to the destination file inside the container
+//Writes the content to the destination file inside the container, one line per position
 //Params:
 //cli - the docker client
 //id - the container id
@@ -132,35 +184,82 @@ func RemoveContainer(cli *client.Client, id string) error {
 //1. an error if the passed id doesn't exists or if the destination file is a invalid one
 //2. nil otherwise.
 func Write(cli *client.Client, id string, content []string, dest string) error {
-	for _, c := range content {
-		c = strings.ReplaceAll(c, "'", "'\"'\"'")
-		cmd := fmt.Sprintf(`echo -E '%s' >> %s`, c, dest)
-		log.Printf("Writing [%s] on [%s] from Container [%s]", c, dest, id)
-		err := Exec(cli, id, cmd)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+	lines := strings.Join(content, "\n") + "\n"
+	containerLog(id).With("dest", dest).Debugf("Writing %d lines", len(content))
+	return WriteFile(cli, id, []byte(lines), dest, 0644)
 }
 
-//It copies the src file, which lives in the worker host,
-//to the dest file inside the container.
+//Writes the content to the destination file inside the container, creating its missing parent directories
 //Params:
 //cli - the docker client
 //id - the container id
-//src - the source file path (in the worker host)
-//dest - the destination file, inside the container
+//content - the file content, which can be binary
+//dest - the destination file absolute path, inside the container.
+//mode - the file permissions
 //It returns:
 //1. an error if the passed id doesn't exists or if the destination file is a invalid one
 //2. nil otherwise.
+func WriteFile(cli *client.Client, id string, content []byte, dest string, mode os.FileMode) error {
+	if !path.IsAbs(dest) {
+		return errors.New("The destination path [" + dest + "] must be absolute")
+	}
+
+	archive, err := ArchiveContent(strings.TrimPrefix(path.Clean(dest), "/"), content, mode)
+
+	if err != nil {
+		return err
+	}
+
+	return cli.CopyToContainer(context.Background(), id, "/", archive, types.CopyToContainerOptions{})
+}
+
+//It copies the src file or directory, which lives in the worker host,
+//to the dest path inside the container, keeping its permissions.
+//Params:
+//cli - the docker client
+//id - the container id
+//src - the source file or directory path (in the worker host)
+//dest - the destination absolute path, inside the container
+//It returns:
+//1. an error if the passed id doesn't exists or if the destination path is a invalid one
+//2. nil otherwise.
 func Copy(cli *client.Client, id, src, dest string) error {
-	log.Printf("Copy [%s] to [%s] from Container [%s]", src, dest, id)
-	dat, _ := ioutil.ReadFile(src)
-	content := string(dat)
-	content = strings.ReplaceAll(content, "'", "'\"'\"'")
-	cmd := fmt.Sprintf("echo -E '%s' >| %s", content, dest)
-	return Exec(cli, id, cmd)
+	containerLog(id).With("src", src).With("dest", dest).Debug("Copying to container")
+
+	if !path.IsAbs(dest) {
+		return errors.New("The destination path [" + dest + "] must be absolute")
+	}
+
+	if _, err := os.Stat(src); err != nil {
+		return err
+	}
+
+	archive := ArchivePath(src, strings.TrimPrefix(path.Clean(dest), "/"))
+	defer archive.Close()
+
+	return cli.CopyToContainer(context.Background(), id, "/", archive, types.CopyToContainerOptions{})
+}
+
+//It copies the src file or directory, which lives inside the container,
+//to the dest path in the worker host, keeping its permissions.
+//Params:
+//cli - the docker client
+//id - the container id
+//src - the source file or directory path, inside the container
+//dest - the destination path (in the worker host)
+//It returns:
+//1. an error if the passed id or the source path doesn't exists
+//2. nil otherwise.
+func CopyFrom(cli *client.Client, id, src, dest string) error {
+	containerLog(id).With("src", src).With("dest", dest).Debug("Copying from container")
+	reader, _, err := cli.CopyFromContainer(context.Background(), id, src)
+
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	return ExtractArchive(reader, dest)
 }
 
 //Executes a bash command inside the container
@@ -173,7 +272,7 @@ func Copy(cli *client.Client, id, src, dest string) error {
 //(e.g call a binary that doesn't exists), or if the id doesn't exists
 //2. nil otherwise.
 func Exec(cli *client.Client, id, cmd string) error {
-	log.Printf("Executing command [%s] on container [%s]", cmd, id)
+	containerLog(id).With("cmd", cmd).Debug("Executing command")
 	config := types.ExecConfig{
 		Cmd: []string{"/bin/bash", "-c", cmd},
 	}
@@ -181,65 +280,198 @@ func Exec(cli *client.Client, id, cmd string) error {
 	return cli.ContainerExecStart(context.Background(), rid.ID, types.ExecStartCheck{})
 }
 
-//Executes cat in a file inside the container and returns its output
+//Executes a bash command inside the container and waits until it finishes
 //Params:
+//ctx - the context that bounds the waiting
 //cli - the docker client
 //id - the container id
-//path - the file path inside the container
+//cmd - the bash command (e.g "echo 'arrebol'")
+//It returns:
+//1. -1 and an error if the command couldn't be executed inside the container,
+//or if the context is done before the command finishes
+//2. the command exit code and nil otherwise.
+func ExecWait(ctx context.Context, cli *client.Client, id, cmd string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return -1, err
+	}
+
+	containerLog(id).With("cmd", cmd).Debug("Executing command")
+	config := types.ExecConfig{
+		Cmd: []string{"/bin/bash", "-c", cmd},
+	}
+	rid, err := cli.ContainerExecCreate(ctx, id, config)
+
+	if err != nil {
+		return -1, err
+	}
+
+	if err = cli.ContainerExecStart(ctx, rid.ID, types.ExecStartCheck{}); err != nil {
+		return -1, err
+	}
+
+	return waitExec(ctx, cli, rid.ID)
+}
+
+//Executes a bash command inside the container, writing the input to its stdin, and waits until it finishes.
+//The input is not logged, so it is the way secret content is sent to the container.
+//Params:
+//ctx - the context that bounds the waiting
+//cli - the docker client
+//id - the container id
+//cmd - the bash command (e.g "cat > /tmp/file")
+//input - the content written to the command's stdin
 //It returns:
-//1. nil and an error if the id doesn't exists,
-//or if the file path is invalid.
-//2. The file content as byte array and nil otherwise.
-func Read(cli *client.Client, id, path string) ([]byte, error) {
-	log.Printf("Getting content of file [%s]", path)
+//1. -1 and an error if the command couldn't be executed inside the container,
+//or if the context is done before the command finishes
+//2. the command exit code and nil otherwise.
+func ExecWithInput(ctx context.Context, cli *client.Client, id, cmd string, input []byte) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return -1, err
+	}
+
+	containerLog(id).With("cmd", cmd).Debugf("Executing command with %d bytes of input", len(input))
 	config := types.ExecConfig{
-		Tty:          true,
-		AttachStderr: true,
-		AttachStdout: true,
-		Cmd:          []string{"/bin/bash", "-c", "cat " + path},
+		AttachStdin: true,
+		Cmd:         []string{"/bin/bash", "-c", cmd},
 	}
-	rid, err := cli.ContainerExecCreate(context.Background(), id, config)
+	rid, err := cli.ContainerExecCreate(ctx, id, config)
+
 	if err != nil {
-		log.Println("error on creating container exec" + err.Error())
+		return -1, err
 	}
-	hijack, err := cli.ContainerExecAttach(context.Background(), rid.ID, config)
+
+	resp, err := cli.ContainerExecAttach(ctx, rid.ID, config)
 
 	if err != nil {
-		return nil, err
+		return -1, err
+	}
+	defer resp.Close()
+
+	if _, err := resp.Conn.Write(input); err != nil {
+		return -1, err
+	}
+
+	if err := resp.CloseWrite(); err != nil {
+		return -1, err
+	}
+
+	return waitExec(ctx, cli, rid.ID)
+}
+
+//It polls the exec until it finishes, returning its exit code.
+func waitExec(ctx context.Context, cli *client.Client, execId string) (int, error) {
+	ticker := time.NewTicker(ExecPollingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return -1, ctx.Err()
+		case <-ticker.C:
+			inspect, err := cli.ContainerExecInspect(ctx, execId)
+
+			if err != nil {
+				return -1, err
+			}
+
+			if !inspect.Running {
+				return inspect.ExitCode, nil
+			}
+		}
 	}
-	output, err := read(hijack.Conn)
+}
+
+//Reads a file inside the container through the docker archive API
+//Params:
+//cli - the docker client
+//id - the container id
+//path - the file path inside the container
+//limit - the maximum size (in bytes) of the file
+//It returns:
+//1. nil and an error wrapping ErrSizeLimitExceeded if the file is bigger than the limit
+//2. nil and an error if the id doesn't exists, or if the file path is invalid.
+//3. The file content as byte array and nil otherwise.
+func Read(cli *client.Client, id, path string, limit int64) ([]byte, error) {
+	content, truncated, err := ReadLimited(cli, id, path, limit)
 
 	if err != nil {
 		return nil, err
 	}
-	return output, nil
+
+	if truncated {
+		return nil, fmt.Errorf("The file [%s] is bigger than %d bytes: %w", path, limit, ErrSizeLimitExceeded)
+	}
+
+	return content, nil
 }
 
-//It reads the content that comes from the connection received
-//as parameter
+//Reads a file inside the container through the docker archive API, up to the limit
 //Params:
-//conn - the connection from which the content is read
+//cli - the docker client
+//id - the container id
+//path - the file path inside the container
+//limit - the maximum amount of bytes to be read
 //It returns:
-//1. nil and an error, if there is no content in the connection socket
-//2. a byte array with the content that came from the connection and nil otherwise
-func read(conn net.Conn) ([]byte, error) {
-	result := make([]byte, 0)
-	b := make([]byte, 10)
-	for {
-		n, err := conn.Read(b)
+//1. nil, false and an error if the id doesn't exists, or if the file path is invalid.
+//2. The first limit bytes of the file, whether the file has been truncated, and nil otherwise.
+func ReadLimited(cli *client.Client, id, path string, limit int64) ([]byte, bool, error) {
+	containerLog(id).With("path", path).Debugf("Reading up to %d bytes of file", limit)
+	reader, _, err := cli.CopyFromContainer(context.Background(), id, path)
 
-		if err != nil {
-			log.Println(err)
-			return nil, err
-		}
+	if err != nil {
+		return nil, false, err
+	}
+	defer reader.Close()
 
-		result = append(result, b...)
-		if n < len(b) {
-			break
-		}
-		b = make([]byte, 2*len(b))
+	archive := tar.NewReader(reader)
+	header, err := archive.Next()
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	content, err := ioutil.ReadAll(io.LimitReader(archive, limit))
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	return content, header.Size > limit, nil
+}
+
+//Reads a file or directory inside the container as a tar archive, up to the limit,
+//and writes it to dest, so the archive is never held in memory.
+//Params:
+//cli - the docker client
+//id - the container id
+//path - the file or directory path inside the container
+//dest - the writer the archive is written to
+//limit - the maximum size (in bytes) of the archive
+//It returns:
+//1. an error wrapping ErrSizeLimitExceeded if the archive is bigger than the limit,
+//in which case dest may have got part of the archive
+//2. an error if the id doesn't exists, if the path is invalid or if dest couldn't be written
+//3. The size of the archive and nil otherwise.
+func ReadArchive(cli *client.Client, id, path string, dest io.Writer, limit int64) (int64, error) {
+	containerLog(id).With("path", path).Debugf("Archiving up to %d bytes", limit)
+	reader, _, err := cli.CopyFromContainer(context.Background(), id, path)
+
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	size, err := io.Copy(dest, io.LimitReader(reader, limit+1))
+
+	if err != nil {
+		return 0, err
+	}
+
+	if size > limit {
+		return 0, fmt.Errorf("The archive of [%s] is bigger than %d bytes: %w", path, limit, ErrSizeLimitExceeded)
 	}
-	return result, nil
+
+	return size, nil
 }
 
 //Downloads a docker image
@@ -271,3 +503,12 @@ func CheckImage(cli *client.Client, image string) (exist bool, err error) {
 	}
 	return
 }
+
+//It checks if the docker daemon of the client is reachable.
+//It returns:
+//1. an error if the daemon hasn't answered the ping
+//2. nil otherwise
+func Ping(ctx context.Context, cli *client.Client) error {
+	_, err := cli.Ping(ctx)
+	return err
+}
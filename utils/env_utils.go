@@ -0,0 +1,55 @@
+package utils
+
+//This module implements the reading of typed settings from the environment,
+//which is loaded from the .env file when the worker starts.
+import (
+	"math"
+	"os"
+	"strconv"
+	"time"
+)
+
+//It reads a duration (e.g "30s") from the environment.
+//It returns the default value if the key is not set or its value is invalid.
+func DurationFromEnv(key string, defaultValue time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+
+	if err != nil || value <= 0 {
+		return defaultValue
+	}
+
+	return value
+}
+
+//It reads a number, which must range from min to max, from the environment.
+//It returns the default value if the key is not set or its value is invalid,
+//warning about the invalid ones.
+func floatFromEnv(key string, defaultValue, min, max float64) float64 {
+	raw := os.Getenv(key)
+
+	if raw == "" {
+		return defaultValue
+	}
+
+	value, err := strconv.ParseFloat(raw, 64)
+
+	if err != nil || math.IsNaN(value) || value < min || value > max {
+		Log().With("key", key).With("value", raw).With("default", defaultValue).
+			Warnf("The setting must range from %v to %v; using the default one", min, max)
+		return defaultValue
+	}
+
+	return value
+}
+
+//It reads an integer from the environment.
+//It returns the default value if the key is not set or its value is invalid.
+func Int64FromEnv(key string, defaultValue int64) int64 {
+	value, err := strconv.ParseInt(os.Getenv(key), 10, 64)
+
+	if err != nil || value < 0 {
+		return defaultValue
+	}
+
+	return value
+}
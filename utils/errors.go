@@ -0,0 +1,97 @@
+package utils
+
+//This module implements the error taxonomy of the communication with the server.
+//Each request error carries one of the kinds below, so the callers are able to
+//decide what to do by checking it with errors.Is (e.g rejoin when the
+//authentication has expired, back off when the server is unavailable).
+import (
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+var (
+	//The worker's token is missing, invalid or expired
+	ErrUnauthorized = errors.New("unauthorized")
+	//The worker is authenticated, but isn't allowed to do the request (e.g it has been banned),
+	//so joining the server again doesn't help
+	ErrForbidden = errors.New("forbidden")
+	//The server has no task to dispatch to the worker
+	ErrNoTask = errors.New("no task available")
+	//The requested resource doesn't exist in the server
+	ErrNotFound = errors.New("not found")
+	//The server couldn't be reached or has failed to handle the request
+	ErrServerUnavailable = errors.New("server unavailable")
+	//The request or the response content couldn't be (un)marshalled
+	ErrMalformedPayload = errors.New("malformed payload")
+	//The server has refused the request for any other reason
+	ErrRequestRejected = errors.New("request rejected")
+	//The request couldn't be signed with the worker's private key
+	ErrSigningFailed = errors.New("signing failed")
+)
+
+type RequestError struct {
+	//One of the error kinds above
+	Kind error
+	//The response status code, if the server has answered
+	StatusCode int
+	Endpoint   string
+	Err        error
+}
+
+func (e *RequestError) Error() string {
+	msg := e.Kind.Error() + " on " + e.Endpoint
+
+	if e.StatusCode != 0 {
+		msg += " (status code " + strconv.Itoa(e.StatusCode) + ")"
+	}
+
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+
+	return msg
+}
+
+func (e *RequestError) Is(target error) bool {
+	return e.Kind == target
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+func NewRequestError(kind error, endpoint string, err error) *RequestError {
+	return &RequestError{Kind: kind, Endpoint: endpoint, Err: err}
+}
+
+//It classifies the response by its status code.
+//It returns:
+//1. nil if the status code is a successful one
+//2. the RequestError of the matching kind otherwise
+func CheckStatus(response *HttpResponse, endpoint string) error {
+	code := response.StatusCode
+
+	if code >= 200 && code < 300 {
+		return nil
+	}
+
+	var kind error
+
+	switch {
+	case code == http.StatusUnauthorized:
+		kind = ErrUnauthorized
+	case code == http.StatusForbidden:
+		kind = ErrForbidden
+	case code == http.StatusNotFound:
+		kind = ErrNotFound
+	case code == http.StatusBadRequest || code == http.StatusUnprocessableEntity:
+		kind = ErrMalformedPayload
+	case code == http.StatusTooManyRequests || code >= 500:
+		kind = ErrServerUnavailable
+	default:
+		kind = ErrRequestRejected
+	}
+
+	return &RequestError{Kind: kind, StatusCode: code, Endpoint: endpoint}
+}
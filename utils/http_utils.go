@@ -3,11 +3,13 @@ package utils
 import (
 	"bytes"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 )
 
 type HTTPClient interface {
@@ -16,11 +18,27 @@ type HTTPClient interface {
 
 const (
 	SIGNATURE_KEY_PATTERN = "Signature"
+	//The headers of the request components covered by the signature
+	DATE_KEY_PATTERN   = "Date"
+	DIGEST_KEY_PATTERN = "Digest"
+	NONCE_KEY_PATTERN  = "Nonce"
+
+	//How long a download may take, including the reading of its body
+	DownloadTimeout = 10 * time.Minute
+	//How many redirects a download may follow, as the default http client does
+	DownloadMaxRedirects = 10
 )
 
 var (
-	Client       HTTPClient                                        = &http.Client{}
-	GetSignature func(payload interface{}, workerId string) []byte = getSignature
+	Client       HTTPClient                                                    = &http.Client{}
+	GetSignature func(message []byte, workerId string) ([]byte, string, error) = getSignature
+	//The client of the downloads, whose sources may be out of the server
+	DownloadClient HTTPClient = &http.Client{Timeout: DownloadTimeout, CheckRedirect: stripCredentialsOnRedirect}
+	//The headers that carry the worker's credentials, which aren't sent to other origins
+	credentialHeaders = []string{"arrebol-worker-token", SIGNATURE_KEY_PATTERN, DIGEST_KEY_PATTERN, NONCE_KEY_PATTERN}
+	//It guards the lastServerContact, which is set by the requests of every slot
+	contactLock       sync.RWMutex
+	lastServerContact time.Time
 )
 
 type HttpResponse struct {
@@ -29,113 +47,251 @@ type HttpResponse struct {
 	StatusCode int
 }
 
-func getSignature(payload interface{}, workerId string) []byte {
-	parsedPayload, err := json.Marshal(payload)
+//It sends the request with the Client, observing its latency and recording the
+//server contact if the server has answered it.
+func do(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := Client.Do(req)
+	observeRequest(req, resp, time.Since(start))
 
-	if err != nil {
-		log.Fatal("Error on marshalling the payload")
+	if err == nil && resp.StatusCode < 500 && endpointLabel(req.URL) != OtherEndpoint {
+		contactLock.Lock()
+		lastServerContact = time.Now()
+		contactLock.Unlock()
 	}
 
-	signature, _ := SignMessage(GetPrivateKey(workerId), parsedPayload)
+	return resp, err
+}
 
-	return signature
+//It returns when the server has answered a request for the last time.
+//The time is zero if the server has never answered.
+func LastServerContact() time.Time {
+	contactLock.RLock()
+	defer contactLock.RUnlock()
+	return lastServerContact
 }
 
-func AddSignature(workerId string, payload interface{}, headers http.Header) http.Header {
-	signature := GetSignature(payload, workerId)
-	strSignature := fmt.Sprintf("%v", signature)
-	headers.Set(SIGNATURE_KEY_PATTERN, strSignature)
-	return headers
+//It signs the canonical request with the worker's private key.
+//It returns the signature and its algorithm.
+func getSignature(message []byte, workerId string) ([]byte, string, error) {
+	privateKey, err := GetPrivateKey(workerId)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	return SignMessage(privateKey, message)
 }
 
 func Post(workerId string, body interface{}, headers http.Header, endpoint string) (*HttpResponse, error) {
-	headers = AddSignature(workerId, body, headers)
-
 	requestBody, err := json.Marshal(body)
 
 	if err != nil {
-		log.Fatal("Unable to marshal body")
+		return nil, NewRequestError(ErrMalformedPayload, endpoint, err)
 	}
 
 	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewBuffer(requestBody))
 	if err != nil {
-		return nil, err
+		return nil, NewRequestError(ErrMalformedPayload, endpoint, err)
 	}
 
 	req.Header = headers
 
-	resp, err := Client.Do(req)
+	if err := SignRequest(workerId, req, requestBody); err != nil {
+		return nil, err
+	}
+
+	resp, err := do(req)
 
 	if err != nil {
-		return nil, err
+		return nil, NewRequestError(ErrServerUnavailable, endpoint, err)
 	}
 	defer resp.Body.Close()
 
 	respBody, err := ioutil.ReadAll(resp.Body)
 
 	if err != nil {
-		return nil, err
+		return nil, NewRequestError(ErrServerUnavailable, endpoint, err)
 	}
 
-	return &HttpResponse{Body: respBody, Headers: resp.Header, StatusCode: resp.StatusCode}, nil
+	response := &HttpResponse{Body: respBody, Headers: resp.Header, StatusCode: resp.StatusCode}
+	return response, CheckStatus(response, endpoint)
 }
 
 func Get(workerId string, endpoint string, header http.Header) (*HttpResponse, error) {
-	header = AddSignature(workerId, endpoint, header)
-
 	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
 
 	if err != nil {
-		return nil, err
+		return nil, NewRequestError(ErrMalformedPayload, endpoint, err)
 	}
 
 	req.Header = header
 
-	resp, err := Client.Do(req)
-	if err != nil {
+	if err := SignRequest(workerId, req, nil); err != nil {
 		return nil, err
 	}
 
+	resp, err := do(req)
+	if err != nil {
+		return nil, NewRequestError(ErrServerUnavailable, endpoint, err)
+	}
+
 	defer resp.Body.Close()
 
 	respBody, err := ioutil.ReadAll(resp.Body)
 
 	if err != nil {
-		log.Println("The following error occurred on parsing response body: " + err.Error())
-		return &HttpResponse{nil, resp.Header, resp.StatusCode}, err
+		Log().WithError(err).Error("Error on reading the response body")
+		return &HttpResponse{nil, resp.Header, resp.StatusCode}, NewRequestError(ErrServerUnavailable, endpoint, err)
 	}
 
-	return &HttpResponse{Body: respBody, Headers: resp.Header, StatusCode: resp.StatusCode}, nil
+	response := &HttpResponse{Body: respBody, Headers: resp.Header, StatusCode: resp.StatusCode}
+	return response, CheckStatus(response, endpoint)
 }
 
 func Put(workerId string, body interface{}, headers http.Header, endpoint string) (*HttpResponse, error) {
-	headers = AddSignature(workerId, body, headers)
-
 	requestBody, err := json.Marshal(body)
 
 	if err != nil {
-		return nil, errors.New("Unable to marshal body")
+		return nil, NewRequestError(ErrMalformedPayload, endpoint, err)
 	}
 
 	req, err := http.NewRequest(http.MethodPut, endpoint, bytes.NewBuffer(requestBody))
 
 	if err != nil {
+		return nil, NewRequestError(ErrMalformedPayload, endpoint, err)
+	}
+
+	req.Header = headers
+
+	if err := SignRequest(workerId, req, requestBody); err != nil {
 		return nil, err
 	}
 
+	resp, err := do(req)
+
+	if err != nil {
+		return nil, NewRequestError(ErrServerUnavailable, endpoint, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		return nil, NewRequestError(ErrServerUnavailable, endpoint, err)
+	}
+
+	response := &HttpResponse{Body: respBody, Headers: resp.Header, StatusCode: resp.StatusCode}
+	return response, CheckStatus(response, endpoint)
+}
+
+//It sends raw content, such as task logs or artifacts, to the endpoint.
+//The request is signed in the same way as the json ones, its digest covering the raw content.
+//Params:
+//workerId - the id of the worker whose key signs the content
+//content - the content to be sent as the request body
+//contentType - the content media type (e.g text/plain)
+//headers - the request headers
+//endpoint - the server endpoint
+//It returns:
+//1. nil and an error if the server couldn't be reached
+//2. the response and an error if the server has refused the content
+//3. the response and nil otherwise
+func Upload(workerId string, content []byte, contentType string, headers http.Header, endpoint string) (*HttpResponse, error) {
+	headers.Set("Content-Type", contentType)
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(content))
+
+	if err != nil {
+		return nil, NewRequestError(ErrMalformedPayload, endpoint, err)
+	}
+
 	req.Header = headers
-	resp, err := Client.Do(req)
+
+	if err := SignRequest(workerId, req, content); err != nil {
+		return nil, err
+	}
+
+	resp, err := do(req)
 
 	if err != nil {
-		return nil, errors.New("Unable to reach the server on endpoint: " + endpoint)
+		return nil, NewRequestError(ErrServerUnavailable, endpoint, err)
 	}
 	defer resp.Body.Close()
 
 	respBody, err := ioutil.ReadAll(resp.Body)
 
 	if err != nil {
-		return nil, errors.New("Error on parsing the body to byte")
+		return nil, NewRequestError(ErrServerUnavailable, endpoint, err)
+	}
+
+	response := &HttpResponse{Body: respBody, Headers: resp.Header, StatusCode: resp.StatusCode}
+	return response, CheckStatus(response, endpoint)
+}
+
+//It downloads the content of the endpoint with the DownloadClient, whose timeout bounds
+//the reading of the body as well. The request is only signed if the worker id is set,
+//so the worker's credentials are sent to the server alone; nor are they sent along
+//a redirect to another origin.
+//Params:
+//workerId - the id of the worker whose key signs the request, or empty for an unsigned one
+//endpoint - the URL of the content
+//header - the request headers
+//It returns:
+//1. nil and an error if the endpoint couldn't be reached or hasn't answered successfully.
+//The server's answers are classified as in CheckStatus, while the others aren't, since
+//they say nothing about the worker's standing in the server.
+//2. the content reader, which the caller must close, and nil otherwise
+func Download(workerId string, endpoint string, header http.Header) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+
+	if err != nil {
+		return nil, NewRequestError(ErrMalformedPayload, endpoint, err)
+	}
+
+	req.Header = header
+
+	if workerId != "" {
+		if err := SignRequest(workerId, req, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := DownloadClient.Do(req)
+
+	if err != nil {
+		return nil, NewRequestError(ErrServerUnavailable, endpoint, err)
+	}
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp.Body, nil
+	}
+
+	defer resp.Body.Close()
+
+	if workerId == "" {
+		return nil, fmt.Errorf("The source [%s] has answered with status code %d", endpoint, resp.StatusCode)
+	}
+
+	return nil, CheckStatus(&HttpResponse{Headers: resp.Header, StatusCode: resp.StatusCode}, endpoint)
+}
+
+//It removes the worker's credentials from a redirected download whose origin differs
+//from the one of the first request, since the http client copies the custom headers
+//to every redirect.
+//It returns an error if the download has already followed too many redirects.
+func stripCredentialsOnRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= DownloadMaxRedirects {
+		return fmt.Errorf("stopped after %d redirects", DownloadMaxRedirects)
+	}
+
+	first := via[0].URL
+
+	if !strings.EqualFold(req.URL.Scheme, first.Scheme) || !strings.EqualFold(req.URL.Host, first.Host) {
+		for _, key := range credentialHeaders {
+			req.Header.Del(key)
+		}
 	}
 
-	return &HttpResponse{Body: respBody, Headers: resp.Header, StatusCode: resp.StatusCode}, nil
+	return nil
 }
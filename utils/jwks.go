@@ -0,0 +1,327 @@
+package utils
+
+//This module implements the set of the server's public keys, which verify the
+//tokens the server assigns to the worker. The keys are fetched from a JWKS endpoint
+//and cached, being fetched again once the cache expires or a token is signed by a
+//key the cache doesn't know. When pins are configured, only the keys whose pin
+//(the base64 sha256 of their PKIX encoding) is among them are trusted, so a
+//compromised endpoint can't make the worker accept tokens it has signed.
+//Without an endpoint, the set only has the server key at KEYS_PATH (server.pub).
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ServerJWKSURLKey  = "SERVER_JWKS_URL"
+	ServerKeyPinsKey  = "SERVER_KEY_PINS"
+	ServerJWKSTTLKey  = "SERVER_JWKS_TTL"
+	ServerKeyFileName = "server"
+
+	DefaultJWKSTTL = time.Hour
+	//The least time between two fetches of the set, successful or not, so the tokens
+	//signed by unknown keys and a failing endpoint don't make the worker flood it
+	MinJWKSRefreshInterval = 30 * time.Second
+	//How long a fetch of the set may take, including the reading of its body
+	JWKSFetchTimeout = 10 * time.Second
+	//(Bytes) of the set served by the endpoint
+	MaxJWKSSize = 1024 * 1024
+)
+
+//This struct represents where the server's keys come from, and which of them are trusted.
+type KeySetConfig struct {
+	//The JWKS endpoint. If it is empty, the server key at KEYS_PATH is used.
+	URL string
+	//The pins of the trusted keys. If it is empty, every key of the set is trusted.
+	Pins []string
+	//How long the fetched keys are cached
+	TTL time.Duration
+}
+
+//It reads the key set config from the environment, whose pins are comma separated.
+func KeySetConfigFromEnv() KeySetConfig {
+	pins := make([]string, 0)
+
+	for _, pin := range strings.Split(os.Getenv(ServerKeyPinsKey), ",") {
+		if pin = strings.TrimSpace(pin); pin != "" {
+			pins = append(pins, pin)
+		}
+	}
+
+	return KeySetConfig{
+		URL:  os.Getenv(ServerJWKSURLKey),
+		Pins: pins,
+		TTL:  DurationFromEnv(ServerJWKSTTLKey, DefaultJWKSTTL),
+	}
+}
+
+//It is the cached set of the server's public keys, indexed by their key ids.
+type KeySet struct {
+	config KeySetConfig
+	pins   map[string]bool
+	//It guards the fields below, which are replaced by each fetch
+	lock      sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+	//When the set has been fetched for the last time, even if the fetch has failed
+	attemptedAt time.Time
+	//for test purpose
+	now func() time.Time
+}
+
+//This struct represents a JSON Web Key Set, as served by the JWKS endpoint.
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+//This struct represents a JSON Web Key. Only the RSA and the EC P-256 keys are supported.
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+//It creates the key set, which is empty until a key is requested.
+func NewKeySet(config KeySetConfig) *KeySet {
+	if config.TTL <= 0 {
+		config.TTL = DefaultJWKSTTL
+	}
+
+	pins := make(map[string]bool)
+
+	for _, pin := range config.Pins {
+		pins[pin] = true
+	}
+
+	return &KeySet{config: config, pins: pins, now: time.Now}
+}
+
+//It returns the pin of the public key, which is the base64 sha256 of its PKIX encoding.
+func KeyPin(publicKey crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(der)
+	return base64.StdEncoding.EncodeToString(sum[:]), nil
+}
+
+//It returns the trusted server key of the key id, fetching the set if the cache
+//has expired or doesn't know the key id. An empty key id is only resolved if the
+//set has a single key. The key id is ignored if the set is the server key file,
+//which has no key id.
+//It returns an error if there is no trusted key of the key id.
+func (s *KeySet) Key(kid string) (crypto.PublicKey, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.config.URL == "" {
+		kid = ""
+	}
+
+	now := s.now()
+	key, known := s.lookup(kid)
+	expired := now.Sub(s.fetchedAt) >= s.config.TTL
+	canRefresh := now.Sub(s.attemptedAt) >= MinJWKSRefreshInterval
+
+	if canRefresh && (expired || !known) {
+		s.attemptedAt = now
+		keys, err := s.fetch()
+
+		if err != nil {
+			if !known {
+				return nil, fmt.Errorf("Error on fetching the server keys: %w", err)
+			}
+
+			//the cached key is kept while the endpoint is failing
+			Log().WithError(err).Warn("Error on fetching the server keys; using the cached ones")
+		} else {
+			s.keys, s.fetchedAt = keys, now
+			key, known = s.lookup(kid)
+		}
+	}
+
+	if !known {
+		return nil, errors.New("There is no trusted server key of id [" + kid + "]")
+	}
+
+	return key, nil
+}
+
+func (s *KeySet) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(s.keys) == 1 {
+		for _, key := range s.keys {
+			return key, true
+		}
+	}
+
+	key, ok := s.keys[kid]
+	return key, ok
+}
+
+//It fetches the keys, dropping the untrusted ones.
+//It returns an error if the keys couldn't be fetched, or none of them is trusted.
+func (s *KeySet) fetch() (map[string]crypto.PublicKey, error) {
+	var fetched map[string]crypto.PublicKey
+	var err error
+
+	if s.config.URL == "" {
+		fetched, err = s.readKeyFile()
+	} else {
+		fetched, err = s.fetchJWKS()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	trusted := make(map[string]crypto.PublicKey)
+
+	for kid, key := range fetched {
+		pin, err := KeyPin(key)
+
+		if err != nil || (len(s.pins) > 0 && !s.pins[pin]) {
+			Log().With("kid", kid).With("pin", pin).Warn("Ignoring a server key that is not pinned")
+			continue
+		}
+
+		trusted[kid] = key
+	}
+
+	if len(trusted) == 0 {
+		return nil, errors.New("None of the server keys is trusted")
+	}
+
+	return trusted, nil
+}
+
+func (s *KeySet) readKeyFile() (map[string]crypto.PublicKey, error) {
+	key, err := GetPublicKey(ServerKeyFileName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]crypto.PublicKey{"": key}, nil
+}
+
+//It fetches the set from the JWKS endpoint, within the JWKSFetchTimeout and up to the MaxJWKSSize.
+func (s *KeySet) fetchJWKS() (map[string]crypto.PublicKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), JWKSFetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodGet, s.config.URL, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := do(req.WithContext(ctx))
+
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("The JWKS endpoint has answered the status code %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, MaxJWKSSize+1))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(body) > MaxJWKSSize {
+		return nil, fmt.Errorf("The JWKS is bigger than %d bytes: %w", MaxJWKSSize, ErrSizeLimitExceeded)
+	}
+
+	var set jwks
+
+	if err := json.Unmarshal(body, &set); err != nil {
+		return nil, fmt.Errorf("Error on parsing the JWKS: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := k.publicKey()
+
+		if err != nil {
+			Log().WithError(err).With("kid", k.Kid).Warn("Ignoring an unsupported server key")
+			continue
+		}
+
+		keys[k.Kid] = key
+	}
+
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, nErr := decodeBigInt(k.N)
+		e, eErr := decodeBigInt(k.E)
+
+		if nErr != nil || eErr != nil || !e.IsInt64() {
+			return nil, errors.New("The RSA key is malformed")
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, errors.New("Only the P-256 curve is supported")
+		}
+
+		x, xErr := decodeBigInt(k.X)
+		y, yErr := decodeBigInt(k.Y)
+
+		if xErr != nil || yErr != nil || !elliptic.P256().IsOnCurve(x, y) {
+			return nil, errors.New("The EC key is malformed")
+		}
+
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	default:
+		return nil, errors.New("The key type [" + k.Kty + "] is not supported")
+	}
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+
+	if err != nil || len(decoded) == 0 {
+		return nil, errors.New("The value is not base64url encoded")
+	}
+
+	return new(big.Int).SetBytes(decoded), nil
+}
@@ -0,0 +1,209 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//It starts a mock JWKS endpoint serving an EC P-256 key of each key id, counting the fetches.
+//The endpoint fails while failing is set.
+func jwksTestServer(t *testing.T, kids ...string) (*httptest.Server, *int32, *int32) {
+	var fetches, failing int32
+	keys := make([]map[string]string, 0)
+
+	for _, kid := range kids {
+		privateKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		keys = append(keys, map[string]string{
+			"kid": kid,
+			"kty": "EC",
+			"crv": "P-256",
+			"x":   base64.RawURLEncoding.EncodeToString(privateKey.X.Bytes()),
+			"y":   base64.RawURLEncoding.EncodeToString(privateKey.Y.Bytes()),
+		})
+	}
+
+	//the unsupported keys are ignored
+	keys = append(keys, map[string]string{"kid": "okp", "kty": "OKP", "crv": "Ed25519", "x": "AAAA"})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	}))
+
+	return server, &fetches, &failing
+}
+
+func TestKeySet_KeyCaching(t *testing.T) {
+	//setup
+	server, fetches, failing := jwksTestServer(t, "k1", "k2")
+	defer server.Close()
+	previous := Client
+	Client = &http.Client{}
+	defer func() {
+		Client = previous
+	}()
+
+	now := time.Now()
+	keys := NewKeySet(KeySetConfig{URL: server.URL, TTL: time.Hour})
+	keys.now = func() time.Time { return now }
+
+	//exercise
+	first, err := keys.Key("k1")
+	keys.Key("k2")
+
+	//verification
+	if err != nil || first == nil || atomic.LoadInt32(fetches) != 1 {
+		t.Fatalf("The keys must be fetched once, got %d fetches and [%v]", atomic.LoadInt32(fetches), err)
+	}
+
+	if _, err := keys.Key("okp"); err == nil {
+		t.Error("The unsupported key must not be in the set")
+	}
+
+	if atomic.LoadInt32(fetches) != 1 {
+		t.Errorf("The unknown key ids must not be fetched again before %v, got %d fetches", MinJWKSRefreshInterval, atomic.LoadInt32(fetches))
+	}
+
+	now = now.Add(MinJWKSRefreshInterval)
+
+	if _, err := keys.Key("k3"); err == nil || atomic.LoadInt32(fetches) != 2 {
+		t.Errorf("The unknown key id must make the keys be fetched again, got %d fetches", atomic.LoadInt32(fetches))
+	}
+
+	//the cached keys are kept while the endpoint is failing
+	atomic.StoreInt32(failing, 1)
+	now = now.Add(time.Hour)
+
+	if key, err := keys.Key("k1"); err != nil || key == nil || atomic.LoadInt32(fetches) != 3 {
+		t.Errorf("The expired keys must be fetched again and kept if the fetch fails, got %d fetches and [%v]", atomic.LoadInt32(fetches), err)
+	}
+}
+
+func TestKeySet_KeyThrottlesFailedFetches(t *testing.T) {
+	//setup
+	server, fetches, failing := jwksTestServer(t, "k1")
+	defer server.Close()
+	previous := Client
+	Client = &http.Client{}
+	defer func() {
+		Client = previous
+	}()
+
+	atomic.StoreInt32(failing, 1)
+	now := time.Now()
+	keys := NewKeySet(KeySetConfig{URL: server.URL})
+	keys.now = func() time.Time { return now }
+
+	//exercise
+	_, err := keys.Key("k1")
+	_, again := keys.Key("k1")
+
+	//verification
+	if err == nil || again == nil || atomic.LoadInt32(fetches) != 1 {
+		t.Fatalf("The failed fetch must not be retried before %v, got %d fetches", MinJWKSRefreshInterval, atomic.LoadInt32(fetches))
+	}
+
+	atomic.StoreInt32(failing, 0)
+	now = now.Add(MinJWKSRefreshInterval)
+
+	if key, err := keys.Key("k1"); err != nil || key == nil || atomic.LoadInt32(fetches) != 2 {
+		t.Errorf("The keys must be fetched again after %v, got %d fetches and [%v]", MinJWKSRefreshInterval, atomic.LoadInt32(fetches), err)
+	}
+}
+
+func TestKeySet_KeyFromOversizedSet(t *testing.T) {
+	//setup
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"keys": [], "padding": "`))
+		w.Write(make([]byte, MaxJWKSSize))
+		w.Write([]byte(`"}`))
+	}))
+	defer server.Close()
+	previous := Client
+	Client = &http.Client{}
+	defer func() {
+		Client = previous
+	}()
+
+	//exercise
+	_, err := NewKeySet(KeySetConfig{URL: server.URL}).Key("k1")
+
+	//verification
+	if !errors.Is(err, ErrSizeLimitExceeded) {
+		t.Errorf("The set bigger than %d bytes must not be read, got [%v]", MaxJWKSSize, err)
+	}
+}
+
+func TestKeySet_KeyWithoutKeyId(t *testing.T) {
+	//setup
+	single, _, _ := jwksTestServer(t, "k1")
+	defer single.Close()
+	many, _, _ := jwksTestServer(t, "k1", "k2")
+	defer many.Close()
+	previous := Client
+	Client = &http.Client{}
+	defer func() {
+		Client = previous
+	}()
+
+	//exercise
+	_, singleErr := NewKeySet(KeySetConfig{URL: single.URL}).Key("")
+	_, manyErr := NewKeySet(KeySetConfig{URL: many.URL}).Key("")
+
+	//verification
+	if singleErr != nil {
+		t.Errorf("The single key must be used by the tokens without key id, got [%v]", singleErr)
+	}
+
+	if manyErr == nil {
+		t.Error("The tokens without key id must be refused if the set has many keys")
+	}
+}
+
+func TestKeySet_KeyFromFile(t *testing.T) {
+	//setup
+	keysPath, restore := emptyKeysPath(t)
+	defer restore()
+
+	serverKeys, _ := GenerateKeyPair(KeyECDSAP256)
+	saveKey(serverKeys.Public, filepath.Join(keysPath, ServerKeyFileName+PublicKeyExt))
+	block, _ := pem.Decode(serverKeys.Public)
+	expected, _ := parsePublicKey(block)
+	pin, _ := KeyPin(expected)
+
+	//exercise
+	key, err := NewKeySet(KeySetConfig{Pins: []string{pin}}).Key("")
+	//the server may set a key id in the token, which the key file doesn't have
+	keyOfId, idErr := NewKeySet(KeySetConfig{Pins: []string{pin}}).Key("server-key-1")
+	_, unpinnedErr := NewKeySet(KeySetConfig{Pins: []string{"other-pin"}}).Key("")
+
+	//verification
+	if err != nil || !samePublicKey(key, expected) {
+		t.Errorf("The server key must be read from the keys path, got [%v]", err)
+	}
+
+	if idErr != nil || !samePublicKey(keyOfId, expected) {
+		t.Errorf("The key id of the token must be ignored when the server key is read from the keys path, got [%v]", idErr)
+	}
+
+	if unpinnedErr == nil {
+		t.Error("The server key must not be trusted if it is not pinned")
+	}
+}
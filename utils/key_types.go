@@ -0,0 +1,239 @@
+package utils
+
+//This module implements the key types the worker is able to use: RSA, ECDSA P-256
+//and Ed25519. The type is chosen when the keys are generated, while the loaded keys
+//have their type detected from their encoding. The new keys are PEM encoded as PKCS8
+//(private) and PKIX (public), and the PKCS1 RSA keys of the older workers are still loaded.
+//Each type signs with its own algorithm, whose name goes along with the signatures,
+//so the server knows how to verify them.
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+)
+
+const (
+	KeyTypeKey = "KEY_TYPE"
+
+	RSAKeyBitSize = 4096
+
+	//The algorithms of the signatures, as declared to the server
+	AlgorithmRSAPSS    = "rsa-pss-sha256"
+	AlgorithmECDSAP256 = "ecdsa-p256-sha256"
+	AlgorithmEd25519   = "ed25519"
+)
+
+type KeyType string
+
+const (
+	KeyRSA       KeyType = "rsa"
+	KeyECDSAP256 KeyType = "ecdsa-p256"
+	KeyEd25519   KeyType = "ed25519"
+)
+
+//It reads the type of the keys to be generated from the KEY_TYPE env var.
+//It returns RSA if the var is not set or its value is unknown.
+func KeyTypeFromEnv() KeyType {
+	switch keyType := KeyType(strings.ToLower(os.Getenv(KeyTypeKey))); keyType {
+	case KeyECDSAP256, KeyEd25519:
+		return keyType
+	default:
+		return KeyRSA
+	}
+}
+
+func generatePrivateKey(keyType KeyType) (crypto.Signer, error) {
+	switch keyType {
+	case KeyRSA, "":
+		privateKey, err := rsa.GenerateKey(rand.Reader, RSAKeyBitSize)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return privateKey, privateKey.Validate()
+	case KeyECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyEd25519:
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		return privateKey, err
+	default:
+		return nil, errors.New("Unknown key type [" + string(keyType) + "]")
+	}
+}
+
+//It encodes the private key as a PKCS8 PEM block.
+func EncodePrivateKeyToPem(privateKey crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+//It encodes the public key as a PKIX PEM block.
+func EncodePublicKeyToPem(publicKey crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+//It parses the private key of the PEM block, whose type is detected from the block.
+func parsePrivateKey(block *pem.Block) (crypto.Signer, error) {
+	var key interface{}
+	var err error
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, errors.New("The PEM block [" + block.Type + "] is not a private key")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+
+	if !ok {
+		return nil, fmt.Errorf("The private key type %T is not supported", key)
+	}
+
+	if _, err := SignatureAlgorithm(signer.Public()); err != nil {
+		return nil, err
+	}
+
+	return signer, nil
+}
+
+//It parses the public key of the PEM block, whose type is detected from the block.
+func parsePublicKey(block *pem.Block) (crypto.PublicKey, error) {
+	var key crypto.PublicKey
+	var err error
+
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, errors.New("The PEM block [" + block.Type + "] is not a public key")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := SignatureAlgorithm(key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+//It returns the algorithm of the signatures made by the private key of the public key.
+//It returns an error if the key type is not supported.
+func SignatureAlgorithm(publicKey crypto.PublicKey) (string, error) {
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		return AlgorithmRSAPSS, nil
+	case *ecdsa.PublicKey:
+		if key.Curve != elliptic.P256() {
+			return "", errors.New("Only the P-256 curve is supported")
+		}
+
+		return AlgorithmECDSAP256, nil
+	case ed25519.PublicKey:
+		return AlgorithmEd25519, nil
+	default:
+		return "", fmt.Errorf("The key type %T is not supported", publicKey)
+	}
+}
+
+func samePublicKey(a, b crypto.PublicKey) bool {
+	aDer, aErr := x509.MarshalPKIXPublicKey(a)
+	bDer, bErr := x509.MarshalPKIXPublicKey(b)
+	return aErr == nil && bErr == nil && bytes.Equal(aDer, bDer)
+}
+
+//It signs the message with the private key, in the algorithm of its type.
+//It returns:
+//1. nil, an empty algorithm and an error if the message couldn't be signed
+//2. the signature, its algorithm and nil otherwise
+func SignMessage(privateKey crypto.Signer, message []byte) ([]byte, string, error) {
+	if privateKey == nil {
+		return nil, "", errors.New("There is no private key to sign the message")
+	}
+
+	algorithm, err := SignatureAlgorithm(privateKey.Public())
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	var signature []byte
+
+	switch algorithm {
+	case AlgorithmEd25519:
+		//Ed25519 hashes the message itself
+		signature, err = privateKey.Sign(rand.Reader, message, crypto.Hash(0))
+	case AlgorithmRSAPSS:
+		digest := sha256.Sum256(message)
+		signature, err = privateKey.Sign(rand.Reader, digest[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto, Hash: crypto.SHA256})
+	default:
+		digest := sha256.Sum256(message)
+		signature, err = privateKey.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+
+	if err != nil {
+		return nil, "", fmt.Errorf("Error on signing the message: %w", err)
+	}
+
+	return signature, algorithm, nil
+}
+
+//It checks the signature of the message against the public key, in the algorithm of its type.
+func VerifySignature(publicKey crypto.PublicKey, message []byte, signature []byte) bool {
+	digest := sha256.Sum256(message)
+
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPSS(key, crypto.SHA256, digest[:], signature, nil) == nil
+	case *ecdsa.PublicKey:
+		var parsed struct{ R, S *big.Int }
+
+		if rest, err := asn1.Unmarshal(signature, &parsed); err != nil || len(rest) > 0 {
+			return false
+		}
+
+		return ecdsa.Verify(key, digest[:], parsed.R, parsed.S)
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, message, signature)
+	default:
+		return false
+	}
+}
@@ -0,0 +1,120 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGenAccessKeysOfEachType(t *testing.T) {
+	//setup
+	_, restore := emptyKeysPath(t)
+	defer restore()
+
+	previous := os.Getenv(KeyTypeKey)
+	defer os.Setenv(KeyTypeKey, previous)
+
+	algorithms := map[KeyType]string{
+		KeyRSA:       AlgorithmRSAPSS,
+		KeyECDSAP256: AlgorithmECDSAP256,
+		KeyEd25519:   AlgorithmEd25519,
+	}
+
+	for keyType, expected := range algorithms {
+		os.Setenv(KeyTypeKey, string(keyType))
+		workerId := "worker-" + string(keyType)
+		message := []byte("message of the " + string(keyType) + " keys")
+
+		//exercise
+		if err := GenAccessKeys(workerId); err != nil {
+			t.Fatalf("Error on generating the %s keys: %v", keyType, err)
+		}
+
+		privateKey, privErr := GetPrivateKey(workerId)
+		publicKey, pubErr := GetPublicKey(workerId)
+
+		if privErr != nil || pubErr != nil {
+			t.Fatalf("The %s keys must be loaded, got [%v] and [%v]", keyType, privErr, pubErr)
+		}
+
+		signature, algorithm, err := SignMessage(privateKey, message)
+
+		//verification
+		if err != nil || algorithm != expected {
+			t.Errorf("The %s keys must sign in %s, got %s and [%v]", keyType, expected, algorithm, err)
+		}
+
+		if !VerifySignature(publicKey, message, signature) {
+			t.Errorf("The signature of the %s keys must be valid", keyType)
+		}
+
+		if VerifySignature(publicKey, []byte("another message"), signature) {
+			t.Errorf("The signature of the %s keys must not be valid for another message", keyType)
+		}
+	}
+}
+
+func TestGetKeysInLegacyRSAEncoding(t *testing.T) {
+	//setup
+	keysPath, restore := emptyKeysPath(t)
+	defer restore()
+
+	workerId := "legacy-worker"
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+
+	if err != nil {
+		t.Fatalf("Error on generating the legacy key: %v", err)
+	}
+
+	privatePem := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+	publicPem := pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&privateKey.PublicKey)})
+	ioutil.WriteFile(filepath.Join(keysPath, workerId+PrivateKeyExt), privatePem, 0600)
+	ioutil.WriteFile(filepath.Join(keysPath, workerId+PublicKeyExt), publicPem, 0644)
+
+	//exercise
+	generated, err := EnsureAccessKeys(workerId)
+
+	//verification
+	if err != nil || generated {
+		t.Fatalf("The legacy keys must be reused, got [%v]", err)
+	}
+
+	signer, _ := GetPrivateKey(workerId)
+	publicKey, _ := GetPublicKey(workerId)
+	signature, algorithm, err := SignMessage(signer, []byte("message"))
+
+	if err != nil || algorithm != AlgorithmRSAPSS || !VerifySignature(publicKey, []byte("message"), signature) {
+		t.Errorf("The legacy keys must sign in %s, got %s and [%v]", AlgorithmRSAPSS, algorithm, err)
+	}
+}
+
+func TestKeyTypeFromEnv(t *testing.T) {
+	//setup
+	previous := os.Getenv(KeyTypeKey)
+	defer os.Setenv(KeyTypeKey, previous)
+
+	cases := map[string]KeyType{
+		"":           KeyRSA,
+		"rsa":        KeyRSA,
+		"ECDSA-P256": KeyECDSAP256,
+		"ed25519":    KeyEd25519,
+		"dsa":        KeyRSA,
+	}
+
+	for value, expected := range cases {
+		os.Setenv(KeyTypeKey, value)
+
+		//exercise
+		keyType := KeyTypeFromEnv()
+
+		//verification
+		if keyType != expected {
+			t.Errorf("The key type of [%s] must be %s, got %s", value, expected, keyType)
+		}
+	}
+}
@@ -6,181 +6,307 @@ package utils
 //time, when the user could use his own keys. The problem with this approach, is that
 //it is needed a specific format of keys, whose generation process is not user friendly.
 //So, generating them here, makes the deployment easier.
+//The keys are kept across restarts, since they are the worker's identity, and they
+//are only replaced by a rotation, whose new pair is staged next to the current one
+//until the server accepts it.
 import (
 	"crypto"
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/sha256"
-	"crypto/x509"
 	"encoding/base64"
 	"encoding/pem"
+	"errors"
+	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
+	"path/filepath"
 )
 
 const (
 	KeysPathKey = "KEYS_PATH"
+
+	PrivateKeyExt = ".priv"
+	PublicKeyExt  = ".pub"
+	//The extension of a key pair that has been staged to replace the current one
+	StagedKeyExt = ".new"
 )
 
-func GenAccessKeys(id string) {
-	keyspath := os.Getenv(KeysPathKey)
-	privateKeyPath := keyspath + "/" + id + ".priv"
-	publicKeyPath := keyspath + "/" + id + ".pub"
-	bitSize := 4096
+//It is a key pair, PEM encoded.
+type KeyPair struct {
+	Private []byte
+	Public  []byte
+}
+
+//It generates the worker's key pair, of the type set in the KEY_TYPE env var, and
+//saves it in the keys path, replacing the current one, if there is one.
+//It returns:
+//1. an error if the keys couldn't be generated or saved
+//2. nil otherwise
+func GenAccessKeys(id string) error {
+	keys, err := GenerateKeyPair(KeyTypeFromEnv())
 
-	privateKey, err := GeneratePrivateKey(bitSize)
 	if err != nil {
-		log.Fatal(err.Error())
+		return err
 	}
 
-	privateKeyBytes, publicKeyBytes := encodeKeysToPem(privateKey, &privateKey.PublicKey)
+	return saveKeyPair(keys, keyPath(id, PrivateKeyExt), keyPath(id, PublicKeyExt))
+}
 
-	err = saveKey(privateKeyBytes, privateKeyPath)
-	if err != nil {
-		log.Fatal(err.Error())
+//It makes sure the worker has a valid key pair in the keys path, so its identity is kept
+//across restarts. A rotation interrupted while the pair was being replaced is completed.
+//The keys are only generated if there is no valid pair.
+//It returns:
+//1. false and an error if the keys couldn't be generated or saved
+//2. whether the keys have been generated and nil otherwise
+func EnsureAccessKeys(id string) (bool, error) {
+	completeInterruptedRotation(id)
+
+	if err := checkKeyPair(id); err == nil {
+		Log().With(WorkerIdField, id).Info("Reusing the existing key pair")
+		return false, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		Log().With(WorkerIdField, id).WithError(err).Warn("The existing key pair is invalid; generating a new one")
 	}
 
-	err = saveKey(publicKeyBytes, publicKeyPath)
+	return true, GenAccessKeys(id)
+}
+
+//It checks that the key pair of the id can be parsed and that its keys match.
+func checkKeyPair(id string) error {
+	privateKey, err := GetPrivateKey(id)
+
 	if err != nil {
-		log.Fatal(err.Error())
+		return err
 	}
-}
 
-func GetPrivateKey(id string) *rsa.PrivateKey {
-	keyName := "/" + id + ".priv"
-	decodedKey := decodeKey(keyName)
+	publicKey, err := GetPublicKey(id)
 
-	rsaKey, err := x509.ParsePKCS1PrivateKey(decodedKey.Bytes)
 	if err != nil {
-		log.Fatal("Error on parsing private key " + err.Error())
+		return err
+	}
+
+	if !samePublicKey(privateKey.Public(), publicKey) {
+		return errors.New("The public key doesn't match the private key of " + id)
 	}
 
-	return rsaKey
+	return nil
 }
 
-func decodeKey(keyName string) *pem.Block {
-	keyspath := os.Getenv(KeysPathKey)
-	keyContent, err := ioutil.ReadFile(keyspath + keyName)
+//It generates a new key pair of the type, which isn't saved.
+func GenerateKeyPair(keyType KeyType) (KeyPair, error) {
+	privateKey, err := generatePrivateKey(keyType)
 
 	if err != nil {
-		log.Fatal("The private key is not where it should be")
+		return KeyPair{}, fmt.Errorf("Error on generating the private key: %w", err)
 	}
 
-	decodedKey, rest := pem.Decode(keyContent)
+	Log().With("key_type", keyType).Info("Private key generated")
+	privateKeyBytes, err := EncodePrivateKeyToPem(privateKey)
 
-	if len(rest) > 0 {
-		log.Fatal("Error on decoding private key; the rest is not empty.")
+	if err != nil {
+		return KeyPair{}, fmt.Errorf("Error on encoding the private key: %w", err)
+	}
+
+	publicKeyBytes, err := EncodePublicKeyToPem(privateKey.Public())
+
+	if err != nil {
+		return KeyPair{}, fmt.Errorf("Error on encoding the public key: %w", err)
 	}
 
-	return decodedKey
+	return KeyPair{Private: privateKeyBytes, Public: publicKeyBytes}, nil
+}
+
+//It saves the key pair next to the current one of the id, so it can replace it
+//by CommitStagedKeys once the server has accepted it.
+func StageKeys(id string, keys KeyPair) error {
+	return saveKeyPair(keys, keyPath(id, PrivateKeyExt+StagedKeyExt), keyPath(id, PublicKeyExt+StagedKeyExt))
 }
 
-func SignMessage(privateKey *rsa.PrivateKey, message []byte) ([]byte, []byte) {
-	messageHash := sha256.New()
-	writtenBytesCounter, err := messageHash.Write(message)
+//It reads the staged key pair of the id, which is left behind by a rotation the
+//server may have accepted, so it can be sent to the server again.
+//It returns:
+//1. an error wrapping os.ErrNotExist if there is no staged pair
+//2. the staged pair and nil otherwise
+func StagedKeys(id string) (KeyPair, error) {
+	privateKey, err := ioutil.ReadFile(keyPath(id, PrivateKeyExt+StagedKeyExt))
 
 	if err != nil {
-		panic(err)
+		return KeyPair{}, err
 	}
 
-	if writtenBytesCounter != len(message) {
-		log.Fatal("The message has not been entirely written in the message hash.")
+	publicKey, err := ioutil.ReadFile(keyPath(id, PublicKeyExt+StagedKeyExt))
+
+	if err != nil {
+		return KeyPair{}, err
 	}
 
-	msgHashSum := messageHash.Sum(nil)
+	return KeyPair{Private: privateKey, Public: publicKey}, nil
+}
 
-	signature, err := rsa.SignPSS(rand.Reader, privateKey, crypto.SHA256, msgHashSum, nil)
-	if err != nil {
-		panic(err)
+//It replaces the current key pair of the id by the staged one. Each key file is
+//replaced atomically, the private one first, so an interrupted commit is completed
+//by EnsureAccessKeys.
+func CommitStagedKeys(id string) error {
+	for _, ext := range []string{PrivateKeyExt, PublicKeyExt} {
+		if err := os.Rename(keyPath(id, ext+StagedKeyExt), keyPath(id, ext)); err != nil {
+			return fmt.Errorf("Error on replacing the key %s: %w", id+ext, err)
+		}
 	}
 
-	return signature, msgHashSum
+	Log().With(WorkerIdField, id).Info("Key pair replaced")
+	return nil
 }
 
-func VerifySignature(key *rsa.PublicKey, hash []byte, signature []byte) bool {
-	err := rsa.VerifyPSS(key, crypto.SHA256, hash, signature, nil)
-	if err != nil {
-		return false
+//It removes the staged key pair of the id, if there is one.
+func DiscardStagedKeys(id string) {
+	for _, ext := range []string{PrivateKeyExt, PublicKeyExt} {
+		os.Remove(keyPath(id, ext+StagedKeyExt))
 	}
-	return true
 }
 
-func GetPublicKey(id string) *rsa.PublicKey {
-	keyName := "/" + id + ".pub"
-	decodedKey := decodeKey(keyName)
+//It completes a commit interrupted between the replacement of the private
+//key and of the public one, which is when the staged public key matches the
+//current private key. A whole staged pair is kept, since the server may have
+//accepted it, so the next rotation sends it again. Any other staged key is discarded.
+func completeInterruptedRotation(id string) {
+	stagedPublicKeyName := "/" + id + PublicKeyExt + StagedKeyExt
 
-	rsaKey, err := x509.ParsePKCS1PublicKey(decodedKey.Bytes)
-	if err != nil {
-		log.Fatal("Error on parsing public key " + err.Error())
+	if _, err := os.Stat(keyPath(id, PublicKeyExt+StagedKeyExt)); err != nil {
+		return
 	}
 
-	return rsaKey
+	if _, err := os.Stat(keyPath(id, PrivateKeyExt+StagedKeyExt)); err == nil {
+		Log().With(WorkerIdField, id).Warn("Keeping the staged key pair of an unfinished rotation")
+		return
+	} else if os.IsNotExist(err) {
+		privateKey, privateErr := GetPrivateKey(id)
+		stagedPublicKey, publicErr := readPublicKey(stagedPublicKeyName)
+
+		if privateErr == nil && publicErr == nil && samePublicKey(privateKey.Public(), stagedPublicKey) {
+			if err := os.Rename(keyPath(id, PublicKeyExt+StagedKeyExt), keyPath(id, PublicKeyExt)); err == nil {
+				Log().With(WorkerIdField, id).Info("Completed the interrupted key rotation")
+				return
+			}
+		}
+	}
+
+	Log().With(WorkerIdField, id).Warn("Discarding the staged key")
+	DiscardStagedKeys(id)
+}
+
+func keyPath(id, ext string) string {
+	return os.Getenv(KeysPathKey) + "/" + id + ext
 }
 
-// GeneratePrivateKey creates a RSA Private Key of specified byte size
-func GeneratePrivateKey(bitSize int) (*rsa.PrivateKey, error) {
-	// Private Key generation
-	privateKey, err := rsa.GenerateKey(rand.Reader, bitSize)
+//It retrieves the private key of the id from the keys path, detecting its type.
+//It returns:
+//1. nil and an error if the key couldn't be read or parsed, or its type is not supported
+//2. the key and nil otherwise
+func GetPrivateKey(id string) (crypto.Signer, error) {
+	keyName := "/" + id + PrivateKeyExt
+	decodedKey, err := decodeKey(keyName)
+
 	if err != nil {
 		return nil, err
 	}
 
-	// Validate Private Key
-	err = privateKey.Validate()
+	privateKey, err := parsePrivateKey(decodedKey)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("Error on parsing private key %s: %w", keyName, err)
 	}
 
-	log.Println("Private Key generated")
 	return privateKey, nil
 }
 
-func encodeKeysToPem(privateKey *rsa.PrivateKey, publicKey *rsa.PublicKey) ([]byte, []byte) {
-	return EncodePrivKeyToPem(privateKey), EncodePublicKeyToPem(publicKey)
-}
+func decodeKey(keyName string) (*pem.Block, error) {
+	keyspath := os.Getenv(KeysPathKey)
+	keyContent, err := ioutil.ReadFile(keyspath + keyName)
 
-func EncodePrivKeyToPem(privKey *rsa.PrivateKey) []byte {
-	privDER := x509.MarshalPKCS1PrivateKey(privKey)
+	if err != nil {
+		return nil, fmt.Errorf("The key %s is not where it should be: %w", keyName, err)
+	}
 
-	privBlock := pem.Block{
-		Type:    "RSA PRIVATE KEY",
-		Headers: nil,
-		Bytes:   privDER,
+	decodedKey, rest := pem.Decode(keyContent)
+
+	if decodedKey == nil {
+		return nil, errors.New("Error on decoding key " + keyName + "; it is not PEM encoded")
 	}
 
-	privPEM := pem.EncodeToMemory(&privBlock)
+	if len(rest) > 0 {
+		return nil, errors.New("Error on decoding key " + keyName + "; the rest is not empty")
+	}
+
+	return decodedKey, nil
+}
 
-	return privPEM
+//It retrieves the public key of the id from the keys path, detecting its type.
+//It returns:
+//1. nil and an error if the key couldn't be read or parsed, or its type is not supported
+//2. the key and nil otherwise
+func GetPublicKey(id string) (crypto.PublicKey, error) {
+	return readPublicKey("/" + id + PublicKeyExt)
 }
 
-func EncodePublicKeyToPem(publicKey *rsa.PublicKey) []byte {
-	publicDER := x509.MarshalPKCS1PublicKey(publicKey)
+func readPublicKey(keyName string) (crypto.PublicKey, error) {
+	decodedKey, err := decodeKey(keyName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, err := parsePublicKey(decodedKey)
+	if err != nil {
+		return nil, fmt.Errorf("Error on parsing public key %s: %w", keyName, err)
+	}
+
+	return publicKey, nil
+}
 
-	publicBlock := pem.Block{
-		Type:    "RSA PUBLIC KEY",
-		Headers: nil,
-		Bytes:   publicDER,
+func saveKeyPair(keys KeyPair, privateKeyPath, publicKeyPath string) error {
+	if err := saveKey(keys.Private, privateKeyPath); err != nil {
+		return fmt.Errorf("Error on saving the private key: %w", err)
 	}
 
-	publicPEM := pem.EncodeToMemory(&publicBlock)
+	if err := saveKey(keys.Public, publicKeyPath); err != nil {
+		return fmt.Errorf("Error on saving the public key: %w", err)
+	}
 
-	return publicPEM
+	return nil
 }
 
+//It saves the key atomically, by writing it to a temp file of the same
+//dir and renaming it, so a key file is never read half written.
 func saveKey(keyBytes []byte, filePath string) error {
-	err := ioutil.WriteFile(filePath, keyBytes, 0600)
+	file, err := ioutil.TempFile(filepath.Dir(filePath), "."+filepath.Base(filePath)+"-")
+
 	if err != nil {
 		return err
 	}
 
-	log.Printf("Key saved to: %s", filePath)
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write(keyBytes); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(file.Name(), filePath); err != nil {
+		return err
+	}
+
+	Log().With("path", filePath).Info("Key saved")
 	return nil
 }
 
 func GetBase64PubKey(workerId string) (string, error) {
-	keyPath := os.Getenv(KeysPathKey) + "/" + workerId + ".pub"
-	publicKey,err := ioutil.ReadFile(keyPath)
+	publicKey, err := ioutil.ReadFile(keyPath(workerId, PublicKeyExt))
 
 	if err != nil {
 		return "", err
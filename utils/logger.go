@@ -0,0 +1,263 @@
+package utils
+
+//This module implements the structured leveled logger of the worker. Each entry is
+//a line with its time, level, message and fields, such as the ids of the worker,
+//queue, task and container it refers to, formatted either as logfmt or JSON.
+//Every line goes through the redaction policy before being written.
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LogLevelKey  = "LOG_LEVEL"
+	LogFormatKey = "LOG_FORMAT"
+
+	WorkerIdField    = "worker_id"
+	QueueIdField     = "queue_id"
+	TaskIdField      = "task_id"
+	ContainerIdField = "container_id"
+	ErrorField       = "error"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = [...]string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+//It parses a level name, which is case insensitive.
+func ParseLevel(name string) (Level, error) {
+	for i, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return Level(i), nil
+		}
+	}
+
+	return LevelInfo, errors.New("Unknown log level [" + name + "]")
+}
+
+type Format string
+
+const (
+	FormatLogfmt Format = "logfmt"
+	FormatJSON   Format = "json"
+)
+
+var (
+	loggingLock sync.Mutex
+	logOutput   io.Writer = NewRedactingWriter(os.Stderr)
+	logLevel              = LevelInfo
+	logFormat             = FormatLogfmt
+	//for test purpose
+	exit = os.Exit
+	now  = time.Now
+)
+
+//It sets the output of the logger, and of the standard one, which is used by the
+//libraries of the worker, so every log line is redacted before being written to out.
+func SetLogOutput(out io.Writer) {
+	writer := NewRedactingWriter(out)
+	log.SetOutput(writer)
+
+	loggingLock.Lock()
+	defer loggingLock.Unlock()
+	logOutput = writer
+}
+
+//It configures the level and the format of the logger.
+//Params:
+//level - the minimum level of the logged entries (debug, info, warn or error). The default is info.
+//format - logfmt or json. The default is logfmt.
+//It returns:
+//1. an error if the level or the format is unknown, in which case the configuration is not changed
+//2. nil otherwise
+func ConfigureLogging(level, format string) error {
+	parsedLevel := LevelInfo
+
+	if level != "" {
+		var err error
+
+		if parsedLevel, err = ParseLevel(level); err != nil {
+			return err
+		}
+	}
+
+	parsedFormat := FormatLogfmt
+
+	switch Format(strings.ToLower(format)) {
+	case "", FormatLogfmt:
+	case FormatJSON:
+		parsedFormat = FormatJSON
+	default:
+		return errors.New("Unknown log format [" + format + "]")
+	}
+
+	loggingLock.Lock()
+	defer loggingLock.Unlock()
+	logLevel, logFormat = parsedLevel, parsedFormat
+	return nil
+}
+
+//It configures the logger from the LOG_LEVEL and LOG_FORMAT env vars.
+func ConfigureLoggingFromEnv() error {
+	return ConfigureLogging(os.Getenv(LogLevelKey), os.Getenv(LogFormatKey))
+}
+
+//It is a logger whose entries carry a set of fields.
+//The loggers are immutable, so they can be shared by goroutines.
+type Logger struct {
+	fields map[string]interface{}
+}
+
+//It returns the logger without fields.
+func Log() *Logger {
+	return &Logger{}
+}
+
+//It returns a logger whose entries carry the field in addition to the logger ones.
+func (l *Logger) With(key string, value interface{}) *Logger {
+	fields := make(map[string]interface{}, len(l.fields)+1)
+
+	for k, v := range l.fields {
+		fields[k] = v
+	}
+
+	fields[key] = value
+	return &Logger{fields: fields}
+}
+
+//It returns a logger whose entries carry the error in addition to the logger fields.
+func (l *Logger) WithError(err error) *Logger {
+	if err == nil {
+		return l
+	}
+
+	return l.With(ErrorField, err.Error())
+}
+
+func (l *Logger) Debug(msg string) {
+	l.log(LevelDebug, msg)
+}
+
+func (l *Logger) Info(msg string) {
+	l.log(LevelInfo, msg)
+}
+
+func (l *Logger) Warn(msg string) {
+	l.log(LevelWarn, msg)
+}
+
+func (l *Logger) Error(msg string) {
+	l.log(LevelError, msg)
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.log(LevelDebug, fmt.Sprintf(format, args...))
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.log(LevelInfo, fmt.Sprintf(format, args...))
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.log(LevelWarn, fmt.Sprintf(format, args...))
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.log(LevelError, fmt.Sprintf(format, args...))
+}
+
+//It logs the entry at the error level and exits the worker.
+//It must only be used by the main package, which decides when the worker gives up.
+func (l *Logger) Fatal(msg string) {
+	l.log(LevelError, msg)
+	exit(1)
+}
+
+func (l *Logger) log(level Level, msg string) {
+	loggingLock.Lock()
+	defer loggingLock.Unlock()
+
+	if level < logLevel {
+		return
+	}
+
+	var line string
+
+	if logFormat == FormatJSON {
+		line = l.formatJSON(level, msg)
+	} else {
+		line = l.formatLogfmt(level, msg)
+	}
+
+	io.WriteString(logOutput, line+"\n")
+}
+
+func (l *Logger) formatJSON(level Level, msg string) string {
+	entry := make(map[string]interface{}, len(l.fields)+3)
+
+	for k, v := range l.fields {
+		entry[k] = v
+	}
+
+	entry["time"] = now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = level.String()
+	entry["msg"] = msg
+
+	line, err := json.Marshal(entry)
+
+	if err != nil {
+		return l.formatLogfmt(level, msg)
+	}
+
+	return string(line)
+}
+
+func (l *Logger) formatLogfmt(level Level, msg string) string {
+	var line strings.Builder
+	line.WriteString("time=" + now().UTC().Format(time.RFC3339Nano))
+	line.WriteString(" level=" + level.String())
+	line.WriteString(" msg=" + logfmtValue(msg))
+
+	keys := make([]string, 0, len(l.fields))
+
+	for k := range l.fields {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		line.WriteString(" " + k + "=" + logfmtValue(fmt.Sprint(l.fields[k])))
+	}
+
+	return line.String()
+}
+
+//It quotes the value if it is empty or has spaces, quotes or equal signs.
+func logfmtValue(value string) string {
+	if value == "" || strings.ContainsAny(value, " \t\r\n\"=") {
+		return strconv.Quote(value)
+	}
+
+	return value
+}
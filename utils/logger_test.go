@@ -0,0 +1,159 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+//It captures the logger output in the buffer, in the given format, with a fixed time.
+func captureLogs(t *testing.T, level, format string) (*bytes.Buffer, func()) {
+	var out bytes.Buffer
+	SetLogOutput(&out)
+
+	if err := ConfigureLogging(level, format); err != nil {
+		t.Fatalf("Error on configuring the logging: %v", err)
+	}
+
+	now = func() time.Time {
+		return time.Date(2020, 5, 17, 10, 30, 0, 0, time.UTC)
+	}
+
+	return &out, func() {
+		SetLogOutput(os.Stderr)
+		ConfigureLogging("", "")
+		now = time.Now
+	}
+}
+
+func TestLoggerLogfmt(t *testing.T) {
+	//setup
+	out, restore := captureLogs(t, "info", "logfmt")
+	defer restore()
+
+	//exercise
+	Log().With(WorkerIdField, "w-1").With(TaskIdField, 42).WithError(errors.New("no such file")).Error("Error on reading file")
+
+	//verification
+	expected := `time=2020-05-17T10:30:00Z level=error msg="Error on reading file" error="no such file" task_id=42 worker_id=w-1` + "\n"
+
+	if out.String() != expected {
+		t.Errorf("The entry must be [%s], got [%s]", expected, out.String())
+	}
+}
+
+func TestLoggerJSON(t *testing.T) {
+	//setup
+	out, restore := captureLogs(t, "info", "JSON")
+	defer restore()
+
+	//exercise
+	Log().With(ContainerIdField, "c-1").With(QueueIdField, 7).Info("Starting container")
+
+	//verification
+	var entry map[string]interface{}
+
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("The entry [%s] must be JSON: %v", out.String(), err)
+	}
+
+	if entry["level"] != "info" || entry["msg"] != "Starting container" || entry[ContainerIdField] != "c-1" ||
+		entry[QueueIdField] != float64(7) || entry["time"] != "2020-05-17T10:30:00Z" {
+		t.Errorf("The entry %v is not the expected one", entry)
+	}
+}
+
+func TestLoggerLevel(t *testing.T) {
+	//setup
+	out, restore := captureLogs(t, "warn", "")
+	defer restore()
+
+	//exercise
+	Log().Debug("debug entry")
+	Log().Info("info entry")
+	Log().Warn("warn entry")
+	Log().Errorf("error entry %d", 1)
+
+	//verification
+	if strings.Contains(out.String(), "debug entry") || strings.Contains(out.String(), "info entry") {
+		t.Errorf("The entries below the level must not be logged, got [%s]", out.String())
+	}
+
+	if !strings.Contains(out.String(), "warn entry") || !strings.Contains(out.String(), "error entry 1") {
+		t.Errorf("The entries at or above the level must be logged, got [%s]", out.String())
+	}
+}
+
+func TestLoggerFieldsAreImmutable(t *testing.T) {
+	//setup
+	out, restore := captureLogs(t, "info", "")
+	defer restore()
+	workerLog := Log().With(WorkerIdField, "w-1")
+
+	//exercise
+	workerLog.With(TaskIdField, "t-1").Info("task entry")
+	workerLog.Info("worker entry")
+
+	//verification
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+
+	if len(lines) != 2 || !strings.Contains(lines[0], "task_id=t-1") || strings.Contains(lines[1], "task_id") {
+		t.Errorf("A derived logger must not change its parent, got %v", lines)
+	}
+}
+
+func TestLoggerRedactsEntries(t *testing.T) {
+	//setup
+	out, restore := captureLogs(t, "info", "json")
+	defer restore()
+	RegisterSecret(`s3cr3t"log`)
+
+	//exercise
+	Log().With("cmd", `echo s3cr3t"log`).Info("Executing command")
+
+	//verification
+	if strings.Contains(out.String(), `s3cr3t\"log`) || !strings.Contains(out.String(), RedactedMask) {
+		t.Errorf("The secret must be redacted from the entry, got [%s]", out.String())
+	}
+}
+
+func TestLoggerFatal(t *testing.T) {
+	//setup
+	out, restore := captureLogs(t, "info", "")
+	defer restore()
+
+	code := -1
+	exit = func(c int) {
+		code = c
+	}
+	defer func() {
+		exit = os.Exit
+	}()
+
+	//exercise
+	Log().Fatal("Giving up")
+
+	//verification
+	if code != 1 || !strings.Contains(out.String(), "level=error") {
+		t.Errorf("The fatal entry must be logged as an error and exit the worker")
+	}
+}
+
+func TestConfigureLoggingWithInvalidValues(t *testing.T) {
+	//setup
+	_, restore := captureLogs(t, "info", "")
+	defer restore()
+
+	//exercise and verification
+	if err := ConfigureLogging("verbose", ""); err == nil {
+		t.Errorf("An unknown level must be refused")
+	}
+
+	if err := ConfigureLogging("", "xml"); err == nil {
+		t.Errorf("An unknown format must be refused")
+	}
+}
@@ -0,0 +1,90 @@
+package utils
+
+//This module implements the metrics registry of the worker, which is exposed in the
+//Prometheus format by the optional metrics endpoint, and the metrics of the requests
+//to the server. The latency of each request is observed by the server endpoint it
+//has been sent to, whose ids are replaced by a placeholder, so the endpoints of
+//different tasks and queues share the same series.
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	MetricsAddressKey = "METRICS_ADDRESS"
+	MetricsPath       = "/metrics"
+	MetricsNamespace  = "arrebol_worker"
+
+	//The endpoint label of the requests that are not sent to the server, such as the input downloads
+	OtherEndpoint = "other"
+	//The code label of the requests that haven't got a response
+	NoResponseCode = "none"
+	IdPlaceholder  = ":id"
+)
+
+var (
+	//The registry of the worker metrics, which are exposed by the metrics endpoint
+	Metrics = prometheus.NewRegistry()
+
+	httpRequestDuration = promauto.With(Metrics).NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: MetricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "The latency of the requests to the server, by method, endpoint and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "endpoint", "code"})
+)
+
+func init() {
+	Metrics.MustRegister(prometheus.NewGoCollector())
+	Metrics.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+}
+
+//It returns the handler that exposes the worker metrics in the Prometheus text format.
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(Metrics, promhttp.HandlerOpts{})
+}
+
+//It observes the latency of the request, by its method, endpoint and response status code.
+func observeRequest(req *http.Request, resp *http.Response, latency time.Duration) {
+	code := NoResponseCode
+
+	if resp != nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+
+	httpRequestDuration.WithLabelValues(req.Method, endpointLabel(req.URL), code).Observe(latency.Seconds())
+}
+
+//It returns the server endpoint the url refers to, from the workers collection on,
+//with every id replaced by the IdPlaceholder (e.g /workers/:id/queues/:id/tasks).
+//The urls out of the workers collection are labeled as OtherEndpoint.
+func endpointLabel(u *url.URL) string {
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	start := -1
+
+	for i, segment := range segments {
+		if segment == "workers" {
+			start = i
+			break
+		}
+	}
+
+	if start < 0 {
+		return OtherEndpoint
+	}
+
+	segments = segments[start:]
+
+	//the collections and their ids alternate, so every odd segment is an id
+	for i := 1; i < len(segments); i += 2 {
+		segments[i] = IdPlaceholder
+	}
+
+	return "/" + strings.Join(segments, "/")
+}
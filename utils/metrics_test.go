@@ -0,0 +1,69 @@
+package utils
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestEndpointLabel(t *testing.T) {
+	//setup
+	labels := map[string]string{
+		"http://test-server:8000/v1/workers":                                     "/workers",
+		"http://test-server:8000/v1/workers/1023/queues/932/tasks":               "/workers/:id/queues/:id/tasks",
+		"http://test-server:8000/v1/workers/1023/queues/932/tasks/1/logs/stdout": "/workers/:id/queues/:id/tasks/:id/logs/:id",
+		"http://test-server:8000/workers/1023/artifacts/42":                      "/workers/:id/artifacts/:id",
+		"https://datasets.example.com/inputs/data.csv":                           OtherEndpoint,
+	}
+
+	for rawUrl, expected := range labels {
+		u, _ := url.Parse(rawUrl)
+
+		//exercise
+		label := endpointLabel(u)
+
+		//verification
+		if label != expected {
+			t.Errorf("The endpoint of [%s] must be labeled as [%s], got [%s]", rawUrl, expected, label)
+		}
+	}
+}
+
+func TestGetObservesLatency(t *testing.T) {
+	//setup
+	setup()
+	GenAccessKeys(WorkerId)
+	endpoint := "http://test-server:8000/v1/workers/1023/queues/932/tasks"
+	//the series of the endpoint are created in advance, so the requests must not create others
+	httpRequestDuration.WithLabelValues(http.MethodGet, "/workers/:id/queues/:id/tasks", "200")
+	httpRequestDuration.WithLabelValues(http.MethodGet, "/workers/:id/queues/:id/tasks", NoResponseCode)
+	before := testutil.CollectAndCount(httpRequestDuration)
+
+	//exercise
+	Client = &MockedClient{Response: mockResponse(200, "{}")}
+	Get(WorkerId, endpoint, http.Header{})
+	Client = &MockedClient{Err: errors.New("connection refused")}
+	Get(WorkerId, endpoint, http.Header{})
+
+	//verification
+	if after := testutil.CollectAndCount(httpRequestDuration); after != before {
+		t.Errorf("The requests to the same endpoint must share the series, got %d series from %d", after, before)
+	}
+
+	recorder := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, MetricsPath, nil))
+	exposed := recorder.Body.String()
+
+	for _, series := range []string{
+		`arrebol_worker_http_request_duration_seconds_count{code="200",endpoint="/workers/:id/queues/:id/tasks",method="GET"}`,
+		`arrebol_worker_http_request_duration_seconds_count{code="none",endpoint="/workers/:id/queues/:id/tasks",method="GET"}`,
+	} {
+		if !strings.Contains(exposed, series) {
+			t.Errorf("The metrics endpoint must expose [%s]", series)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package utils
+
+//This module implements the redaction policy of the worker, which hides from its logs
+//and reports the secret values it handles, such as the secrets injected into the tasks,
+//and the text matched by the redaction patterns, such as the credentials pasted into
+//the task commands. Every text given to Redact is redacted, which includes every log
+//line when the log output is a RedactingWriter.
+import (
+	"encoding/json"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	RedactedMask = "[REDACTED]"
+)
+
+var (
+	//The credentials that usually show up in commands, such as
+	//"password=...", "--token ..." or "Authorization: Bearer ..."
+	DefaultRedactionPatterns = []string{
+		`(?i)(?:password|passwd|secret|token|api[_-]?key|access[_-]?key)["']?\s*[=:]\s*["']?([^\s"'&;]+)`,
+		`(?i)--(?:password|passwd|secret|token|api-key|access-key)[=\s]+([^\s"'&;]+)`,
+		`(?i)authorization:\s*(?:bearer|basic|token)\s+([^\s"'&;]+)`,
+		`://[^/\s:@]+:([^/\s@]+)@`,
+	}
+
+	secretsLock sync.RWMutex
+	//The registered values, the longest first, so a value that contains another
+	//one is redacted as a whole
+	secretValues []string
+	//The registered patterns
+	secretPatterns []*regexp.Regexp
+)
+
+//This struct represents the redaction policy configured to a worker, which is
+//applied in addition to the default patterns.
+type RedactionConfig struct {
+	//Regular expressions of the text to be redacted. If a pattern has
+	//groups, only the text they match is redacted, otherwise the whole match is.
+	Patterns []string
+	//Secret values to be redacted
+	Values []string
+}
+
+//It applies the redaction policy, registering the default patterns and the config ones.
+//It returns:
+//1. an error if some pattern is not a valid regular expression
+//2. nil otherwise
+func ConfigureRedaction(config RedactionConfig) error {
+	patterns := append(append([]string{}, DefaultRedactionPatterns...), config.Patterns...)
+
+	for _, pattern := range patterns {
+		if err := RegisterPattern(pattern); err != nil {
+			return err
+		}
+	}
+
+	for _, value := range config.Values {
+		RegisterSecret(value)
+	}
+
+	return nil
+}
+
+//It registers a pattern, so the text it matches is redacted from now on.
+//It returns:
+//1. an error if the pattern is not a valid regular expression
+//2. nil otherwise
+func RegisterPattern(pattern string) error {
+	compiled, err := regexp.Compile(pattern)
+
+	if err != nil {
+		return err
+	}
+
+	secretsLock.Lock()
+	defer secretsLock.Unlock()
+
+	for _, p := range secretPatterns {
+		if p.String() == compiled.String() {
+			return nil
+		}
+	}
+
+	secretPatterns = append(secretPatterns, compiled)
+	return nil
+}
+
+//It registers a secret value, so it is redacted from now on.
+//Its JSON-escaped form is registered as well, so it is redacted from the marshalled payloads.
+func RegisterSecret(value string) {
+	if strings.TrimSpace(value) == "" {
+		return
+	}
+
+	escaped, _ := json.Marshal(value)
+	values := []string{value, strings.Trim(string(escaped), "\"")}
+
+	secretsLock.Lock()
+	defer secretsLock.Unlock()
+
+	for _, v := range values {
+		if !contains(secretValues, v) {
+			secretValues = append(secretValues, v)
+		}
+	}
+
+	sort.SliceStable(secretValues, func(i, j int) bool {
+		return len(secretValues[i]) > len(secretValues[j])
+	})
+}
+
+//It replaces every registered secret value, and the text matched by every
+//registered pattern, by the RedactedMask.
+func Redact(text string) string {
+	secretsLock.RLock()
+	defer secretsLock.RUnlock()
+
+	for _, value := range secretValues {
+		text = strings.Replace(text, value, RedactedMask, -1)
+	}
+
+	for _, pattern := range secretPatterns {
+		text = redactMatches(pattern, text)
+	}
+
+	return text
+}
+
+//It masks the groups of each match of the pattern, or the whole match if the pattern has no groups.
+func redactMatches(pattern *regexp.Regexp, text string) string {
+	matches := pattern.FindAllStringSubmatchIndex(text, -1)
+
+	if matches == nil {
+		return text
+	}
+
+	var redacted strings.Builder
+	last := 0
+
+	for _, match := range matches {
+		spans := [][]int{{match[0], match[1]}}
+
+		if len(match) > 2 {
+			spans = spans[:0]
+
+			for i := 2; i < len(match); i += 2 {
+				spans = append(spans, []int{match[i], match[i+1]})
+			}
+		}
+
+		for _, span := range spans {
+			//groups that haven't taken part in the match, or that overlap a previous one, are skipped
+			if span[0] < last || span[0] == span[1] {
+				continue
+			}
+
+			redacted.WriteString(text[last:span[0]])
+			redacted.WriteString(RedactedMask)
+			last = span[1]
+		}
+	}
+
+	redacted.WriteString(text[last:])
+	return redacted.String()
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+//It is a writer that redacts the secret values and patterns before writing to Out.
+//It is meant to be the log output, each Write being a log line.
+type RedactingWriter struct {
+	Out io.Writer
+}
+
+func NewRedactingWriter(out io.Writer) *RedactingWriter {
+	return &RedactingWriter{Out: out}
+}
+
+func (w *RedactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.Out, Redact(string(p))); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
@@ -0,0 +1,220 @@
+package utils
+
+//This module implements the signing of the requests to the server, in the style of the
+//HTTP message signatures. The signature covers a canonical form of the request, made
+//of its method and path, the digest of its body, its date and a random nonce, so a
+//signed request can't have its content changed, be sent to another endpoint, or be
+//replayed once the server has seen its nonce or its date is too old.
+//The canonical form has one "name: value" line per covered component, in this order:
+//
+//	(request-target): post /workers/1023/keys
+//	date: Mon, 02 Jan 2006 15:04:05 GMT
+//	digest: SHA-256=<base64 of the body's sha256>
+//	nonce: <random hex>
+//
+//The signature is sent along with its parameters in the Signature header, e.g
+//keyId="1023",algorithm="ed25519",headers="(request-target) date digest nonce",signature="<base64>"
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	RequestTargetComponent = "(request-target)"
+	DigestAlgorithm        = "SHA-256"
+	NonceSize              = 16
+
+	//How far the date of a signed request may be from the verifier's clock
+	SignatureMaxSkew = 5 * time.Minute
+)
+
+var (
+	//The components covered by the signature, in the canonical order
+	SignedComponents = []string{RequestTargetComponent, "date", "digest", "nonce"}
+
+	//The signature of the request is missing, malformed or doesn't match it
+	ErrInvalidSignature = errors.New("invalid signature")
+)
+
+//This struct represents the parameters of the Signature header.
+type SignatureParams struct {
+	//The id of the worker whose key has signed the request
+	KeyId     string
+	Algorithm string
+	//The components covered by the signature, in order
+	Headers   []string
+	Signature []byte
+}
+
+//It returns the value of the Digest header of the body.
+func BodyDigest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return DigestAlgorithm + "=" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func newNonce() (string, error) {
+	nonce := make([]byte, NonceSize)
+
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(nonce), nil
+}
+
+//It builds the canonical form of the request components, which is the message signed.
+//Params:
+//req - the request, whose date, digest and nonce headers must already be set
+//components - the components to be covered, in order
+//It returns an error if a component is not set in the request.
+func CanonicalRequest(req *http.Request, components []string) ([]byte, error) {
+	lines := make([]string, 0, len(components))
+
+	for _, component := range components {
+		var value string
+
+		if component == RequestTargetComponent {
+			value = strings.ToLower(req.Method) + " " + req.URL.RequestURI()
+		} else if value = req.Header.Get(component); value == "" {
+			return nil, errors.New("The component [" + component + "] is missing from the request")
+		}
+
+		lines = append(lines, component+": "+value)
+	}
+
+	return []byte(strings.Join(lines, "\n")), nil
+}
+
+//It signs the request with the worker's private key, setting its date, digest,
+//nonce and signature headers.
+//Params:
+//workerId - the id of the worker whose key signs the request
+//req - the request to be signed
+//body - the request body, which the digest covers
+//It returns an error of the ErrSigningFailed kind if the request couldn't be signed.
+func SignRequest(workerId string, req *http.Request, body []byte) error {
+	endpoint := req.URL.String()
+	nonce, err := newNonce()
+
+	if err != nil {
+		return NewRequestError(ErrSigningFailed, endpoint, err)
+	}
+
+	req.Header.Set(DATE_KEY_PATTERN, time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set(DIGEST_KEY_PATTERN, BodyDigest(body))
+	req.Header.Set(NONCE_KEY_PATTERN, nonce)
+
+	message, err := CanonicalRequest(req, SignedComponents)
+
+	if err != nil {
+		return NewRequestError(ErrSigningFailed, endpoint, err)
+	}
+
+	signature, algorithm, err := GetSignature(message, workerId)
+
+	if err != nil {
+		return NewRequestError(ErrSigningFailed, endpoint, err)
+	}
+
+	params := SignatureParams{KeyId: workerId, Algorithm: algorithm, Headers: SignedComponents, Signature: signature}
+	req.Header.Set(SIGNATURE_KEY_PATTERN, params.String())
+	return nil
+}
+
+//It formats the parameters as the value of the Signature header.
+func (p SignatureParams) String() string {
+	return fmt.Sprintf(`keyId="%s",algorithm="%s",headers="%s",signature="%s"`,
+		p.KeyId, p.Algorithm, strings.Join(p.Headers, " "), base64.StdEncoding.EncodeToString(p.Signature))
+}
+
+//It parses the value of the Signature header.
+//It returns an error of the ErrInvalidSignature kind if any parameter is missing or malformed.
+func ParseSignatureParams(header string) (SignatureParams, error) {
+	values := make(map[string]string)
+
+	for _, field := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+
+		if len(kv) != 2 || len(kv[1]) < 2 || !strings.HasPrefix(kv[1], `"`) || !strings.HasSuffix(kv[1], `"`) {
+			return SignatureParams{}, fmt.Errorf("%w: malformed parameter [%s]", ErrInvalidSignature, field)
+		}
+
+		values[kv[0]] = strings.Trim(kv[1], `"`)
+	}
+
+	for _, name := range []string{"keyId", "algorithm", "headers", "signature"} {
+		if values[name] == "" {
+			return SignatureParams{}, fmt.Errorf("%w: the parameter [%s] is missing", ErrInvalidSignature, name)
+		}
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(values["signature"])
+
+	if err != nil {
+		return SignatureParams{}, fmt.Errorf("%w: the signature is not base64 encoded", ErrInvalidSignature)
+	}
+
+	return SignatureParams{
+		KeyId:     values["keyId"],
+		Algorithm: values["algorithm"],
+		Headers:   strings.Fields(values["headers"]),
+		Signature: signature,
+	}, nil
+}
+
+//It verifies the signature of a request, as the server does.
+//The nonce is only checked to be covered, since telling whether it has been seen
+//before is up to the verifier, which must keep the nonces for SignatureMaxSkew.
+//Params:
+//req - the signed request
+//body - the request body, since the request's one may have been read already
+//publicKey - the public key of the worker that has signed the request
+//now - the verifier's clock, which the request's date must be close to
+//It returns:
+//1. an error of the ErrInvalidSignature kind if the signature doesn't match the request
+//2. the signature parameters and nil otherwise
+func VerifyRequest(req *http.Request, body []byte, publicKey crypto.PublicKey, now time.Time) (SignatureParams, error) {
+	params, err := ParseSignatureParams(req.Header.Get(SIGNATURE_KEY_PATTERN))
+
+	if err != nil {
+		return SignatureParams{}, err
+	}
+
+	if strings.Join(params.Headers, " ") != strings.Join(SignedComponents, " ") {
+		return SignatureParams{}, fmt.Errorf("%w: the signature must cover [%s]", ErrInvalidSignature, strings.Join(SignedComponents, " "))
+	}
+
+	if algorithm, err := SignatureAlgorithm(publicKey); err != nil || algorithm != params.Algorithm {
+		return SignatureParams{}, fmt.Errorf("%w: the algorithm [%s] doesn't match the key", ErrInvalidSignature, params.Algorithm)
+	}
+
+	if req.Header.Get(DIGEST_KEY_PATTERN) != BodyDigest(body) {
+		return SignatureParams{}, fmt.Errorf("%w: the digest doesn't match the body", ErrInvalidSignature)
+	}
+
+	date, err := http.ParseTime(req.Header.Get(DATE_KEY_PATTERN))
+
+	if err != nil || date.Sub(now) > SignatureMaxSkew || now.Sub(date) > SignatureMaxSkew {
+		return SignatureParams{}, fmt.Errorf("%w: the date is malformed or too far from now", ErrInvalidSignature)
+	}
+
+	message, err := CanonicalRequest(req, params.Headers)
+
+	if err != nil {
+		return SignatureParams{}, fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+
+	if !VerifySignature(publicKey, message, params.Signature) {
+		return SignatureParams{}, fmt.Errorf("%w: the signature doesn't match the request", ErrInvalidSignature)
+	}
+
+	return params, nil
+}
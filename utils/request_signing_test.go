@@ -0,0 +1,209 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+//It records the requests it receives, answering them with an empty 200 response.
+type recordingClient struct {
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (c *recordingClient) Do(req *http.Request) (*http.Response, error) {
+	body := []byte{}
+
+	if req.Body != nil {
+		body, _ = ioutil.ReadAll(req.Body)
+	}
+
+	c.requests = append(c.requests, req)
+	c.bodies = append(c.bodies, body)
+	return mockResponse(200, ""), nil
+}
+
+//It generates the worker's keys of the type in an empty keys path, restoring it when the returned func is called.
+func signingTestKeys(t *testing.T, keyType KeyType) func() {
+	_, restore := emptyKeysPath(t)
+	previous := os.Getenv(KeyTypeKey)
+	os.Setenv(KeyTypeKey, string(keyType))
+
+	if err := GenAccessKeys(WorkerId); err != nil {
+		t.Fatalf("Error on generating the %s keys: %v", keyType, err)
+	}
+
+	return func() {
+		os.Setenv(KeyTypeKey, previous)
+		restore()
+	}
+}
+
+//It returns a request to the endpoint signed with the worker's keys.
+func signedRequest(t *testing.T, method string, endpoint string, body []byte) *http.Request {
+	req, _ := http.NewRequest(method, endpoint, bytes.NewReader(body))
+
+	if err := SignRequest(WorkerId, req, body); err != nil {
+		t.Fatalf("Error on signing the request: %v", err)
+	}
+
+	return req
+}
+
+func TestSignRequestRoundTrip(t *testing.T) {
+	for keyType, algorithm := range map[KeyType]string{KeyRSA: AlgorithmRSAPSS, KeyECDSAP256: AlgorithmECDSAP256, KeyEd25519: AlgorithmEd25519} {
+		//setup
+		restore := signingTestKeys(t, keyType)
+		publicKey, _ := GetPublicKey(WorkerId)
+		body := []byte(`{"Id":"t-1"}`)
+
+		//exercise
+		req := signedRequest(t, http.MethodPost, "http://test-server:8000/workers/1023/queues/932/tasks?state=FINISHED", body)
+		params, err := VerifyRequest(req, body, publicKey, time.Now())
+		restore()
+
+		//verification
+		if err != nil {
+			t.Fatalf("The %s signature must be valid, got [%v]", keyType, err)
+		}
+
+		if params.KeyId != WorkerId || params.Algorithm != algorithm {
+			t.Errorf("The signature must be made by the worker %s in %s, got %+v", WorkerId, algorithm, params)
+		}
+	}
+}
+
+func TestVerifyRequestWithTamperedRequest(t *testing.T) {
+	//setup
+	restore := signingTestKeys(t, KeyEd25519)
+	defer restore()
+
+	publicKey, _ := GetPublicKey(WorkerId)
+	endpoint := "http://test-server:8000/workers/1023/queues/932/tasks"
+	body := []byte(`{"Id":"t-1"}`)
+
+	tamperings := map[string]func(req *http.Request) []byte{
+		"body": func(req *http.Request) []byte {
+			return []byte(`{"Id":"t-2"}`)
+		},
+		"method": func(req *http.Request) []byte {
+			req.Method = http.MethodPut
+			return body
+		},
+		"path": func(req *http.Request) []byte {
+			req.URL.Path = "/workers/1023/queues/933/tasks"
+			return body
+		},
+		"nonce": func(req *http.Request) []byte {
+			req.Header.Set(NONCE_KEY_PATTERN, "00000000000000000000000000000000")
+			return body
+		},
+		"date": func(req *http.Request) []byte {
+			req.Header.Set(DATE_KEY_PATTERN, time.Now().Add(-SignatureMaxSkew-time.Minute).UTC().Format(http.TimeFormat))
+			return body
+		},
+		"signature": func(req *http.Request) []byte {
+			req.Header.Set(SIGNATURE_KEY_PATTERN, strings.Replace(req.Header.Get(SIGNATURE_KEY_PATTERN), `signature="`, `signature="AAAA`, 1))
+			return body
+		},
+		"components": func(req *http.Request) []byte {
+			req.Header.Set(SIGNATURE_KEY_PATTERN, strings.Replace(req.Header.Get(SIGNATURE_KEY_PATTERN), " nonce", "", 1))
+			return body
+		},
+		"missing signature": func(req *http.Request) []byte {
+			req.Header.Del(SIGNATURE_KEY_PATTERN)
+			return body
+		},
+	}
+
+	for name, tamper := range tamperings {
+		req := signedRequest(t, http.MethodPost, endpoint, body)
+
+		//exercise
+		_, err := VerifyRequest(req, tamper(req), publicKey, time.Now())
+
+		//verification
+		if !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("The request with a tampered %s must have an invalid signature, got [%v]", name, err)
+		}
+	}
+}
+
+func TestVerifyRequestWithAnotherKey(t *testing.T) {
+	//setup
+	restore := signingTestKeys(t, KeyRSA)
+	defer restore()
+
+	otherKeys, _ := GenerateKeyPair(KeyRSA)
+	block, _ := pem.Decode(otherKeys.Public)
+	otherKey, _ := parsePublicKey(block)
+	req := signedRequest(t, http.MethodGet, "http://test-server:8000/workers/1023", nil)
+
+	//exercise
+	_, err := VerifyRequest(req, nil, otherKey, time.Now())
+
+	//verification
+	if !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("The signature must not be valid for another key, got [%v]", err)
+	}
+}
+
+func TestPostSignsCanonicalRequest(t *testing.T) {
+	//setup
+	restore := signingTestKeys(t, KeyECDSAP256)
+	defer restore()
+
+	publicKey, _ := GetPublicKey(WorkerId)
+	client := &recordingClient{}
+	previous := Client
+	Client = client
+	defer func() {
+		Client = previous
+	}()
+
+	//exercise
+	Post(WorkerId, map[string]string{"state": "RUNNING"}, http.Header{}, "http://test-server:8000/workers/1023")
+	Get(WorkerId, "http://test-server:8000/workers/1023", http.Header{})
+	Upload(WorkerId, []byte("log line"), "text/plain", http.Header{}, "http://test-server:8000/workers/1023/logs")
+
+	//verification
+	nonces := make(map[string]bool)
+
+	for i, req := range client.requests {
+		if _, err := VerifyRequest(req, client.bodies[i], publicKey, time.Now()); err != nil {
+			t.Errorf("The %s request must carry a valid signature, got [%v]", req.Method, err)
+		}
+
+		nonces[req.Header.Get(NONCE_KEY_PATTERN)] = true
+	}
+
+	if len(client.requests) != 3 || len(nonces) != 3 {
+		t.Errorf("Each request must be signed with its own nonce, got %v", nonces)
+	}
+}
+
+func TestParseSignatureParams(t *testing.T) {
+	//setup
+	params := SignatureParams{KeyId: WorkerId, Algorithm: AlgorithmEd25519, Headers: SignedComponents, Signature: []byte{1, 2, 3, 250}}
+
+	//exercise
+	parsed, err := ParseSignatureParams(params.String())
+
+	//verification
+	if err != nil || parsed.String() != params.String() {
+		t.Errorf("The parameters must round trip, got %+v and [%v]", parsed, err)
+	}
+
+	for _, header := range []string{"", `keyId="1023"`, `keyId="1023",algorithm="ed25519",headers="date",signature="not base64!"`} {
+		if _, err := ParseSignatureParams(header); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("The header [%s] must be invalid, got [%v]", header, err)
+		}
+	}
+}
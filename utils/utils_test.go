@@ -2,9 +2,18 @@ package utils
 
 import (
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"github.com/joho/godotenv"
+	"io/ioutil"
 	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 const (
@@ -25,10 +34,10 @@ func TestGetPublicKey(t *testing.T) {
 	GenAccessKeys(WorkerId)
 
 	//exercise
-	publicKey := GetPublicKey(WorkerId)
+	publicKey, err := GetPublicKey(WorkerId)
 
 	//verification
-	if publicKey == nil {
+	if err != nil || publicKey == nil {
 		t.Errorf("Error on retrieving created public key")
 	}
 }
@@ -39,10 +48,10 @@ func TestGetPrivateKey(t *testing.T) {
 	GenAccessKeys(WorkerId)
 
 	//exercise
-	privateKey := GetPrivateKey(WorkerId)
+	privateKey, err := GetPrivateKey(WorkerId)
 
 	//verification
-	if privateKey == nil {
+	if err != nil || privateKey == nil {
 		t.Errorf("Error on retrieving created private key")
 	}
 }
@@ -60,11 +69,486 @@ func TestSignMessage(t *testing.T) {
 		t.Errorf("Error on mashalling the mockedData")
 	}
 
+	privateKey, _ := GetPrivateKey(WorkerId)
+	publicKey, _ := GetPublicKey(WorkerId)
+
 	//exercise
-	signedWorker, hashSum := SignMessage(GetPrivateKey(WorkerId), marshalledData)
+	signedWorker, algorithm, err := SignMessage(privateKey, marshalledData)
 
 	//verification
-	if !VerifySignature(GetPublicKey(WorkerId), hashSum, signedWorker) {
+	if err != nil {
+		t.Errorf("Error on signing the message: " + err.Error())
+	}
+
+	if algorithm != AlgorithmRSAPSS {
+		t.Errorf("The signature algorithm of the default keys must be %s, got %s", AlgorithmRSAPSS, algorithm)
+	}
+
+	if !VerifySignature(publicKey, marshalledData, signedWorker) {
 		t.Errorf("Signature verification doesnt match the specifications")
 	}
 }
+
+type MockedClient struct {
+	Response *http.Response
+	Err      error
+}
+
+func (c *MockedClient) Do(req *http.Request) (*http.Response, error) {
+	return c.Response, c.Err
+}
+
+func mockResponse(statusCode int, body string) *http.Response {
+	return &http.Response{
+		StatusCode: statusCode,
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+	}
+}
+
+//It points the keys path to an empty temp dir, restoring it when the returned func is called.
+func emptyKeysPath(t *testing.T) (string, func()) {
+	keysPath, err := ioutil.TempDir("", "keys")
+
+	if err != nil {
+		t.Fatalf("Error on creating the keys path: %v", err)
+	}
+
+	previous := os.Getenv(KeysPathKey)
+	os.Setenv(KeysPathKey, keysPath)
+
+	return keysPath, func() {
+		os.Setenv(KeysPathKey, previous)
+		os.RemoveAll(keysPath)
+	}
+}
+
+func TestGetPrivateKeyWithMissingKey(t *testing.T) {
+	//setup
+	_, restore := emptyKeysPath(t)
+	defer restore()
+
+	//exercise
+	privateKey, err := GetPrivateKey(WorkerId)
+
+	//verification
+	if err == nil || privateKey != nil {
+		t.Errorf("A missing key must be reported as an error")
+	}
+}
+
+func TestGetPublicKeyWithInvalidKey(t *testing.T) {
+	//setup
+	keysPath, restore := emptyKeysPath(t)
+	defer restore()
+
+	contents := map[string][]byte{
+		"not-pem":   []byte("not a key"),
+		"not-rsa":   pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: []byte("garbage")}),
+		"with-rest": append(pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: []byte("garbage")}), []byte("rest")...),
+	}
+
+	for id, content := range contents {
+		ioutil.WriteFile(filepath.Join(keysPath, id+".pub"), content, 0600)
+
+		//exercise
+		publicKey, err := GetPublicKey(id)
+
+		//verification
+		if err == nil || publicKey != nil {
+			t.Errorf("The invalid key [%s] must be reported as an error", id)
+		}
+	}
+}
+
+func TestGenAccessKeysWithMissingPath(t *testing.T) {
+	//setup
+	keysPath, restore := emptyKeysPath(t)
+	defer restore()
+	os.Setenv(KeysPathKey, filepath.Join(keysPath, "missing"))
+
+	//exercise
+	err := GenAccessKeys(WorkerId)
+
+	//verification
+	if err == nil {
+		t.Errorf("The keys that couldn't be saved must be reported as an error")
+	}
+}
+
+func TestSignMessageWithoutKey(t *testing.T) {
+	//exercise
+	signature, _, err := SignMessage(nil, []byte("message"))
+
+	//verification
+	if err == nil || signature != nil {
+		t.Errorf("A message can't be signed without a key")
+	}
+}
+
+func TestPostWithMissingKey(t *testing.T) {
+	//setup
+	_, restore := emptyKeysPath(t)
+	defer restore()
+	Client = &MockedClient{Response: mockResponse(201, "")}
+
+	//exercise
+	_, err := Post(WorkerId, map[string]string{}, http.Header{}, "http://test-server:8000/v1")
+
+	//verification
+	if !errors.Is(err, ErrSigningFailed) {
+		t.Errorf("The error must be classified as signing failed, got [%v]", err)
+	}
+}
+
+func TestPostWithUnmarshallableBody(t *testing.T) {
+	//setup
+	Client = &MockedClient{Response: mockResponse(201, "")}
+	GetSignature = func(message []byte, workerId string) ([]byte, string, error) {
+		return []byte("FAKE-SIGNATURE"), AlgorithmRSAPSS, nil
+	}
+	defer func() {
+		GetSignature = getSignature
+	}()
+
+	//exercise
+	_, err := Post(WorkerId, make(chan int), http.Header{}, "http://test-server:8000/v1")
+
+	//verification
+	if !errors.Is(err, ErrMalformedPayload) {
+		t.Errorf("The error must be classified as malformed payload, got [%v]", err)
+	}
+}
+
+func TestCheckStatus(t *testing.T) {
+	expectedKinds := map[int]error{
+		200: nil,
+		201: nil,
+		401: ErrUnauthorized,
+		403: ErrForbidden,
+		404: ErrNotFound,
+		400: ErrMalformedPayload,
+		429: ErrServerUnavailable,
+		503: ErrServerUnavailable,
+		409: ErrRequestRejected,
+	}
+
+	for code, kind := range expectedKinds {
+		//exercise
+		err := CheckStatus(&HttpResponse{StatusCode: code}, "http://test-server:8000/v1")
+
+		//verification
+		if kind == nil && err != nil {
+			t.Errorf("Status code %d must not be an error", code)
+		}
+
+		if kind != nil && !errors.Is(err, kind) {
+			t.Errorf("Status code %d must be classified as [%v], got [%v]", code, kind, err)
+		}
+	}
+}
+
+func TestGetWithUnreachableServer(t *testing.T) {
+	//setup
+	setup()
+	GenAccessKeys(WorkerId)
+	Client = &MockedClient{Err: errors.New("connection refused")}
+
+	//exercise
+	_, err := Get(WorkerId, "http://test-server:8000/v1", http.Header{})
+
+	//verification
+	if !errors.Is(err, ErrServerUnavailable) {
+		t.Errorf("The error must be classified as server unavailable, got [%v]", err)
+	}
+}
+
+func TestPutWithUnreachableServer(t *testing.T) {
+	//setup
+	setup()
+	GenAccessKeys(WorkerId)
+	refused := errors.New("connection refused")
+	Client = &MockedClient{Err: refused}
+
+	//exercise
+	_, err := Put(WorkerId, map[string]string{}, http.Header{}, "http://test-server:8000/v1")
+
+	//verification
+	if !errors.Is(err, ErrServerUnavailable) {
+		t.Errorf("The error must be classified as server unavailable, got [%v]", err)
+	}
+
+	if !errors.Is(err, refused) {
+		t.Errorf("The error must keep the transport error, got [%v]", err)
+	}
+}
+
+func TestPutWithExpiredToken(t *testing.T) {
+	//setup
+	setup()
+	GenAccessKeys(WorkerId)
+	Client = &MockedClient{Response: mockResponse(401, "")}
+
+	//exercise
+	resp, err := Put(WorkerId, map[string]string{}, http.Header{}, "http://test-server:8000/v1")
+
+	//verification
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("The error must be classified as unauthorized, got [%v]", err)
+	}
+
+	if resp == nil || resp.StatusCode != 401 {
+		t.Errorf("The response must be returned along with the error")
+	}
+}
+
+func TestDownloadRedirectedToOtherOrigin(t *testing.T) {
+	//setup
+	GetSignature = func(message []byte, workerId string) ([]byte, string, error) {
+		return []byte("FAKE-SIGNATURE"), AlgorithmRSAPSS, nil
+	}
+	defer func() {
+		GetSignature = getSignature
+	}()
+
+	var received http.Header
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+		w.Write([]byte("content"))
+	}))
+	defer other.Close()
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, other.URL+"/inputs/1", http.StatusFound)
+	}))
+	defer origin.Close()
+
+	header := http.Header{}
+	header.Set("arrebol-worker-token", "test-token")
+
+	//exercise
+	content, err := Download(WorkerId, origin.URL+"/inputs/1", header)
+
+	//verification
+	if err != nil {
+		t.Fatalf("The redirected download must succeed, got [%v]", err)
+	}
+	defer content.Close()
+
+	if body, _ := ioutil.ReadAll(content); string(body) != "content" {
+		t.Errorf("The content of the redirect target must be returned, got [%s]", body)
+	}
+
+	for _, key := range credentialHeaders {
+		if received.Get(key) != "" {
+			t.Errorf("The header [%s] must not be sent to another origin", key)
+		}
+	}
+}
+
+func TestBackoff_Next(t *testing.T) {
+	//setup
+	backoff := NewBackoff(time.Second, 10*time.Second, 2, 0)
+	expected := []time.Duration{1, 2, 4, 8, 10, 10}
+
+	for _, e := range expected {
+		//exercise
+		interval := backoff.Next()
+
+		//verification
+		if interval != e*time.Second {
+			t.Errorf("The interval %v is different from the expected %v", interval, e*time.Second)
+		}
+	}
+
+	backoff.Reset()
+
+	if interval := backoff.Next(); interval != time.Second {
+		t.Errorf("The interval must be the initial one after a reset, got %v", interval)
+	}
+}
+
+func TestBackoff_NextWithJitter(t *testing.T) {
+	//setup
+	backoff := NewBackoff(10*time.Second, 15*time.Second, 1, 0.5)
+
+	for i := 0; i < 100; i++ {
+		//exercise
+		interval := backoff.Next()
+
+		//verification
+		if interval < 5*time.Second || interval > 15*time.Second {
+			t.Errorf("The interval %v is out of the jitter range", interval)
+		}
+	}
+}
+
+func TestNewBackoffFromEnv(t *testing.T) {
+	//setup
+	previousMultiplier, previousJitter := os.Getenv(PollingMultiplierKey), os.Getenv(PollingJitterKey)
+	defer func() {
+		os.Setenv(PollingMultiplierKey, previousMultiplier)
+		os.Setenv(PollingJitterKey, previousJitter)
+	}()
+
+	cases := []struct {
+		multiplier, jitter                 string
+		expectedMultiplier, expectedJitter float64
+	}{
+		{"3", "0.5", 3, 0.5},
+		{"1", "0", 1, 0},
+		{"", "1", DefaultMultiplier, 1},
+		{"0.5", "1.5", DefaultMultiplier, DefaultJitter},
+		{"NaN", "-0.1", DefaultMultiplier, DefaultJitter},
+		{"two", "", DefaultMultiplier, DefaultJitter},
+	}
+
+	for _, c := range cases {
+		os.Setenv(PollingMultiplierKey, c.multiplier)
+		os.Setenv(PollingJitterKey, c.jitter)
+
+		//exercise
+		backoff := NewBackoffFromEnv()
+
+		//verification
+		if backoff.Multiplier != c.expectedMultiplier || backoff.Jitter != c.expectedJitter {
+			t.Errorf("The multiplier [%s] and jitter [%s] must be read as %v and %v, got %v and %v",
+				c.multiplier, c.jitter, c.expectedMultiplier, c.expectedJitter, backoff.Multiplier, backoff.Jitter)
+		}
+	}
+}
+
+func TestBackoff_NextWithInvalidSettings(t *testing.T) {
+	//setup
+	backoff := NewBackoff(time.Second, 10*time.Second, 0.5, 3)
+
+	for i := 0; i < 100; i++ {
+		//exercise
+		interval := backoff.Next()
+
+		//verification
+		if interval < 0 || interval > 10*time.Second {
+			t.Errorf("The interval %v is out of range", interval)
+		}
+	}
+}
+
+func TestLastServerContact(t *testing.T) {
+	//setup
+	setup()
+	GenAccessKeys(WorkerId)
+	before := LastServerContact()
+
+	//exercise
+	Client = &MockedClient{Response: mockResponse(200, "")}
+	Get(WorkerId, "https://datasets.example.com/inputs/data.csv", http.Header{})
+	afterOtherEndpoint := LastServerContact()
+	Client = &MockedClient{Err: errors.New("connection refused")}
+	Get(WorkerId, "http://test-server:8000/v1/workers/1023/queues/932/tasks", http.Header{})
+	afterUnreachable := LastServerContact()
+	Client = &MockedClient{Response: mockResponse(204, "")}
+	Get(WorkerId, "http://test-server:8000/v1/workers/1023/queues/932/tasks", http.Header{})
+
+	//verification
+	if !afterOtherEndpoint.Equal(before) || !afterUnreachable.Equal(before) {
+		t.Error("Only the answers of the server must be recorded as contacts")
+	}
+
+	if !LastServerContact().After(before) {
+		t.Error("The answer of the server must be recorded as a contact")
+	}
+}
+
+func TestEnsureAccessKeysReusesKeys(t *testing.T) {
+	//setup
+	keysPath, restore := emptyKeysPath(t)
+	defer restore()
+
+	generated, err := EnsureAccessKeys(WorkerId)
+
+	if err != nil || !generated {
+		t.Fatalf("The missing keys must be generated, got [%v]", err)
+	}
+
+	firstKey, _ := ioutil.ReadFile(filepath.Join(keysPath, WorkerId+".priv"))
+
+	//exercise
+	generated, err = EnsureAccessKeys(WorkerId)
+
+	//verification
+	secondKey, _ := ioutil.ReadFile(filepath.Join(keysPath, WorkerId+".priv"))
+
+	if err != nil || generated || string(firstKey) != string(secondKey) {
+		t.Errorf("The existing keys must be reused, got [%v]", err)
+	}
+}
+
+func TestEnsureAccessKeysWithMismatchedPair(t *testing.T) {
+	//setup
+	keysPath, restore := emptyKeysPath(t)
+	defer restore()
+	GenAccessKeys(WorkerId)
+	otherKeys, _ := GenerateKeyPair(KeyRSA)
+	ioutil.WriteFile(filepath.Join(keysPath, WorkerId+".pub"), otherKeys.Public, 0600)
+
+	//exercise
+	generated, err := EnsureAccessKeys(WorkerId)
+
+	//verification
+	if err != nil || !generated {
+		t.Errorf("The mismatched keys must be replaced, got [%v]", err)
+	}
+
+	if err := checkKeyPair(WorkerId); err != nil {
+		t.Errorf("The new keys must match, got [%v]", err)
+	}
+}
+
+func TestEnsureAccessKeysCompletesInterruptedRotation(t *testing.T) {
+	//setup
+	keysPath, restore := emptyKeysPath(t)
+	defer restore()
+	GenAccessKeys(WorkerId)
+	newKeys, _ := GenerateKeyPair(KeyRSA)
+	StageKeys(WorkerId, newKeys)
+	//the rotation is interrupted right after the private key is replaced
+	os.Rename(filepath.Join(keysPath, WorkerId+".priv.new"), filepath.Join(keysPath, WorkerId+".priv"))
+
+	//exercise
+	generated, err := EnsureAccessKeys(WorkerId)
+
+	//verification
+	publicKey, _ := ioutil.ReadFile(filepath.Join(keysPath, WorkerId+".pub"))
+
+	if err != nil || generated || string(publicKey) != string(newKeys.Public) {
+		t.Errorf("The interrupted rotation must be completed, got [%v]", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(keysPath, WorkerId+".pub.new")); !os.IsNotExist(err) {
+		t.Errorf("The staged key must not be left behind")
+	}
+}
+
+func TestEnsureAccessKeysKeepsStagedPair(t *testing.T) {
+	//setup
+	keysPath, restore := emptyKeysPath(t)
+	defer restore()
+	GenAccessKeys(WorkerId)
+	current, _ := ioutil.ReadFile(filepath.Join(keysPath, WorkerId+".priv"))
+	newKeys, _ := GenerateKeyPair(KeyEd25519)
+	StageKeys(WorkerId, newKeys)
+
+	//exercise
+	generated, err := EnsureAccessKeys(WorkerId)
+
+	//verification
+	privateKey, _ := ioutil.ReadFile(filepath.Join(keysPath, WorkerId+".priv"))
+	staged, stagedErr := StagedKeys(WorkerId)
+
+	if err != nil || generated || string(privateKey) != string(current) {
+		t.Errorf("The current keys must be kept, got [%v]", err)
+	}
+
+	if stagedErr != nil || string(staged.Public) != string(newKeys.Public) {
+		t.Errorf("The staged pair the server may have accepted must be kept, got [%v]", stagedErr)
+	}
+}
@@ -2,13 +2,17 @@
 
 # Read the task script file and execute one command at a time, saving your exitcodes in the .ts.ec file.
 # Each command executed is written to the .cmds file.
+# The start and end timestamps (epoch milliseconds) of each command are written to the .times file.
 # Use -tsf= or --task_filepath= to input the task file path (Required).
 # Use the flag -d or --debug to store .out and .err from execution (Optional).
+# Use the flag -ff or --fail-fast to stop the execution at the first non-zero exit code command (Optional).
+# Set ARREBOL_WORK_DIR to change the directory where the files above are written (Optional).
 
-# This flag does the execution not stop on non-zero exit code commands
+# This flag does the execution not stop on non-zero exit code commands;
+# the fail fast mode stops it explicitly.
 set +e
 
-WORK_DIR=/arrebol
+WORK_DIR=${ARREBOL_WORK_DIR:-/arrebol}
 
 for i in "$@"
 do
@@ -21,6 +25,10 @@ do
 	    DEBUG=YES
 	    shift
 	    ;;
+	    -ff|--fail-fast)
+	    FAIL_FAST=YES
+	    shift
+	    ;;
 	    *)
 	        # unknown option
 	    ;;
@@ -43,6 +51,10 @@ __COMMANDS=$WORK_DIR/$TS_FILENAME.cmds
 rm $__COMMANDS
 touch $__COMMANDS
 
+__TIMES=$WORK_DIR/$TS_FILENAME.times
+rm $__TIMES
+touch $__TIMES
+
 if [ -n "$DEBUG" ];
 then
 	rm $WORK_DIR/$TS_FILENAME.out
@@ -53,7 +65,15 @@ fi
 
 while IFS= read -r __line || [ -n "$__line" ]; do
 	set +e
-    eval $__line
-	  echo $__line >> $__COMMANDS
-    echo "$?" >> $__EXIT_CODES
+	__start=$(date +%s%3N)
+	eval $__line
+	__exit_code=$?
+	__end=$(date +%s%3N)
+	echo $__line >> $__COMMANDS
+	echo "$__start $__end" >> $__TIMES
+	echo "$__exit_code" >> $__EXIT_CODES
+	if [ -n "$FAIL_FAST" ] && [ "$__exit_code" -ne 0 ];
+	then
+		exit $__exit_code
+	fi
 done < $__TASK_SCRIPT_FILEPATH
\ No newline at end of file
@@ -0,0 +1,175 @@
+package worker
+
+//This module implements the per-command results of a task, which are built from the
+//exit codes and timestamps written by the executor script, the failure policies
+//that decide the task's final state from them, and the execution modes of the script.
+
+import (
+	"errors"
+	"github.com/ufcg-lsd/arrebol-pb-worker/utils"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	TaskFailurePolicyKey = "TASK_FAILURE_POLICY"
+)
+
+//It decides whether the non-zero exit codes of the task's commands make it fail.
+type FailurePolicy string
+
+const (
+	//The task is finished no matter the exit codes of its commands
+	PolicyIgnore FailurePolicy = "ignore"
+	//The task runs all of its commands, and fails if some of them has exited non-zero
+	PolicyFailOnAnyNonZero FailurePolicy = "fail-on-any-nonzero"
+	//The task is stopped and fails as soon as some command exits non-zero.
+	//It implies the fail-fast execution mode.
+	PolicyFailFast FailurePolicy = "fail-fast"
+)
+
+//It decides whether the executor script goes on after a command exits non-zero.
+type ExecutionMode string
+
+const (
+	//All the commands are executed, no matter the exit codes of the previous ones
+	ModeContinue ExecutionMode = "continue"
+	//The execution stops at the first command that exits non-zero,
+	//so the commands after it are skipped
+	ModeFailFast ExecutionMode = "fail-fast"
+)
+
+//This struct represents the execution of one of the task's commands.
+type CommandResult struct {
+	Command    string
+	ExitCode   int
+	StartedAt  time.Time
+	FinishedAt time.Time
+	// Whether the command has not been executed because a previous one has
+	// failed in the fail-fast execution mode
+	Skipped bool
+}
+
+//It returns the task's failure policy. If the task doesn't set one,
+//the worker's default policy is used, which is ignore unless configured.
+func (task *Task) failurePolicy() FailurePolicy {
+	policy := task.FailurePolicy
+
+	if policy == "" {
+		policy = FailurePolicy(os.Getenv(TaskFailurePolicyKey))
+	}
+
+	switch policy {
+	case PolicyFailOnAnyNonZero, PolicyFailFast:
+		return policy
+	case "", PolicyIgnore:
+		return PolicyIgnore
+	default:
+		utils.Log().With(utils.TaskIdField, task.Id).With("policy", policy).Warn("Unknown failure policy; ignoring the exit codes")
+		return PolicyIgnore
+	}
+}
+
+//It returns the task's execution mode, which is fail-fast if either
+//the task asks for it or its failure policy is fail-fast.
+func (task *Task) executionMode() ExecutionMode {
+	if task.ExecutionMode == ModeFailFast || task.failurePolicy() == PolicyFailFast {
+		return ModeFailFast
+	}
+
+	return ModeContinue
+}
+
+//It decides the final state of a task whose commands have been executed.
+func (p FailurePolicy) decide(results []CommandResult) TaskOutcome {
+	if p == PolicyIgnore {
+		return TaskOutcome{State: TaskFinished}
+	}
+
+	for _, result := range results {
+		if result.ExitCode != 0 {
+			return TaskOutcome{State: TaskFailed, Cause: CauseCommandFailed}
+		}
+	}
+
+	return TaskOutcome{State: TaskFinished}
+}
+
+//It builds the results of the executed commands.
+//Params:
+//commands - the task's commands
+//exitCodes - the exit codes of the executed commands, in execution order
+//times - the content of the .times file, one "start end" line
+//(epoch milliseconds) per executed command
+func buildCommandResults(commands []string, exitCodes []int, times string) []CommandResult {
+	lines := strings.Split(strings.TrimSpace(times), "\n")
+	results := make([]CommandResult, 0, len(exitCodes))
+
+	for i, exitCode := range exitCodes {
+		result := CommandResult{ExitCode: exitCode}
+
+		if i < len(commands) {
+			result.Command = commands[i]
+		}
+
+		if i < len(lines) {
+			result.StartedAt, result.FinishedAt = parseTimes(lines[i])
+		}
+
+		results = append(results, result)
+	}
+
+	return results
+}
+
+//It appends the commands skipped by a fail-fast execution to the results.
+//It returns the results and the index of the command that has failed, which
+//is nil if no command has failed.
+func skipAfterFailure(commands []string, results []CommandResult) ([]CommandResult, *int) {
+	if len(results) == 0 || results[len(results)-1].ExitCode == 0 {
+		return results, nil
+	}
+
+	failed := len(results) - 1
+
+	for i := len(results); i < len(commands); i++ {
+		results = append(results, CommandResult{Command: commands[i], Skipped: true})
+	}
+
+	return results, &failed
+}
+
+//It checks that each command fits in a line, since the executor script runs the task
+//script line by line, and the results are paired with the commands by their order.
+//It returns an error if some command has a line break.
+func validateCommands(commands []string) error {
+	for i, command := range commands {
+		if strings.ContainsAny(command, "\r\n") {
+			return errors.New("The command " + strconv.Itoa(i) + " has a line break")
+		}
+	}
+
+	return nil
+}
+
+func parseTimes(line string) (time.Time, time.Time) {
+	fields := strings.Fields(line)
+
+	if len(fields) != 2 {
+		return time.Time{}, time.Time{}
+	}
+
+	return parseMillis(fields[0]), parseMillis(fields[1])
+}
+
+func parseMillis(s string) time.Time {
+	millis, err := strconv.ParseInt(s, 10, 64)
+
+	if err != nil {
+		return time.Time{}
+	}
+
+	return time.Unix(0, millis*int64(time.Millisecond)).UTC()
+}
@@ -0,0 +1,162 @@
+package worker
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestBuildCommandResults(t *testing.T) {
+	//setup
+	commands := []string{"echo 'arrebol'", "false", "echo 'not executed yet'"}
+	times := "1590000000000 1590000000500\r\n1590000000500 1590000001000\r\n"
+
+	//exercise
+	results := buildCommandResults(commands, []int{0, 1}, times)
+
+	//verification
+	if len(results) != 2 {
+		t.Fatalf("Only the executed commands must have results, got %d", len(results))
+	}
+
+	if results[1].Command != "false" || results[1].ExitCode != 1 {
+		t.Errorf("The result is not the expected one: %v", results[1])
+	}
+
+	if !results[0].StartedAt.Equal(time.Unix(1590000000, 0)) || results[0].FinishedAt.Sub(results[0].StartedAt) != 500*time.Millisecond {
+		t.Errorf("The timestamps are not the expected ones: %v", results[0])
+	}
+}
+
+func TestBuildCommandResultsWithExitCodesAbove127(t *testing.T) {
+	//exercise
+	results := buildCommandResults([]string{"exit 200"}, []int{200}, "")
+
+	//verification
+	if results[0].ExitCode != 200 {
+		t.Errorf("The exit code must not be truncated, got %d", results[0].ExitCode)
+	}
+}
+
+func TestFailurePolicy_Decide(t *testing.T) {
+	//setup
+	succeeded := []CommandResult{{Command: "true", ExitCode: 0}}
+	failed := []CommandResult{{Command: "false", ExitCode: 1}, {Command: "true", ExitCode: 0}}
+
+	//exercise and verification
+	if outcome := PolicyIgnore.decide(failed); outcome.State != TaskFinished {
+		t.Errorf("The ignore policy must finish the task, got %v", outcome.State)
+	}
+
+	for _, policy := range []FailurePolicy{PolicyFailOnAnyNonZero, PolicyFailFast} {
+		if outcome := policy.decide(failed); outcome.State != TaskFailed || outcome.Cause != CauseCommandFailed {
+			t.Errorf("The %s policy must fail the task, got %v", policy, outcome.State)
+		}
+
+		if outcome := policy.decide(succeeded); outcome.State != TaskFinished {
+			t.Errorf("The %s policy must finish the task, got %v", policy, outcome.State)
+		}
+	}
+}
+
+func TestTask_FailurePolicy(t *testing.T) {
+	//setup
+	defer os.Unsetenv(TaskFailurePolicyKey)
+
+	//exercise and verification
+	if policy := (&Task{}).failurePolicy(); policy != PolicyIgnore {
+		t.Errorf("The default policy must be ignore, got %s", policy)
+	}
+
+	os.Setenv(TaskFailurePolicyKey, string(PolicyFailOnAnyNonZero))
+
+	if policy := (&Task{}).failurePolicy(); policy != PolicyFailOnAnyNonZero {
+		t.Errorf("The worker's policy must be used, got %s", policy)
+	}
+
+	if policy := (&Task{FailurePolicy: PolicyFailFast}).failurePolicy(); policy != PolicyFailFast {
+		t.Errorf("The task's policy must override the worker's one, got %s", policy)
+	}
+}
+
+func TestSkipAfterFailure(t *testing.T) {
+	//setup
+	commands := []string{"true", "false", "echo 'skipped'"}
+	results := []CommandResult{{Command: "true", ExitCode: 0}, {Command: "false", ExitCode: 1}}
+
+	//exercise
+	results, failed := skipAfterFailure(commands, results)
+
+	//verification
+	if failed == nil || *failed != 1 {
+		t.Fatalf("The failed command index is not the expected one")
+	}
+
+	if len(results) != 3 || !results[2].Skipped || results[2].Command != "echo 'skipped'" {
+		t.Errorf("The commands after the failed one must be reported as skipped")
+	}
+}
+
+func TestSkipAfterFailureWithoutFailure(t *testing.T) {
+	//setup
+	results := []CommandResult{{Command: "true", ExitCode: 0}}
+
+	//exercise
+	results, failed := skipAfterFailure([]string{"true"}, results)
+
+	//verification
+	if failed != nil || len(results) != 1 {
+		t.Errorf("No command must be skipped")
+	}
+}
+
+func TestTask_ExecutionMode(t *testing.T) {
+	//exercise and verification
+	if mode := (&Task{}).executionMode(); mode != ModeContinue {
+		t.Errorf("The default mode must be continue, got %s", mode)
+	}
+
+	if mode := (&Task{ExecutionMode: ModeFailFast}).executionMode(); mode != ModeFailFast {
+		t.Errorf("The task's mode must be used, got %s", mode)
+	}
+
+	if mode := (&Task{FailurePolicy: PolicyFailFast}).executionMode(); mode != ModeFailFast {
+		t.Errorf("The fail-fast policy must imply the fail-fast mode, got %s", mode)
+	}
+}
+
+func TestSkipAfterFailureWithMoreResultsThanCommands(t *testing.T) {
+	//setup
+	results := []CommandResult{{Command: "true", ExitCode: 0}, {ExitCode: 1}}
+
+	//exercise
+	results, failed := skipAfterFailure([]string{"true"}, results)
+
+	//verification
+	if failed == nil || *failed != 1 || len(results) != 2 {
+		t.Errorf("The results must be kept as they are, got %+v", results)
+	}
+}
+
+func TestValidateCommands(t *testing.T) {
+	//setup
+	cases := map[string]bool{
+		"echo 'one line'":        true,
+		"echo 'first'\necho two": false,
+		"echo 'carriage'\r":      false,
+	}
+
+	for command, valid := range cases {
+		//exercise
+		err := validateCommands([]string{"true", command})
+
+		//verification
+		if valid && err != nil {
+			t.Errorf("The command %q must be valid, got [%v]", command, err)
+		}
+
+		if !valid && err == nil {
+			t.Errorf("The command %q must be refused", command)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package worker
+
+//This module implements the rotation of the worker's key pair. A new pair is
+//generated and staged next to the current one, and its public key is sent to the
+//server in a request signed with the current private key, which proves the worker
+//owns it. The staged pair only replaces the current one once the server accepts it,
+//so the worker never ends up with a key the server doesn't know. If the server
+//couldn't be reached, it may have accepted the pair anyway, so the pair is kept
+//staged and sent again, rather than discarded, until the server answers.
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/ufcg-lsd/arrebol-pb-worker/utils"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	//How many times the new public key is sent while the server is unavailable
+	KeyRotationAttempts      = 3
+	KeyRotationRetryInterval = 5 * time.Second
+)
+
+//This struct represents the request for the server to replace the worker's public key.
+type KeyRotation struct {
+	//The new public key, PEM encoded in base64
+	PublicKey string
+}
+
+//It replaces the worker's key pair by a new one, which the server is asked to accept.
+//The pair staged by a previous rotation the server may have accepted is sent again
+//instead of a new one.
+//It returns:
+//1. an error if the new pair couldn't be generated or staged, or the server has
+//refused it, in which case the current pair is kept and the staged one is discarded
+//2. an error if the server couldn't be reached, or has refused a pair it may have
+//accepted before, in which case the current pair is kept and the staged one is left
+//to be sent again by the next rotation
+//3. an error if the server has accepted the new pair, but it couldn't replace the current one
+//4. nil otherwise
+func (w *Worker) RotateKeys(serverEndpoint string) error {
+	keys, pending, err := w.rotationKeys()
+
+	if err != nil {
+		return err
+	}
+
+	token, _ := w.credentials()
+	headers := http.Header{}
+	headers.Set("arrebol-worker-token", token)
+	rotation := KeyRotation{PublicKey: base64.StdEncoding.EncodeToString(keys.Public)}
+	backoff := utils.NewBackoff(KeyRotationRetryInterval, 4*KeyRotationRetryInterval, 2, 0)
+
+	for attempt := 1; ; attempt++ {
+		//the request is signed with the current private key, since the staged one isn't committed yet
+		_, err = utils.Post(w.Id, rotation, headers.Clone(), serverEndpoint+"/workers/"+w.Id+"/keys")
+
+		if err == nil || refused(err) || attempt == KeyRotationAttempts {
+			break
+		}
+
+		interval := backoff.Next()
+		w.logger().WithError(err).With("retry_in", interval).Warn("Error on sending the new keys; retrying")
+		pending = true
+		sleep(context.Background(), interval)
+	}
+
+	switch {
+	case err == nil:
+		if err := utils.CommitStagedKeys(w.Id); err != nil {
+			return err
+		}
+	//a pair the server may have accepted before is refused as unauthorized or conflicting,
+	//since the request is signed with the replaced key, so only the other refusals are final
+	case refused(err) && (!pending || !refusedIfAccepted(err)):
+		utils.DiscardStagedKeys(w.Id)
+		return fmt.Errorf("Error on rotating the keys: %w", err)
+	default:
+		w.logger().With("keys_path", os.Getenv(utils.KeysPathKey)).
+			Warn("The new keys are kept to be sent again by the next rotation; if the server hasn't accepted them, " +
+				"remove the " + utils.StagedKeyExt + " files of the keys path so the next rotation generates a new pair")
+		return fmt.Errorf("Error on rotating the keys; the new ones are kept to be sent again: %w", err)
+	}
+
+	w.logger().Info("Keys rotated")
+	return nil
+}
+
+//It returns the key pair to be sent to the server, which is the one left staged by
+//a previous rotation, if there is one, or a new one, which is staged.
+//It returns whether the pair has been sent before, and an error if the new pair
+//couldn't be generated or staged.
+func (w *Worker) rotationKeys() (utils.KeyPair, bool, error) {
+	if keys, err := utils.StagedKeys(w.Id); err == nil {
+		w.logger().Warn("Sending again the keys of a rotation the server may have accepted")
+		return keys, true, nil
+	}
+
+	keys, err := utils.GenerateKeyPair(utils.KeyTypeFromEnv())
+
+	if err != nil {
+		return utils.KeyPair{}, false, err
+	}
+
+	return keys, false, utils.StageKeys(w.Id, keys)
+}
+
+//It checks whether the server has certainly refused the request, which is when it has
+//answered with a client error. The server may have handled the other failed requests.
+func refused(err error) bool {
+	var requestErr *utils.RequestError
+	return errors.As(err, &requestErr) && requestErr.StatusCode >= 400 && requestErr.StatusCode < 500
+}
+
+//It checks whether the refusal is the one the server may answer to a pair it has
+//already accepted, which is unauthorized or conflicting.
+func refusedIfAccepted(err error) bool {
+	var requestErr *utils.RequestError
+	return errors.As(err, &requestErr) &&
+		(requestErr.StatusCode == http.StatusUnauthorized || requestErr.StatusCode == http.StatusConflict)
+}
@@ -0,0 +1,224 @@
+package worker
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/ufcg-lsd/arrebol-pb-worker/utils"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var (
+	//The signature function, before the tests replace it
+	signPayload = utils.GetSignature
+)
+
+//It starts a mock server that accepts the key rotations signed with the worker's
+//current key, answering the status codes in order. The last one answers the remaining rotations.
+//It returns the server and the public keys it has received.
+func keyRotationServer(t *testing.T, workerId string, statusCodes ...int) (*httptest.Server, *[]string) {
+	received := make([]string, 0)
+	currentKey, err := utils.GetPublicKey(workerId)
+
+	if err != nil {
+		t.Fatalf("Error on reading the current key: %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		_, err := utils.VerifyRequest(r, body, currentKey, time.Now())
+
+		if r.URL.Path != "/workers/"+workerId+"/keys" || err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var rotation KeyRotation
+		json.Unmarshal(body, &rotation)
+		received = append(received, rotation.PublicKey)
+
+		if len(received) < len(statusCodes) {
+			w.WriteHeader(statusCodes[len(received)-1])
+			return
+		}
+
+		w.WriteHeader(statusCodes[len(statusCodes)-1])
+	}))
+
+	return server, &received
+}
+
+//It points the keys path to a temp dir with the worker's keys, and sends the requests
+//to the mock server signed with the actual keys, restoring all of them when the returned func is called.
+func rotationTestKeys(t *testing.T, w *Worker) (string, func()) {
+	keysPath, err := ioutil.TempDir("", "keys")
+
+	if err != nil {
+		t.Fatalf("Error on creating the keys path: %v", err)
+	}
+
+	previous, previousClient, previousSignature := os.Getenv(utils.KeysPathKey), utils.Client, utils.GetSignature
+	os.Setenv(utils.KeysPathKey, keysPath)
+	utils.GenAccessKeys(w.Id)
+	utils.GetSignature = signPayload
+	utils.Client = &http.Client{}
+
+	return keysPath, func() {
+		os.Setenv(utils.KeysPathKey, previous)
+		utils.Client, utils.GetSignature = previousClient, previousSignature
+		os.RemoveAll(keysPath)
+	}
+}
+
+func TestWorker_RotateKeys(t *testing.T) {
+	//setup
+	w := &Worker{Id: "1023", Token: "test-token", QueueId: 932}
+	keysPath, restore := rotationTestKeys(t, w)
+	defer restore()
+
+	server, received := keyRotationServer(t, w.Id, http.StatusOK)
+	defer server.Close()
+
+	//exercise
+	err := w.RotateKeys(server.URL)
+
+	//verification
+	if err != nil || len(*received) != 1 {
+		t.Fatalf("The rotation must be accepted, got [%v]", err)
+	}
+
+	publicKey, _ := ioutil.ReadFile(filepath.Join(keysPath, w.Id+".pub"))
+
+	if (*received)[0] != base64.StdEncoding.EncodeToString(publicKey) {
+		t.Error("The current key must be the one the server has accepted")
+	}
+
+	if _, err := utils.EnsureAccessKeys(w.Id); err != nil {
+		t.Errorf("The rotated keys must be a valid pair, got [%v]", err)
+	}
+
+	if staged, _ := filepath.Glob(filepath.Join(keysPath, "*.new")); len(staged) != 0 {
+		t.Errorf("The staged keys must not be left behind, got %v", staged)
+	}
+}
+
+func TestWorker_RotateKeysRejected(t *testing.T) {
+	//setup
+	w := &Worker{Id: "1023", Token: "test-token", QueueId: 932}
+	keysPath, restore := rotationTestKeys(t, w)
+	defer restore()
+
+	server, _ := keyRotationServer(t, w.Id, http.StatusForbidden)
+	defer server.Close()
+
+	before, _ := ioutil.ReadFile(filepath.Join(keysPath, w.Id+".priv"))
+
+	//exercise
+	err := w.RotateKeys(server.URL)
+
+	//verification
+	after, _ := ioutil.ReadFile(filepath.Join(keysPath, w.Id+".priv"))
+
+	if err == nil || string(before) != string(after) {
+		t.Errorf("The current keys must be kept when the server rejects the rotation, got [%v]", err)
+	}
+
+	if staged, _ := filepath.Glob(filepath.Join(keysPath, "*.new")); len(staged) != 0 {
+		t.Errorf("The staged keys must be discarded, got %v", staged)
+	}
+}
+
+func TestWorker_RotateKeysServerUnavailable(t *testing.T) {
+	//setup
+	w := &Worker{Id: "1023", Token: "test-token", QueueId: 932}
+	keysPath, restore := rotationTestKeys(t, w)
+	defer restore()
+
+	unavailable, sent := keyRotationServer(t, w.Id, http.StatusServiceUnavailable)
+	defer unavailable.Close()
+
+	waits := make([]time.Duration, 0)
+	sleep = func(ctx context.Context, d time.Duration) {
+		waits = append(waits, d)
+	}
+	defer func() { sleep = wait }()
+
+	before, _ := ioutil.ReadFile(filepath.Join(keysPath, w.Id+".priv"))
+
+	//exercise
+	err := w.RotateKeys(unavailable.URL)
+
+	//verification
+	after, _ := ioutil.ReadFile(filepath.Join(keysPath, w.Id+".priv"))
+
+	if err == nil || string(before) != string(after) || len(*sent) != KeyRotationAttempts || len(waits) != KeyRotationAttempts-1 {
+		t.Fatalf("The keys must be sent %d times and kept while the server is unavailable, got %d sends and [%v]", KeyRotationAttempts, len(*sent), err)
+	}
+
+	if staged, _ := filepath.Glob(filepath.Join(keysPath, "*.new")); len(staged) != 2 {
+		t.Fatalf("The staged keys must be kept, since the server may have accepted them, got %v", staged)
+	}
+
+	//the server which may have accepted the keys refuses them once they are sent again
+	refusing, _ := keyRotationServer(t, w.Id, http.StatusUnauthorized)
+	defer refusing.Close()
+
+	if err := w.RotateKeys(refusing.URL); err == nil {
+		t.Error("The refused rotation must fail")
+	}
+
+	if staged, _ := filepath.Glob(filepath.Join(keysPath, "*.new")); len(staged) != 2 {
+		t.Errorf("The keys the server may have accepted must not be discarded, got %v", staged)
+	}
+
+	recovered, received := keyRotationServer(t, w.Id, http.StatusServiceUnavailable, http.StatusOK)
+	defer recovered.Close()
+
+	if err := w.RotateKeys(recovered.URL); err != nil || len(*received) != 2 || (*received)[1] != (*sent)[0] {
+		t.Errorf("The staged keys must be sent again until the server accepts them, got [%v]", err)
+	}
+
+	if staged, _ := filepath.Glob(filepath.Join(keysPath, "*.new")); len(staged) != 0 {
+		t.Errorf("The staged keys must be committed, got %v", staged)
+	}
+}
+
+func TestWorker_RotateKeysPendingRefused(t *testing.T) {
+	//setup
+	w := &Worker{Id: "1023", Token: "test-token", QueueId: 932}
+	keysPath, restore := rotationTestKeys(t, w)
+	defer restore()
+
+	//the pair of a rotation the server may have accepted
+	pending, _ := utils.GenerateKeyPair(utils.KeyEd25519)
+	utils.StageKeys(w.Id, pending)
+
+	refusing, sent := keyRotationServer(t, w.Id, http.StatusBadRequest)
+	defer refusing.Close()
+
+	//exercise
+	err := w.RotateKeys(refusing.URL)
+
+	//verification
+	if err == nil || len(*sent) != 1 || (*sent)[0] != base64.StdEncoding.EncodeToString(pending.Public) {
+		t.Fatalf("The pending keys must be sent again and refused, got [%v]", err)
+	}
+
+	if staged, _ := filepath.Glob(filepath.Join(keysPath, "*.new")); len(staged) != 0 {
+		t.Fatalf("The keys the server has refused for good must be discarded, got %v", staged)
+	}
+
+	accepting, received := keyRotationServer(t, w.Id, http.StatusOK)
+	defer accepting.Close()
+
+	if err := w.RotateKeys(accepting.URL); err != nil || len(*received) != 1 || (*received)[0] == (*sent)[0] {
+		t.Errorf("The next rotation must send a new pair, got [%v]", err)
+	}
+}
@@ -0,0 +1,82 @@
+package worker
+
+//This module implements the metrics of the worker activity, such as the fetched
+//and ended tasks, their duration, the image pulls and the joins. They are kept
+//in the utils.Metrics registry, along with the metrics of the requests to the server.
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/ufcg-lsd/arrebol-pb-worker/utils"
+	"time"
+)
+
+const (
+	JoinSucceeded = "succeeded"
+	JoinFailed    = "failed"
+)
+
+var (
+	metrics = promauto.With(utils.Metrics)
+
+	tasksFetched = metrics.NewCounter(prometheus.CounterOpts{
+		Namespace: utils.MetricsNamespace,
+		Name:      "tasks_fetched_total",
+		Help:      "The tasks the server has dispatched to the worker.",
+	})
+	tasksFinished = metrics.NewCounter(prometheus.CounterOpts{
+		Namespace: utils.MetricsNamespace,
+		Name:      "tasks_finished_total",
+		Help:      "The tasks that have finished successfully.",
+	})
+	tasksFailed = metrics.NewCounterVec(prometheus.CounterOpts{
+		Namespace: utils.MetricsNamespace,
+		Name:      "tasks_failed_total",
+		Help:      "The tasks that haven't finished successfully, by final state and failure cause.",
+	}, []string{"state", "cause"})
+	taskDuration = metrics.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: utils.MetricsNamespace,
+		Name:      "task_duration_seconds",
+		Help:      "The time from the task start to its final report, by final state.",
+		//from 1 second to about 4.5 hours
+		Buckets: prometheus.ExponentialBuckets(1, 4, 8),
+	}, []string{"state"})
+	imagePullDuration = metrics.NewHistogram(prometheus.HistogramOpts{
+		Namespace: utils.MetricsNamespace,
+		Name:      "image_pull_duration_seconds",
+		Help:      "The time to pull the task images that weren't in the worker node.",
+		//from half a second to about 4 minutes
+		Buckets: prometheus.ExponentialBuckets(0.5, 2, 10),
+	})
+	joinAttempts = metrics.NewCounterVec(prometheus.CounterOpts{
+		Namespace: utils.MetricsNamespace,
+		Name:      "join_attempts_total",
+		Help:      "The attempts to join the server, by result.",
+	}, []string{"result"})
+	reportFailures = metrics.NewCounter(prometheus.CounterOpts{
+		Namespace: utils.MetricsNamespace,
+		Name:      "report_failures_total",
+		Help:      "The task reports that the server hasn't accepted or that couldn't be sent.",
+	})
+)
+
+//It counts the ended task and observes its duration, by its final state.
+func observeTaskEnd(task *Task, duration time.Duration) {
+	state := task.State.String()
+
+	if task.State == TaskFinished {
+		tasksFinished.Inc()
+	} else {
+		tasksFailed.WithLabelValues(state, string(task.FailureCause)).Inc()
+	}
+
+	taskDuration.WithLabelValues(state).Observe(duration.Seconds())
+}
+
+func observeJoin(err error) {
+	if err != nil {
+		joinAttempts.WithLabelValues(JoinFailed).Inc()
+	} else {
+		joinAttempts.WithLabelValues(JoinSucceeded).Inc()
+	}
+}
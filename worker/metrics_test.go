@@ -0,0 +1,81 @@
+package worker
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/ufcg-lsd/arrebol-pb-worker/utils"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestObserveTaskEnd(t *testing.T) {
+	//setup
+	finished := testutil.ToFloat64(tasksFinished)
+	oomKilled := testutil.ToFloat64(tasksFailed.WithLabelValues("TaskFailed", string(CauseOOMKilled)))
+	timedOut := testutil.ToFloat64(tasksFailed.WithLabelValues("TaskTimedOut", ""))
+
+	//exercise
+	observeTaskEnd(&Task{Id: "1", State: TaskFinished}, time.Second)
+	observeTaskEnd(&Task{Id: "2", State: TaskFailed, FailureCause: CauseOOMKilled}, time.Second)
+	observeTaskEnd(&Task{Id: "3", State: TaskTimedOut}, time.Minute)
+
+	//verification
+	if testutil.ToFloat64(tasksFinished) != finished+1 {
+		t.Error("The finished task must be counted")
+	}
+
+	if testutil.ToFloat64(tasksFailed.WithLabelValues("TaskFailed", string(CauseOOMKilled))) != oomKilled+1 {
+		t.Error("The failed task must be counted by its cause")
+	}
+
+	if testutil.ToFloat64(tasksFailed.WithLabelValues("TaskTimedOut", "")) != timedOut+1 {
+		t.Error("The timed out task must be counted as failed")
+	}
+
+	if testutil.CollectAndCount(taskDuration) < 3 {
+		t.Error("The task duration must be observed by final state")
+	}
+}
+
+func TestWorker_MetricsOfTheServerRequests(t *testing.T) {
+	//setup
+	workerTestInstance.QueueId = 932
+	utils.Client = &MockedClient{}
+	utils.GetSignature = func(message []byte, workerId string) ([]byte, string, error) {
+		return []byte("FAKE-SIGNATURE"), utils.AlgorithmRSAPSS, nil
+	}
+
+	fetched := testutil.ToFloat64(tasksFetched)
+	failedReports := testutil.ToFloat64(reportFailures)
+	failedJoins := testutil.ToFloat64(joinAttempts.WithLabelValues(JoinFailed))
+
+	//exercise
+	GetDo = func() (*http.Response, error) {
+		body, _ := json.Marshal(map[string]interface{}{"Id": "1", "Commands": []string{"true"}, "ReportInterval": 5})
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewReader(body))}, nil
+	}
+	workerTestInstance.GetTask("http://test-server:8000/v1")
+
+	GetDo = func() (*http.Response, error) {
+		return nil, errors.New("connection refused")
+	}
+	workerTestInstance.sendTaskReport(&Task{Id: "1", Commands: []string{}}, &TaskExecutor{}, "http://test-server:8000/v1")
+	workerTestInstance.Join("http://test-server:8000/v1")
+
+	//verification
+	if testutil.ToFloat64(tasksFetched) != fetched+1 {
+		t.Error("The fetched task must be counted")
+	}
+
+	if testutil.ToFloat64(reportFailures) != failedReports+1 {
+		t.Error("The report that couldn't be sent must be counted")
+	}
+
+	if testutil.ToFloat64(joinAttempts.WithLabelValues(JoinFailed)) != failedJoins+1 {
+		t.Error("The failed join attempt must be counted")
+	}
+}
@@ -0,0 +1,147 @@
+package worker
+
+//This module implements the slot scheduler, which allows the worker instance
+//to run several tasks at once. The Vcpu and Ram configured to the worker are
+//split evenly across its slots, and each slot owns a TaskExecutor.
+//The main loop must acquire a slot before getting a new task, so a task is only
+//fetched when there is room to run it.
+
+import (
+	"context"
+	"fmt"
+	"github.com/ufcg-lsd/arrebol-pb-worker/utils"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultSlots = 1
+	//The least Ram (MegaBytes) docker accepts as a container memory limit
+	MinSlotRam = 6
+)
+
+//It represents a share of the worker's resources in which a single task runs.
+type Slot struct {
+	Id int
+	//The Vcpu available to the slot
+	Vcpu float32
+	//The Ram available to the slot (MegaBytes)
+	Ram uint32
+	//The executor that runs the tasks assigned to the slot
+	Executor *TaskExecutor
+}
+
+type Scheduler struct {
+	slots chan *Slot
+	//Every slot, whether it is running a task or not
+	all     []*Slot
+	running sync.WaitGroup
+}
+
+//Creates a scheduler with as many slots as configured in the worker.
+//Params:
+//w - the worker whose Vcpu and Ram will be split across the slots
+//docker - the client of the docker daemon in which the slots' executors will run the tasks
+//It returns:
+//1. nil and an error if the worker mounts are invalid, or the Ram of each slot
+//is less than the MinSlotRam, so docker would refuse to create the task containers
+//2. the scheduler and nil otherwise
+func NewScheduler(w *Worker, docker *utils.DockerClient) (*Scheduler, error) {
+	amount := int(w.Slots)
+
+	if amount == 0 {
+		amount = DefaultSlots
+	}
+
+	if err := validateMounts(w.Mounts); err != nil {
+		return nil, err
+	}
+
+	//zero Ram means the containers have no memory limit
+	if ram := w.Ram / uint32(amount); w.Ram > 0 && ram < MinSlotRam {
+		return nil, fmt.Errorf("The Ram of each slot is %d MB, but docker needs at least %d MB", ram, MinSlotRam)
+	}
+
+	scheduler := &Scheduler{slots: make(chan *Slot, amount)}
+
+	for i := 0; i < amount; i++ {
+		slot := &Slot{
+			Id:   i,
+			Vcpu: w.Vcpu / float32(amount),
+			Ram:  w.Ram / uint32(amount),
+		}
+		slot.Executor = &TaskExecutor{
+			Docker: docker,
+			Limits: ResourceLimits{
+				Vcpu:         slot.Vcpu,
+				Ram:          slot.Ram,
+				PidsLimit:    w.PidsLimit,
+				MaxOpenFiles: w.MaxOpenFiles,
+			},
+			Mounts:        w.Mounts,
+			ResolveSecret: FileSecretStore(os.Getenv(SecretsPathKey)),
+		}
+		scheduler.slots <- slot
+		scheduler.all = append(scheduler.all, slot)
+	}
+
+	return scheduler, nil
+}
+
+//It blocks until some slot has room for a new task.
+//It returns:
+//1. nil and the context error, if the context is done before that
+//2. the slot and nil otherwise
+func (s *Scheduler) Acquire(ctx context.Context) (*Slot, error) {
+	select {
+	case slot := <-s.slots:
+		return slot, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+//It gives the slot back to the scheduler, so it can be acquired again.
+func (s *Scheduler) Release(slot *Slot) {
+	s.slots <- slot
+}
+
+//It runs the job in background, releasing the slot when the job returns.
+func (s *Scheduler) Run(slot *Slot, job func(slot *Slot)) {
+	s.running.Add(1)
+
+	go func() {
+		defer s.running.Done()
+		defer s.Release(slot)
+		job(slot)
+	}()
+}
+
+//It returns every slot of the scheduler, whether it is running a task or not.
+func (s *Scheduler) Slots() []*Slot {
+	return s.all
+}
+
+//It blocks until every running job returns.
+func (s *Scheduler) Wait() {
+	s.running.Wait()
+}
+
+//It blocks until every running job returns or the timeout expires.
+//It returns false if some job is still running.
+func (s *Scheduler) WaitTimeout(timeout time.Duration) bool {
+	done := make(chan struct{})
+
+	go func() {
+		s.running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,157 @@
+package worker
+
+import (
+	"context"
+	"github.com/ufcg-lsd/arrebol-pb-worker/utils"
+	"testing"
+	"time"
+)
+
+//It returns a client of the local docker daemon, which is not reached by the scheduler tests.
+func testDocker(t *testing.T) *utils.DockerClient {
+	docker, err := utils.NewDockerClient(utils.DockerConfig{})
+
+	if err != nil {
+		t.Fatalf("Error on creating the docker client: %v", err)
+	}
+
+	return docker
+}
+
+func acquire(t *testing.T, scheduler *Scheduler) *Slot {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	slot, err := scheduler.Acquire(ctx)
+
+	if err != nil {
+		t.Fatal("No slot has been released")
+	}
+
+	return slot
+}
+
+func TestNewScheduler(t *testing.T) {
+	//setup
+	w := Worker{Vcpu: 4, Ram: 1024, Id: "1023", Slots: 4}
+
+	//exercise
+	scheduler, err := NewScheduler(&w, testDocker(t))
+
+	//verification
+	if err != nil {
+		t.Fatal("Error on creating the scheduler: " + err.Error())
+	}
+
+	for i := 0; i < 4; i++ {
+		slot := acquire(t, scheduler)
+
+		if slot.Vcpu != 1 || slot.Ram != 256 {
+			t.Errorf("The slot resources are not the expected ones: %v vcpu, %v ram", slot.Vcpu, slot.Ram)
+		}
+
+		if slot.Executor == nil {
+			t.Errorf("The slot has no executor")
+		}
+	}
+}
+
+func TestNewSchedulerWithoutSlots(t *testing.T) {
+	//setup
+	w := Worker{Vcpu: 2, Ram: 512, Id: "1023"}
+
+	//exercise
+	scheduler, err := NewScheduler(&w, testDocker(t))
+
+	//verification
+	if err != nil {
+		t.Fatal("Error on creating the scheduler: " + err.Error())
+	}
+
+	slot := acquire(t, scheduler)
+
+	if slot.Vcpu != 2 || slot.Ram != 512 {
+		t.Errorf("The single slot must hold the whole worker budget")
+	}
+}
+
+func TestNewSchedulerWithTooLittleRam(t *testing.T) {
+	//setup
+	workers := []*Worker{
+		{Vcpu: 1, Ram: 2, Id: "1023"},
+		{Vcpu: 4, Ram: 20, Id: "1023", Slots: 4},
+	}
+
+	for _, w := range workers {
+		//exercise
+		scheduler, err := NewScheduler(w, testDocker(t))
+
+		//verification
+		if err == nil || scheduler != nil {
+			t.Errorf("The %d slots sharing %d MB of Ram must be refused", w.Slots, w.Ram)
+		}
+	}
+}
+
+func TestScheduler_Run(t *testing.T) {
+	//setup
+	w := Worker{Vcpu: 2, Ram: 512, Id: "1023", Slots: 2}
+	scheduler, _ := NewScheduler(&w, testDocker(t))
+	ran := make(chan int, 2)
+
+	//exercise
+	for i := 0; i < 2; i++ {
+		scheduler.Run(acquire(t, scheduler), func(slot *Slot) {
+			ran <- slot.Id
+		})
+	}
+	scheduler.Wait()
+
+	//verification
+	if len(ran) != 2 {
+		t.Errorf("Not every job has been run")
+	}
+
+	for i := 0; i < 2; i++ {
+		acquire(t, scheduler)
+	}
+}
+
+func TestScheduler_AcquireWithDoneContext(t *testing.T) {
+	//setup
+	w := Worker{Vcpu: 1, Ram: 256, Id: "1023"}
+	scheduler, _ := NewScheduler(&w, testDocker(t))
+	acquire(t, scheduler)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	//exercise
+	slot, err := scheduler.Acquire(ctx)
+
+	//verification
+	if err == nil || slot != nil {
+		t.Errorf("No slot must be acquired after the context is done")
+	}
+}
+
+func TestScheduler_WaitTimeout(t *testing.T) {
+	//setup
+	w := Worker{Vcpu: 1, Ram: 256, Id: "1023"}
+	scheduler, _ := NewScheduler(&w, testDocker(t))
+	release := make(chan struct{})
+
+	scheduler.Run(acquire(t, scheduler), func(slot *Slot) {
+		<-release
+	})
+
+	//exercise and verification
+	if scheduler.WaitTimeout(10 * time.Millisecond) {
+		t.Errorf("The running job must not be drained before it returns")
+	}
+
+	close(release)
+
+	if !scheduler.WaitTimeout(time.Second) {
+		t.Errorf("The job must be drained after it returns")
+	}
+}
@@ -0,0 +1,201 @@
+package worker
+
+//This module implements the verification of the token the server assigns to the worker
+//when it joins. The token must be signed, in one of the allowed algorithms, by a trusted
+//key of the server's key set (see utils.KeySet), and its claims are decoded into
+//TokenClaims, which must have an expiration, must not be used before their nbf and, if
+//the worker expects an audience, must be meant for it.
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/ufcg-lsd/arrebol-pb-worker/utils"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ServerTokenAlgorithmsKey = "SERVER_TOKEN_ALGORITHMS"
+	ServerTokenAudienceKey   = "SERVER_TOKEN_AUDIENCE"
+
+	//How far the token's time claims may be from the worker's clock
+	TokenLeeway = time.Minute
+)
+
+var (
+	//The algorithms the server tokens are accepted in by default
+	DefaultTokenAlgorithms = []string{"RS256", "PS256", "ES256"}
+
+	//It guards the tokenVerifier, which is configured when the worker starts
+	verifierLock  sync.RWMutex
+	tokenVerifier = NewTokenVerifier(utils.NewKeySet(utils.KeySetConfig{}), DefaultTokenAlgorithms, "")
+)
+
+//This struct represents the claims of the server token.
+type TokenClaims struct {
+	//The queue from which the worker must ask for tasks
+	QueueId   uint
+	ExpiresAt int64    `json:"exp"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	Issuer    string   `json:"iss,omitempty"`
+	Subject   string   `json:"sub,omitempty"`
+	Audience  Audience `json:"aud,omitempty"`
+}
+
+//It is the aud claim, which is either a single audience or a list of them.
+type Audience []string
+
+func (a *Audience) UnmarshalJSON(data []byte) error {
+	var single string
+
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = Audience{single}
+		return nil
+	}
+
+	var list []string
+
+	if err := json.Unmarshal(data, &list); err != nil {
+		return errors.New("The aud claim must be a string or a list of strings")
+	}
+
+	*a = list
+	return nil
+}
+
+func (a Audience) contains(audience string) bool {
+	for _, aud := range a {
+		if aud == audience {
+			return true
+		}
+	}
+
+	return false
+}
+
+//It checks the time claims against the current time, so the claims satisfy jwt.Claims.
+func (c *TokenClaims) Valid() error {
+	return c.validate(time.Now(), "")
+}
+
+//It checks the claims at the time.
+//Params:
+//now - the worker's clock
+//audience - the audience the token must be meant for. If it is empty, the aud claim isn't checked.
+//It returns an error if the token has no expiration, has expired, is not valid yet,
+//is not meant for the audience or has no queue id.
+func (c *TokenClaims) validate(now time.Time, audience string) error {
+	if c.ExpiresAt == 0 {
+		return errors.New("The token has no expiration")
+	}
+
+	if now.Add(-TokenLeeway).Unix() >= c.ExpiresAt {
+		return errors.New("The token has expired")
+	}
+
+	if c.NotBefore != 0 && now.Add(TokenLeeway).Unix() < c.NotBefore {
+		return errors.New("The token is not valid yet")
+	}
+
+	if audience != "" && !c.Audience.contains(audience) {
+		return errors.New("The token is not meant for the audience [" + audience + "]")
+	}
+
+	if c.QueueId == 0 {
+		return errors.New("The token has no queue id")
+	}
+
+	return nil
+}
+
+//It verifies the server tokens.
+type TokenVerifier struct {
+	keys       *utils.KeySet
+	algorithms []string
+	audience   string
+	//for test purpose
+	now func() time.Time
+}
+
+//It creates a verifier of the tokens signed by the keys of the set in one of the
+//algorithms, which must be meant for the audience, if it is not empty.
+func NewTokenVerifier(keys *utils.KeySet, algorithms []string, audience string) *TokenVerifier {
+	return &TokenVerifier{keys: keys, algorithms: algorithms, audience: audience, now: time.Now}
+}
+
+//It creates the verifier whose key set, algorithms and audience are read from the environment.
+//It returns an error if some of the algorithms is not an asymmetric one.
+func TokenVerifierFromEnv() (*TokenVerifier, error) {
+	algorithms := DefaultTokenAlgorithms
+
+	if value := os.Getenv(ServerTokenAlgorithmsKey); value != "" {
+		algorithms = make([]string, 0)
+
+		for _, alg := range strings.Split(value, ",") {
+			alg = strings.TrimSpace(alg)
+
+			if !isAsymmetricAlgorithm(alg) {
+				return nil, errors.New("The token algorithm [" + alg + "] is not allowed")
+			}
+
+			algorithms = append(algorithms, alg)
+		}
+	}
+
+	keys := utils.NewKeySet(utils.KeySetConfigFromEnv())
+	return NewTokenVerifier(keys, algorithms, os.Getenv(ServerTokenAudienceKey)), nil
+}
+
+//The tokens must be signed by the server's private key, so neither the none nor
+//the HMAC algorithms, whose key would be the server's public one, are allowed.
+func isAsymmetricAlgorithm(alg string) bool {
+	switch jwt.GetSigningMethod(alg).(type) {
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS, *jwt.SigningMethodECDSA:
+		return true
+	default:
+		return false
+	}
+}
+
+//It sets the verifier of the tokens the server assigns to the worker.
+func ConfigureTokenVerifier(verifier *TokenVerifier) {
+	verifierLock.Lock()
+	defer verifierLock.Unlock()
+	tokenVerifier = verifier
+}
+
+//It verifies the token's signature and claims.
+//It returns:
+//1. nil and an error if the token is malformed, isn't signed by a trusted key in an
+//allowed algorithm, or its claims are invalid
+//2. the token claims and nil otherwise
+func (v *TokenVerifier) Verify(tokenStr string) (*TokenClaims, error) {
+	claims := &TokenClaims{}
+	parser := &jwt.Parser{ValidMethods: v.algorithms, SkipClaimsValidation: true}
+
+	_, err := parser.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return v.keys.Key(kid)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := claims.validate(v.now(), v.audience); err != nil {
+		return nil, fmt.Errorf("Invalid token claims: %w", err)
+	}
+
+	return claims, nil
+}
+
+func parseToken(tokenStr string) (*TokenClaims, error) {
+	verifierLock.RLock()
+	verifier := tokenVerifier
+	verifierLock.RUnlock()
+	return verifier.Verify(tokenStr)
+}
@@ -0,0 +1,222 @@
+package worker
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/ufcg-lsd/arrebol-pb-worker/utils"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	TestKeyId = "server-key-1"
+)
+
+//It starts a mock JWKS endpoint serving a new EC P-256 key of id TestKeyId, and sends
+//the requests through an actual client, restoring the previous one when the returned func is called.
+//It returns the endpoint URL and the private key of the served one.
+func jwksServer(t *testing.T) (string, *ecdsa.PrivateKey, func()) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatalf("Error on generating the server key: %v", err)
+	}
+
+	set := map[string][]map[string]string{"keys": {{
+		"kid": TestKeyId,
+		"kty": "EC",
+		"crv": "P-256",
+		"use": "sig",
+		"x":   base64.RawURLEncoding.EncodeToString(privateKey.X.Bytes()),
+		"y":   base64.RawURLEncoding.EncodeToString(privateKey.Y.Bytes()),
+	}}}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(set)
+	}))
+
+	previous := utils.Client
+	utils.Client = &http.Client{}
+
+	return server.URL, privateKey, func() {
+		utils.Client = previous
+		server.Close()
+	}
+}
+
+//It signs the claims with the key, in the ES256 algorithm and under the TestKeyId.
+func signToken(t *testing.T, privateKey *ecdsa.PrivateKey, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = TestKeyId
+	signed, err := token.SignedString(privateKey)
+
+	if err != nil {
+		t.Fatalf("Error on signing the token: %v", err)
+	}
+
+	return signed
+}
+
+func TestTokenVerifier_Verify(t *testing.T) {
+	//setup
+	jwksURL, privateKey, closeServer := jwksServer(t)
+	defer closeServer()
+
+	verifier := NewTokenVerifier(utils.NewKeySet(utils.KeySetConfig{URL: jwksURL}), DefaultTokenAlgorithms, "arrebol-worker")
+	expiry := time.Now().Add(time.Hour).Unix()
+	token := signToken(t, privateKey, jwt.MapClaims{
+		"QueueId": 932,
+		"exp":     expiry,
+		"nbf":     time.Now().Unix(),
+		"aud":     []string{"arrebol-worker", "arrebol-cli"},
+		"iss":     "arrebol-server",
+	})
+
+	//exercise
+	claims, err := verifier.Verify(token)
+
+	//verification
+	if err != nil {
+		t.Fatalf("The token must be valid, got [%v]", err)
+	}
+
+	if claims.QueueId != 932 || claims.ExpiresAt != expiry || claims.Issuer != "arrebol-server" || len(claims.Audience) != 2 {
+		t.Errorf("The claims must be decoded from the token, got %+v", claims)
+	}
+}
+
+func TestTokenVerifier_VerifyInvalidTokens(t *testing.T) {
+	//setup
+	jwksURL, privateKey, closeServer := jwksServer(t)
+	defer closeServer()
+
+	verifier := NewTokenVerifier(utils.NewKeySet(utils.KeySetConfig{URL: jwksURL}), DefaultTokenAlgorithms, "arrebol-worker")
+	now := time.Now()
+	valid := func() jwt.MapClaims {
+		return jwt.MapClaims{"QueueId": 932, "exp": now.Add(time.Hour).Unix(), "aud": "arrebol-worker"}
+	}
+
+	expired, notYetValid, otherAudience, noExpiration, noQueue := valid(), valid(), valid(), valid(), valid()
+	expired["exp"] = now.Add(-2 * TokenLeeway).Unix()
+	notYetValid["nbf"] = now.Add(2 * TokenLeeway).Unix()
+	otherAudience["aud"] = "arrebol-cli"
+	delete(noExpiration, "exp")
+	delete(noQueue, "QueueId")
+
+	unknownKey := jwt.NewWithClaims(jwt.SigningMethodES256, valid())
+	unknownKey.Header["kid"] = "server-key-2"
+	unknownKeyToken, _ := unknownKey.SignedString(privateKey)
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	rsaToken, _ := jwt.NewWithClaims(jwt.SigningMethodRS256, valid()).SignedString(rsaKey)
+	noneToken, _ := jwt.NewWithClaims(jwt.SigningMethodNone, valid()).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	hmacToken, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, valid()).SignedString([]byte("secret"))
+
+	tokens := map[string]string{
+		"expired":         signToken(t, privateKey, expired),
+		"not yet valid":   signToken(t, privateKey, notYetValid),
+		"other audience":  signToken(t, privateKey, otherAudience),
+		"no expiration":   signToken(t, privateKey, noExpiration),
+		"no queue":        signToken(t, privateKey, noQueue),
+		"unknown key":     unknownKeyToken,
+		"untrusted key":   rsaToken,
+		"none algorithm":  noneToken,
+		"hmac algorithm":  hmacToken,
+		"tampered claims": strings.Replace(signToken(t, privateKey, valid()), ".", ".e30", 1),
+		"malformed":       "not-a-token",
+	}
+
+	for name, token := range tokens {
+		//exercise
+		claims, err := verifier.Verify(token)
+
+		//verification
+		if err == nil || claims != nil {
+			t.Errorf("The %s token must be refused", name)
+		}
+	}
+}
+
+func TestTokenVerifier_VerifyAlgorithmNotAllowed(t *testing.T) {
+	//setup
+	jwksURL, privateKey, closeServer := jwksServer(t)
+	defer closeServer()
+
+	verifier := NewTokenVerifier(utils.NewKeySet(utils.KeySetConfig{URL: jwksURL}), []string{"RS256"}, "")
+	token := signToken(t, privateKey, jwt.MapClaims{"QueueId": 932, "exp": time.Now().Add(time.Hour).Unix()})
+
+	//exercise
+	_, err := verifier.Verify(token)
+
+	//verification
+	if err == nil {
+		t.Error("The token signed in an algorithm out of the allowlist must be refused")
+	}
+}
+
+func TestTokenVerifier_VerifyPinnedKeys(t *testing.T) {
+	//setup
+	jwksURL, privateKey, closeServer := jwksServer(t)
+	defer closeServer()
+
+	pin, _ := utils.KeyPin(&privateKey.PublicKey)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherPin, _ := utils.KeyPin(&otherKey.PublicKey)
+	token := signToken(t, privateKey, jwt.MapClaims{"QueueId": 932, "exp": time.Now().Add(time.Hour).Unix()})
+
+	pinned := NewTokenVerifier(utils.NewKeySet(utils.KeySetConfig{URL: jwksURL, Pins: []string{pin}}), DefaultTokenAlgorithms, "")
+	unpinned := NewTokenVerifier(utils.NewKeySet(utils.KeySetConfig{URL: jwksURL, Pins: []string{otherPin}}), DefaultTokenAlgorithms, "")
+
+	//exercise
+	_, pinnedErr := pinned.Verify(token)
+	_, unpinnedErr := unpinned.Verify(token)
+
+	//verification
+	if pinnedErr != nil {
+		t.Errorf("The token signed by a pinned key must be accepted, got [%v]", pinnedErr)
+	}
+
+	if unpinnedErr == nil {
+		t.Error("The token signed by a key that is not pinned must be refused")
+	}
+}
+
+func TestTokenVerifierFromEnv(t *testing.T) {
+	//setup
+	previous := os.Getenv(ServerTokenAlgorithmsKey)
+	defer os.Setenv(ServerTokenAlgorithmsKey, previous)
+
+	cases := map[string]bool{
+		"":              true,
+		"RS256, ES256":  true,
+		"PS512":         true,
+		"HS256":         false,
+		"none":          false,
+		"RS256,unknown": false,
+	}
+
+	for algorithms, valid := range cases {
+		os.Setenv(ServerTokenAlgorithmsKey, algorithms)
+
+		//exercise
+		verifier, err := TokenVerifierFromEnv()
+
+		//verification
+		if valid && (err != nil || verifier == nil) {
+			t.Errorf("The algorithms [%s] must be allowed, got [%v]", algorithms, err)
+		}
+
+		if !valid && err == nil {
+			t.Errorf("The algorithms [%s] must not be allowed", algorithms)
+		}
+	}
+}
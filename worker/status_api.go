@@ -0,0 +1,134 @@
+package worker
+
+//This module implements the local status API of the worker, which tells the operators
+//what the worker is doing without reading its logs. It has the liveness and readiness
+//probes, and the current status, as JSON, with the join, the last server contact,
+//the docker daemon reachability and the task each slot is running.
+//The status is read under the locks of the worker and of the executors, so the API
+//can be queried while the tasks run.
+
+import (
+	"encoding/json"
+	"github.com/ufcg-lsd/arrebol-pb-worker/utils"
+	"net/http"
+	"time"
+)
+
+const (
+	StatusAddressKey = "STATUS_ADDRESS"
+
+	LivenessPath  = "/healthz"
+	ReadinessPath = "/readyz"
+	StatusPath    = "/status"
+)
+
+//This struct represents the current status of the worker.
+type WorkerStatus struct {
+	WorkerId string
+	//Whether the server has assigned a token to the worker
+	Joined  bool
+	QueueId uint
+	//When the server has answered a request for the last time, if it has
+	LastServerContact *time.Time `json:",omitempty"`
+	//Whether the docker daemon has answered the last ping of the monitor
+	DockerReachable bool
+	Slots           []SlotStatus
+}
+
+//This struct represents the task a slot is running, if it is running one.
+type SlotStatus struct {
+	Id          int
+	TaskId      string `json:",omitempty"`
+	State       string `json:",omitempty"`
+	Progress    int
+	ContainerId string `json:",omitempty"`
+}
+
+//It returns the current status of the worker and of the scheduler slots.
+//The docker daemon reachability is the one the monitor has found, read through the
+//executor of the first slot, since the slots share the docker client. The daemon isn't
+//pinged here, since a failed ping would make the worker reconnect and stop fetching tasks.
+func (w *Worker) Status(scheduler *Scheduler) WorkerStatus {
+	token, queueId := w.credentials()
+	status := WorkerStatus{
+		WorkerId: w.Id,
+		Joined:   token != "",
+		QueueId:  queueId,
+		Slots:    make([]SlotStatus, 0),
+	}
+
+	if contact := utils.LastServerContact(); !contact.IsZero() {
+		status.LastServerContact = &contact
+	}
+
+	slots := scheduler.Slots()
+
+	for _, slot := range slots {
+		status.Slots = append(status.Slots, slot.Status())
+	}
+
+	if len(slots) > 0 {
+		status.DockerReachable = slots[0].Executor.Docker.Reachable()
+	}
+
+	return status
+}
+
+//It returns the status of the task the slot is running, if it is running one.
+func (s *Slot) Status() SlotStatus {
+	e := s.Executor
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	status := SlotStatus{Id: s.Id}
+
+	if e.taskId != "" {
+		status.TaskId = e.taskId
+		status.State = e.state.String()
+		status.Progress = e.progress
+		status.ContainerId = e.Cid
+	}
+
+	return status
+}
+
+//It returns the handler of the status API, whose endpoints are:
+//LivenessPath - it answers 200 as long as the worker is running
+//ReadinessPath - it answers 200 if the worker has joined the server and the
+//docker daemon is reachable, and 503 otherwise
+//StatusPath - it answers the current status as JSON
+func NewStatusHandler(w *Worker, scheduler *Scheduler) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc(LivenessPath, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("ok\n"))
+	})
+
+	mux.HandleFunc(ReadinessPath, func(rw http.ResponseWriter, r *http.Request) {
+		status := w.Status(scheduler)
+
+		switch {
+		case !status.Joined:
+			http.Error(rw, "The worker hasn't joined the server", http.StatusServiceUnavailable)
+		case !status.DockerReachable:
+			http.Error(rw, "The docker daemon is unreachable", http.StatusServiceUnavailable)
+		default:
+			rw.Write([]byte("ok\n"))
+		}
+	})
+
+	mux.HandleFunc(StatusPath, func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(rw, "Only GET is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(rw).Encode(w.Status(scheduler)); err != nil {
+			w.logger().WithError(err).Warn("Error on writing the status")
+		}
+	})
+
+	return mux
+}
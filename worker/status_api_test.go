@@ -0,0 +1,125 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/ufcg-lsd/arrebol-pb-worker/utils"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+//It returns a scheduler with a single slot, whose executor runs the tasks in a fake docker daemon.
+//The daemon is unreachable if it is not available. It is pinged once, as the monitor does.
+func statusTestScheduler(t *testing.T, available bool) (*Scheduler, func()) {
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+
+	docker, err := utils.NewDockerClient(utils.DockerConfig{Host: strings.TrimPrefix(daemon.URL, "http://")})
+
+	if err != nil {
+		daemon.Close()
+		t.Fatalf("Error on creating the docker client: %v", err)
+	}
+
+	if !available {
+		daemon.Close()
+	}
+
+	docker.Ping(context.Background())
+	slot := &Slot{Id: 0, Executor: &TaskExecutor{Docker: docker}}
+	return &Scheduler{all: []*Slot{slot}}, daemon.Close
+}
+
+func TestStatusHandler_Status(t *testing.T) {
+	//setup
+	w := &Worker{Id: "1023", Token: "test-token", QueueId: 932}
+	scheduler, closeDaemon := statusTestScheduler(t, true)
+	defer closeDaemon()
+
+	executor := scheduler.Slots()[0].Executor
+	executor.setTask("t-1")
+	executor.setProgress(50)
+	executor.setContainerId("c-1")
+
+	//exercise
+	recorder := httptest.NewRecorder()
+	NewStatusHandler(w, scheduler).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, StatusPath, nil))
+
+	//verification
+	var status WorkerStatus
+
+	if err := json.Unmarshal(recorder.Body.Bytes(), &status); err != nil {
+		t.Fatalf("The status must be JSON, got [%s]", recorder.Body.String())
+	}
+
+	if !status.Joined || status.QueueId != 932 || !status.DockerReachable {
+		t.Errorf("The worker must be joined to the queue 932 and reach the docker daemon, got %+v", status)
+	}
+
+	expected := SlotStatus{Id: 0, TaskId: "t-1", State: "TaskRunning", Progress: 50, ContainerId: "c-1"}
+
+	if len(status.Slots) != 1 || status.Slots[0] != expected {
+		t.Errorf("The slot must be running the task %+v, got %+v", expected, status.Slots)
+	}
+
+	//the slot is idle once the task ends
+	executor.setTask("")
+
+	if slotStatus := scheduler.Slots()[0].Status(); slotStatus != (SlotStatus{Id: 0}) {
+		t.Errorf("The slot must be idle, got %+v", slotStatus)
+	}
+}
+
+func TestStatusHandler_Readiness(t *testing.T) {
+	//setup
+	cases := []struct {
+		token     string
+		available bool
+		expected  int
+	}{
+		{"test-token", true, http.StatusOK},
+		{"", true, http.StatusServiceUnavailable},
+		{"test-token", false, http.StatusServiceUnavailable},
+	}
+
+	for _, c := range cases {
+		scheduler, closeDaemon := statusTestScheduler(t, c.available)
+		handler := NewStatusHandler(&Worker{Id: "1023", Token: c.token, QueueId: 932}, scheduler)
+
+		//exercise
+		readiness := httptest.NewRecorder()
+		handler.ServeHTTP(readiness, httptest.NewRequest(http.MethodGet, ReadinessPath, nil))
+		liveness := httptest.NewRecorder()
+		handler.ServeHTTP(liveness, httptest.NewRequest(http.MethodGet, LivenessPath, nil))
+		closeDaemon()
+
+		//verification
+		if readiness.Code != c.expected {
+			t.Errorf("The readiness of a worker with token [%s] and docker available [%t] must be %d, got %d", c.token, c.available, c.expected, readiness.Code)
+		}
+
+		if liveness.Code != http.StatusOK {
+			t.Errorf("The worker must be alive, got %d", liveness.Code)
+		}
+	}
+}
+
+func TestStatusHandler_StatusDoesNotPing(t *testing.T) {
+	//setup
+	w := &Worker{Id: "1023", Token: "test-token", QueueId: 932}
+	scheduler, closeDaemon := statusTestScheduler(t, true)
+	docker := scheduler.Slots()[0].Executor.Docker
+	previous := docker.Client()
+	closeDaemon()
+
+	//exercise
+	status := w.Status(scheduler)
+
+	//verification
+	if !status.DockerReachable || !docker.Reachable() || docker.Client() != previous {
+		t.Error("The status must report the last ping of the monitor, without pinging the daemon and reconnecting")
+	}
+}
@@ -1,102 +1,402 @@
 package worker
 
 //This module implements all steps needed in the task execution, as follows:
-//Init a container, which includes download the task's image; create and start the container;
+//Init a container, which includes download the task's image; create and start the container
+//with the allowed mounts the task requests and its environment;
+//deliver the task's secrets;
 //move the executor script to the work dir inside the container.
+//Stage the task's input files into the container.
 //Send the task commands as a file to the container
 //Execute the task, which includes invoking the executor script passing the commands file as
 //arg and keep tracking of the exit codes of each commands.
 //Track the execution, by retrieving how many commands have already been executed.
+//Collect the task's output files, before the container is removed.
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/client"
+	"github.com/docker/go-units"
 	"github.com/ufcg-lsd/arrebol-pb-worker/utils"
-	"log"
+	"io"
+	"io/ioutil"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 const (
 	TaskScriptExecutorFileName  = "task-script-executor.sh"
 	RunTaskScriptCommandPattern = "/bin/bash %s -d -tsf=%s"
+	FailFastFlag                = " --fail-fast"
 	DefaultWorkerDockerImage    = "ubuntu"
+	//(Bytes) of each file the task script executor writes the results in
+	TaskResultsFileMaxSize = 1024 * 1024
+)
+
+const (
+	//The CFS period (in microseconds) over which the CPU quota is enforced
+	CPUPeriod = 100000
 )
 
 type TaskExecutor struct {
-	Cli client.Client
-	Cid string
+	//The docker client shared by the slots
+	Docker *utils.DockerClient
+	Cid    string
+	//The resources the task containers are limited to
+	Limits ResourceLimits
+	//The mounts the tasks are allowed to request
+	Mounts []MountConfig
+	//It resolves the secrets the tasks reference
+	ResolveSecret SecretResolver
+	//It downloads the task inputs before they are staged into the container
+	FetchInput InputFetcher
+	//It logs the entries of the running task. The container id is added to its fields.
+	Logger *utils.Logger
+	//It guards the Cid, which is set by Execute while the task is tracked or aborted,
+	//and the running task's status, which is set by the worker while it is queried
+	lock sync.Mutex
+	//The id, state and progress of the task the executor is running, if there is one
+	taskId   string
+	state    TaskState
+	progress int
+}
+
+//It represents the resources a task container is limited to.
+//Zero values mean no limit.
+type ResourceLimits struct {
+	Vcpu float32
+	//(MegaBytes)
+	Ram       uint32
+	PidsLimit int64
+	//The maximum number of files a process can open
+	MaxOpenFiles int64
+}
+
+//It returns the limits of the task's container. The task can request less
+//Vcpu and Ram than the executor's limits, but never more.
+func (l ResourceLimits) forTask(task *Task) ResourceLimits {
+	limits := l
+
+	if task.Vcpu > 0 && (limits.Vcpu == 0 || task.Vcpu < limits.Vcpu) {
+		limits.Vcpu = task.Vcpu
+	}
+
+	if task.Ram > 0 && (limits.Ram == 0 || task.Ram < limits.Ram) {
+		limits.Ram = task.Ram
+	}
+
+	return limits
 }
 
-func (e *TaskExecutor) Execute(task *Task, statesChanges chan<- TaskState) {
+//It sets the limits in the container configuration. The swap is
+//not available to the container, so its memory swap equals its memory.
+func (l ResourceLimits) apply(config *utils.ContainerConfig) {
+	if l.Vcpu > 0 {
+		config.CPUPeriod = CPUPeriod
+		config.CPUQuota = int64(l.Vcpu * CPUPeriod)
+	}
+
+	if l.Ram > 0 {
+		config.Memory = int64(l.Ram) * 1024 * 1024
+		config.MemorySwap = config.Memory
+	}
+
+	config.PidsLimit = l.PidsLimit
+
+	if l.MaxOpenFiles > 0 {
+		config.Ulimits = []*units.Ulimit{{Name: "nofile", Soft: l.MaxOpenFiles, Hard: l.MaxOpenFiles}}
+	}
+}
+
+//It runs the task in a new container, sending its outcome through the channel.
+//If the context is done before the task finishes, the container is killed and
+//removed, and the final state is either TaskTimedOut or TaskCanceled, depending
+//on the context error.
+func (e *TaskExecutor) Execute(ctx context.Context, task *Task, outcomes chan<- TaskOutcome) {
 	image := task.DockerImage
 
-	log.Println("Creating container with image: " + image)
+	e.logger().With("image", image).Info("Creating task container")
 	containerName := task.Id + "-" + strconv.Itoa(time.Now().Second())
+	e.setContainerId("")
+
+	if err := validateCommands(task.Commands); err != nil {
+		outcome := e.fail(ctx, task, err)
+		outcome.Cause = CauseInvalidCommands
+		outcomes <- outcome
+		return
+	}
+
+	mounts, err := e.mountsFor(task)
+
+	if err != nil {
+		outcome := e.fail(ctx, task, err)
+		outcome.Cause = CauseMountRefused
+		outcomes <- outcome
+		return
+	}
+
+	env, secretFiles, err := e.resolveSecrets(task)
+
+	if err != nil {
+		outcome := e.fail(ctx, task, err)
+		outcome.Cause = CauseSecretsFailed
+		outcomes <- outcome
+		return
+	}
+
+	if len(secretFiles) > 0 {
+		mounts = append(mounts, secretsMount())
+	}
 
 	config := utils.ContainerConfig{
 		Name:   containerName,
 		Image:  image,
-		Mounts: []mount.Mount{},
+		Mounts: mounts,
+		Env:    env,
 	}
+	e.Limits.forTask(task).apply(&config)
 
 	if err := e.init(config); err != nil {
-		log.Println(err)
-		statesChanges <- TaskFailed
+		outcomes <- e.fail(ctx, task, err)
+		return
+	}
+	if err := e.deliverSecretFiles(ctx, secretFiles); err != nil {
+		outcome := e.fail(ctx, task, err)
+
+		if outcome.State == TaskFailed {
+			outcome.Cause = CauseSecretsFailed
+		}
+
+		outcomes <- outcome
+		return
+	}
+	if err := e.stage(task); err != nil {
+		outcome := e.fail(ctx, task, err)
+
+		if outcome.State == TaskFailed {
+			outcome.Cause = CauseStagingFailed
+		}
+
+		outcomes <- outcome
 		return
 	}
 	if err := e.send(task); err != nil {
-		log.Println(err)
-		statesChanges <- TaskFailed
+		outcomes <- e.fail(ctx, task, err)
 		return
 	}
-	if err := e.run(task.Id); err != nil {
-		log.Println(err)
-		statesChanges <- TaskFailed
+	if err := e.run(ctx, task); err != nil {
+		outcomes <- e.fail(ctx, task, err)
 		return
 	}
-	utils.StopContainer(&e.Cli, e.Cid)
-	utils.RemoveContainer(&e.Cli, e.Cid)
-	statesChanges <- TaskFinished
+	results := e.getCommandResults(task)
+	outcome := task.failurePolicy().decide(results)
+
+	if e.oomKilled() {
+		outcome = TaskOutcome{State: TaskFailed, Cause: CauseOOMKilled}
+	}
+
+	if task.executionMode() == ModeFailFast {
+		results, outcome.FailedCommand = skipAfterFailure(task.Commands, results)
+	}
+
+	outputs, err := e.collectOutputs(ctx, task)
+
+	if err != nil {
+		e.logger().WithError(err).Error("Error on collecting the task outputs")
+
+		if outcome.State != TaskFailed {
+			outcome.State, outcome.Cause = TaskFailed, CauseOutputsFailed
+		}
+	}
+
+	outcome.Results = results
+	outcome.Outputs = outputs
+	outcome.Logs = e.collectLogs()
+
+	if err := e.removeContainer(false); err != nil {
+		e.logger().WithError(err).Error("Error on removing the task's container")
+	}
+
+	outcomes <- outcome
+}
+
+//It returns the outcome of a task whose execution has been broken by the error.
+//The results and logs produced until then are collected, and then the container
+//is removed, being killed if the context is done, or stopped otherwise.
+func (e *TaskExecutor) fail(ctx context.Context, task *Task, err error) TaskOutcome {
+	e.logger().WithError(err).Error("The task execution has been broken")
+	outcome := TaskOutcome{State: TaskFailed, Results: e.getCommandResults(task), Logs: e.collectLogs()}
+
+	switch {
+	case ctx.Err() == nil:
+		if e.oomKilled() {
+			outcome.Cause = CauseOOMKilled
+		}
+	case ctx.Err() == context.DeadlineExceeded:
+		outcome.State = TaskTimedOut
+	default:
+		outcome.State = TaskCanceled
+	}
+
+	if err := e.removeContainer(ctx.Err() != nil); err != nil {
+		e.logger().WithError(err).Error("Error on removing the task's container")
+	}
+
+	return outcome
+}
+
+//It checks if the task's container has run out of memory.
+func (e *TaskExecutor) oomKilled() bool {
+	cid := e.containerId()
+
+	if cid == "" {
+		return false
+	}
+
+	killed, err := utils.IsOOMKilled(e.cli(), cid)
+
+	if err != nil {
+		e.logger().WithError(err).Error("Error on inspecting the task's container")
+	}
+
+	return killed
+}
+
+//It stops and removes the task's container, if it has been created.
+//The container is killed instead of stopped if force is set.
+//It returns an error if the container couldn't be removed.
+func (e *TaskExecutor) removeContainer(force bool) error {
+	cid := e.containerId()
+
+	if cid == "" {
+		return nil
+	}
+
+	stop := utils.StopContainer
+
+	if force {
+		stop = utils.KillContainer
+	}
+
+	//the container may not be running, e.g if it has failed to start
+	if err := stop(e.cli(), cid); err != nil {
+		e.logger().WithError(err).Warn("Error on stopping the task's container")
+	}
+
+	return utils.RemoveContainer(e.cli(), cid)
+}
+
+//It returns the executor's logger, whose entries carry the container id once the container is started.
+func (e *TaskExecutor) logger() *utils.Logger {
+	logger := e.Logger
+
+	if logger == nil {
+		logger = utils.Log()
+	}
+
+	if cid := e.containerId(); cid != "" {
+		logger = logger.With(utils.ContainerIdField, cid)
+	}
+
+	return logger
+}
+
+func (e *TaskExecutor) cli() *client.Client {
+	return e.Docker.Client()
+}
+
+func (e *TaskExecutor) containerId() string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.Cid
+}
+
+func (e *TaskExecutor) setContainerId(cid string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.Cid = cid
+}
+
+//It records the task the executor is running, so its status can be queried while it runs.
+//An empty id means the executor is idle.
+func (e *TaskExecutor) setTask(taskId string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.taskId, e.progress = taskId, 0
+
+	if taskId == "" {
+		e.state = TaskPending
+	} else {
+		e.state = TaskRunning
+	}
+}
+
+func (e *TaskExecutor) setProgress(progress int) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.progress = progress
 }
 
 func (e *TaskExecutor) init(config utils.ContainerConfig) error {
-	exists, err := utils.CheckImage(&e.Cli, config.Image)
+	exists, err := utils.CheckImage(e.cli(), config.Image)
 	if !exists {
-		if _, err = utils.Pull(&e.Cli, config.Image); err != nil {
+		if err = e.pull(config.Image); err != nil {
 			return err
 		}
 	}
-	cid, err := utils.CreateContainer(&e.Cli, config)
+	cid, err := utils.CreateContainer(e.cli(), config)
 
 	if err != nil {
 		return err
 	}
-	err = utils.StartContainer(&e.Cli, cid)
+
+	//the container is known as soon as it exists, so it is removed if the task fails from now on
+	e.setContainerId(cid)
+	err = utils.StartContainer(e.cli(), cid)
 
 	if err != nil {
 		return err
 	}
 
-	err = utils.Exec(&e.Cli, cid, "mkdir /arrebol")
+	err = utils.Exec(e.cli(), cid, "mkdir /arrebol")
 
 	if err != nil {
-		log.Println("Error on creating /arrebol folder")
+		e.logger().WithError(err).Error("Error on creating /arrebol folder")
 		return err
 	}
 
 	taskScriptExecutorPath := os.Getenv("BIN_PATH") + "/" + TaskScriptExecutorFileName
+	err = utils.Copy(e.cli(), cid, taskScriptExecutorPath, "/arrebol/"+TaskScriptExecutorFileName)
 
-	err = utils.Copy(&e.Cli, cid, taskScriptExecutorPath, "/arrebol/"+TaskScriptExecutorFileName)
-
-	e.Cid = cid
 	return err
 }
 
+//It pulls the image, observing the pull time.
+//The pull progress is read until its end, which is when the image is ready.
+func (e *TaskExecutor) pull(image string) error {
+	e.logger().With("image", image).Info("Pulling image")
+	start := time.Now()
+	progress, err := utils.Pull(e.cli(), image)
+
+	if err != nil {
+		return err
+	}
+
+	defer progress.Close()
+
+	if _, err := io.Copy(ioutil.Discard, progress); err != nil {
+		return err
+	}
+
+	imagePullDuration.Observe(time.Since(start).Seconds())
+	return nil
+}
+
 //It sends the task's commands to a file
 //inside the container.
 //Params:
@@ -107,14 +407,24 @@ func (e *TaskExecutor) init(config utils.ContainerConfig) error {
 func (e *TaskExecutor) send(task *Task) error {
 	taskScriptFileName := "task-id.ts"
 	rawCmdsStr := task.Commands
-	err := utils.Write(&e.Cli, e.Cid, rawCmdsStr, "/arrebol/"+taskScriptFileName)
+	err := utils.Write(e.cli(), e.containerId(), rawCmdsStr, "/arrebol/"+taskScriptFileName)
 	return err
 }
 
-func (e *TaskExecutor) run(taskId string) error {
+//It invokes the executor script in the task's execution mode and waits until it finishes.
+//It returns:
+//1. the context error, if the context is done before that
+//2. an error if the script couldn't be invoked
+//3. nil otherwise
+func (e *TaskExecutor) run(ctx context.Context, task *Task) error {
 	taskScriptFilePath := "/arrebol/task-id.ts"
 	cmd := fmt.Sprintf(RunTaskScriptCommandPattern, "/arrebol/"+TaskScriptExecutorFileName, taskScriptFilePath)
-	err := utils.Exec(&e.Cli, e.Cid, cmd)
+
+	if task.executionMode() == ModeFailFast {
+		cmd += FailFastFlag
+	}
+
+	_, err := utils.ExecWait(ctx, e.cli(), e.containerId(), cmd)
 	return err
 }
 
@@ -124,43 +434,71 @@ func (e *TaskExecutor) run(taskId string) error {
 //1. 0 and an error, if it couldn't access the .ec file in the container
 //2. The amount of executed commands and nil.
 func (e *TaskExecutor) Track() (int, error) {
-	err := utils.Exec(&e.Cli, e.Cid, "touch /arrebol/task-id.ts.ec")
+	cid := e.containerId()
+
+	if cid == "" {
+		return 0, errors.New("The task's container has not been started yet")
+	}
+
+	err := utils.Exec(e.cli(), cid, "touch /arrebol/task-id.ts.ec")
 
 	if err != nil {
-		log.Println(err)
+		e.logger().WithError(err).Warn("Error on touching the exit codes file")
 	}
 
 	ec, err := e.getExitCodes()
 
 	if err != nil {
-		log.Println(err)
+		e.logger().WithError(err).Warn("Error on tracking the task")
 		return 0, err
 	}
 
 	return len(ec), nil
 }
 
-func (e *TaskExecutor) getExitCodes() ([]int8, error) {
+//It returns the results of the commands executed so far.
+//It returns nil if the results couldn't be read.
+func (e *TaskExecutor) getCommandResults(task *Task) []CommandResult {
+	if e.containerId() == "" {
+		return nil
+	}
+
+	exitCodes, err := e.getExitCodes()
+
+	if err != nil {
+		e.logger().WithError(err).Error("Error on reading the exit codes")
+		return nil
+	}
+
+	times, err := utils.Read(e.cli(), e.containerId(), "/arrebol/task-id.ts.times", TaskResultsFileMaxSize)
+
+	if err != nil {
+		e.logger().WithError(err).Warn("Error on reading the commands times")
+	}
+
+	return buildCommandResults(task.Commands, exitCodes, string(bytes.Trim(times, "\x00")))
+}
+
+func (e *TaskExecutor) getExitCodes() ([]int, error) {
 	ecFilePath := "/arrebol/task-id" + ".ts.ec"
-	dat, err := utils.Read(&e.Cli, e.Cid, ecFilePath)
+	dat, err := utils.Read(e.cli(), e.containerId(), ecFilePath, TaskResultsFileMaxSize)
 	if err != nil {
 		return nil, err
 	}
 	dat = bytes.TrimFunc(dat, isNotUTFNumber)
 	content := string(dat[:])
-	log.Println("Content: " + content)
-	exitCodesStr := strings.Split(content, "\r\n")
-	log.Println("ExitCodes String Array: ", exitCodesStr)
+	exitCodesStr := strings.Fields(content)
+	e.logger().With("exit_codes", strings.Join(exitCodesStr, ",")).Debug("Exit codes read")
 	exitCodes := toIntArray(exitCodesStr)
 	return exitCodes, nil
 }
 
-func toIntArray(strs []string) []int8 {
-	ints := make([]int8, 0)
+func toIntArray(strs []string) []int {
+	ints := make([]int, 0)
 	for _, s := range strs {
 		x, err := strconv.Atoi(s)
 		if err == nil {
-			ints = append(ints, int8(x))
+			ints = append(ints, x)
 		}
 	}
 	return ints
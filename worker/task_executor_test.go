@@ -0,0 +1,196 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/ufcg-lsd/arrebol-pb-worker/utils"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestResourceLimits_ForTask(t *testing.T) {
+	//setup
+	limits := ResourceLimits{Vcpu: 2, Ram: 1024, PidsLimit: 100}
+
+	//exercise
+	requested := limits.forTask(&Task{Vcpu: 1, Ram: 512})
+	exceeding := limits.forTask(&Task{Vcpu: 4, Ram: 4096})
+	unset := limits.forTask(&Task{})
+
+	//verification
+	if requested.Vcpu != 1 || requested.Ram != 512 {
+		t.Errorf("The task requests must be used when they fit in the limits")
+	}
+
+	if exceeding.Vcpu != 2 || exceeding.Ram != 1024 {
+		t.Errorf("The task requests must be capped by the limits")
+	}
+
+	if unset != limits {
+		t.Errorf("The limits must be used when the task requests nothing")
+	}
+}
+
+func TestResourceLimits_Apply(t *testing.T) {
+	//setup
+	limits := ResourceLimits{Vcpu: 1.5, Ram: 256, PidsLimit: 100, MaxOpenFiles: 1024}
+	config := utils.ContainerConfig{Name: "test", Image: DefaultWorkerDockerImage}
+
+	//exercise
+	limits.apply(&config)
+
+	//verification
+	if config.CPUPeriod != CPUPeriod || config.CPUQuota != 150000 {
+		t.Errorf("The CPU quota is not the expected one: %d/%d", config.CPUQuota, config.CPUPeriod)
+	}
+
+	if config.Memory != 256*1024*1024 || config.MemorySwap != config.Memory {
+		t.Errorf("The memory limits are not the expected ones: %d, %d", config.Memory, config.MemorySwap)
+	}
+
+	if config.PidsLimit != 100 {
+		t.Errorf("The pids limit is not the expected one")
+	}
+
+	if len(config.Ulimits) != 1 || config.Ulimits[0].Name != "nofile" || config.Ulimits[0].Hard != 1024 {
+		t.Errorf("The open files ulimit is not the expected one")
+	}
+}
+
+func TestResourceLimits_ApplyWithoutLimits(t *testing.T) {
+	//setup
+	config := utils.ContainerConfig{Name: "test", Image: DefaultWorkerDockerImage}
+
+	//exercise
+	ResourceLimits{}.apply(&config)
+
+	//verification
+	if config.CPUQuota != 0 || config.Memory != 0 || config.MemorySwap != 0 || config.Ulimits != nil {
+		t.Errorf("No limit must be set")
+	}
+}
+
+func TestTaskExecutor_FailDoesNotLogSecrets(t *testing.T) {
+	//setup
+	var out bytes.Buffer
+	utils.SetLogOutput(&out)
+	defer utils.SetLogOutput(os.Stderr)
+
+	utils.ConfigureRedaction(utils.RedactionConfig{Values: []string{"s3cr3t-dataset"}})
+
+	executor := &TaskExecutor{
+		FetchInput: func(input TaskInput) (io.ReadCloser, error) {
+			return nil, utils.NewRequestError(utils.ErrUnauthorized, input.Source, nil)
+		},
+	}
+	task := &Task{
+		Id:       "1",
+		Commands: []string{"wget --password s3cr3t-wget http://data"},
+		Inputs:   []TaskInput{{Source: "http://data/a.csv?token=s3cr3t-token", Destination: "/data/s3cr3t-dataset.csv"}},
+	}
+
+	//exercise
+	err := executor.stage(task)
+	outcome := executor.fail(context.Background(), task, err)
+
+	//verification
+	if outcome.State != TaskFailed {
+		t.Errorf("The task must fail")
+	}
+
+	for _, secret := range []string{"s3cr3t-token", "s3cr3t-dataset"} {
+		if strings.Contains(out.String(), secret) {
+			t.Errorf("The secret [%s] must not be logged, got [%s]", secret, out.String())
+		}
+	}
+
+	if strings.Contains(task.redacted().Commands[0], "s3cr3t-wget") {
+		t.Errorf("The reported commands must not contain the secret")
+	}
+}
+
+func TestTaskExecutor_Logger(t *testing.T) {
+	//setup
+	var out bytes.Buffer
+	utils.SetLogOutput(&out)
+	defer utils.SetLogOutput(os.Stderr)
+
+	executor := &TaskExecutor{Logger: workerTestInstance.logger().With(utils.TaskIdField, "t-1")}
+	executor.setContainerId("c-1")
+
+	//exercise
+	executor.logger().Info("Task entry")
+
+	//verification
+	for _, field := range []string{"worker_id=1023", "queue_id=", "task_id=t-1", "container_id=c-1"} {
+		if !strings.Contains(out.String(), field) {
+			t.Errorf("The entry [%s] must carry the field [%s]", out.String(), field)
+		}
+	}
+}
+
+//It returns an executor whose container runs in a fake docker daemon, which records the requests
+//it receives. The daemon only stops, kills and removes containers, failing any other request.
+func recordingDaemon(t *testing.T) (*TaskExecutor, *[]string, func()) {
+	var lock sync.Mutex
+	requests := make([]string, 0)
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		lock.Unlock()
+
+		if r.Method == http.MethodDelete || strings.HasSuffix(r.URL.Path, "/stop") || strings.HasSuffix(r.URL.Path, "/kill") {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		w.WriteHeader(http.StatusNotFound)
+	}))
+
+	docker, err := utils.NewDockerClient(utils.DockerConfig{Host: strings.TrimPrefix(daemon.URL, "http://")})
+
+	if err != nil {
+		daemon.Close()
+		t.Fatalf("Error on creating the docker client: %v", err)
+	}
+
+	return &TaskExecutor{Docker: docker}, &requests, daemon.Close
+}
+
+func TestTaskExecutor_FailRemovesContainer(t *testing.T) {
+	//setup
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	cases := map[context.Context]string{
+		context.Background(): "/containers/c-1/stop",
+		canceled:             "/containers/c-1/kill",
+	}
+
+	for ctx, stop := range cases {
+		executor, requests, closeDaemon := recordingDaemon(t)
+		executor.setContainerId("c-1")
+
+		//exercise
+		executor.fail(ctx, &Task{Id: "1", Commands: []string{"true"}}, errors.New("staging failed"))
+		closeDaemon()
+
+		//verification
+		stopped, removed := false, false
+
+		for _, request := range *requests {
+			stopped = stopped || (strings.HasPrefix(request, "POST ") && strings.HasSuffix(request, stop))
+			removed = removed || (strings.HasPrefix(request, "DELETE ") && strings.HasSuffix(request, "/containers/c-1"))
+		}
+
+		if !stopped || !removed {
+			t.Errorf("The container must be stopped (%s) and removed, got %v", stop, *requests)
+		}
+	}
+}
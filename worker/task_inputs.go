@@ -0,0 +1,206 @@
+package worker
+
+//This module implements the staging of the task inputs, which are the files the
+//task needs before its commands run. Each input is downloaded from its source URL,
+//or from the server when it is an artifact hosted there, into a temp file of the
+//worker host, has its checksum verified and is then copied to its destination inside
+//the task's container, so the inputs are never held in memory.
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/ufcg-lsd/arrebol-pb-worker/utils"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const (
+	InputFileMode = 0644
+
+	TaskInputsMaxSizeKey = "TASK_INPUTS_MAX_SIZE"
+
+	//(Bytes) of each task input
+	DefaultTaskInputsMaxSize = 1024 * 1024 * 1024
+)
+
+//This struct represents a file staged into the task's container before its commands run.
+type TaskInput struct {
+	// URL from which the file is downloaded
+	Source string
+	// Id of a file hosted in the server. It is used when the Source is empty.
+	ArtifactId string
+	// Absolute path of the file inside the container
+	Destination string
+	// Expected digest of the file content, as <algorithm>:<hex> (e.g sha256:9f86d0...).
+	// The algorithm can be sha256 or sha512; it is sha256 if omitted.
+	Checksum string
+}
+
+//It downloads the content of a task input.
+//It returns the content reader, which the caller must close.
+type InputFetcher func(input TaskInput) (io.ReadCloser, error)
+
+//It returns the fetcher of the task inputs. The sources of the server's origin, such
+//as its artifacts, are downloaded with the worker's token and signature, while the
+//other sources get an unsigned request, so the worker's credentials aren't leaked.
+func (w *Worker) inputFetcher(serverEndPoint string) InputFetcher {
+	return func(input TaskInput) (io.ReadCloser, error) {
+		source := input.Source
+
+		if source == "" {
+			if input.ArtifactId == "" {
+				return nil, errors.New("The input [" + input.Destination + "] has neither a source nor an artifact id")
+			}
+
+			source = serverEndPoint + "/workers/" + w.Id + "/artifacts/" + input.ArtifactId
+		}
+
+		if !sameOrigin(source, serverEndPoint) {
+			return utils.Download("", source, http.Header{})
+		}
+
+		token, _ := w.credentials()
+		header := http.Header{}
+		header.Set("arrebol-worker-token", token)
+		return utils.Download(w.Id, source, header)
+	}
+}
+
+//It checks whether both URLs have the same scheme and host (including the port).
+func sameOrigin(a, b string) bool {
+	first, err := url.Parse(a)
+
+	if err != nil {
+		return false
+	}
+
+	second, err := url.Parse(b)
+
+	if err != nil {
+		return false
+	}
+
+	return strings.EqualFold(first.Scheme, second.Scheme) && strings.EqualFold(first.Host, second.Host)
+}
+
+//It downloads the task inputs, verifies their checksums and writes them into the container.
+//It returns an error as soon as some input fails to be staged.
+func (e *TaskExecutor) stage(task *Task) error {
+	if len(task.Inputs) == 0 {
+		return nil
+	}
+
+	if e.FetchInput == nil {
+		return errors.New("The executor has no input fetcher")
+	}
+
+	limit := utils.Int64FromEnv(TaskInputsMaxSizeKey, DefaultTaskInputsMaxSize)
+
+	for _, input := range task.Inputs {
+		e.logger().With("dest", input.Destination).Info("Staging input")
+
+		if err := e.stageInput(input, limit); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//It downloads the input into a temp file, up to the limit, and copies it into the
+//container once its checksum is verified.
+//It returns:
+//1. an error wrapping utils.ErrSizeLimitExceeded if the input is bigger than the limit
+//2. an error if the input couldn't be downloaded, verified or written
+//3. nil otherwise
+func (e *TaskExecutor) stageInput(input TaskInput, limit int64) error {
+	content, err := e.FetchInput(input)
+
+	if err != nil {
+		return fmt.Errorf("Error on downloading the input [%s]: %w", input.Destination, err)
+	}
+	defer content.Close()
+
+	file, err := ioutil.TempFile("", "arrebol-input")
+
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	size, err := io.Copy(file, io.LimitReader(content, limit+1))
+
+	if err != nil {
+		return fmt.Errorf("Error on downloading the input [%s]: %w", input.Destination, err)
+	}
+
+	if size > limit {
+		return fmt.Errorf("The input [%s] is bigger than %d bytes: %w", input.Destination, limit, utils.ErrSizeLimitExceeded)
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if err := verifyChecksum(file, input.Checksum); err != nil {
+		return fmt.Errorf("Error on verifying the input [%s]: %w", input.Destination, err)
+	}
+
+	if err := file.Chmod(InputFileMode); err != nil {
+		return err
+	}
+
+	if err := utils.Copy(e.cli(), e.containerId(), file.Name(), input.Destination); err != nil {
+		return fmt.Errorf("Error on writing the input [%s]: %w", input.Destination, err)
+	}
+
+	return nil
+}
+
+//It checks the content against the expected checksum, which is skipped if it is empty.
+//It returns:
+//1. an error if the checksum algorithm is unknown, the content couldn't be read or the digests don't match
+//2. nil otherwise
+func verifyChecksum(content io.Reader, checksum string) error {
+	if checksum == "" {
+		return nil
+	}
+
+	algorithm, expected := "sha256", checksum
+
+	if i := strings.Index(checksum, ":"); i >= 0 {
+		algorithm, expected = checksum[:i], checksum[i+1:]
+	}
+
+	var digest hash.Hash
+
+	switch algorithm {
+	case "sha256":
+		digest = sha256.New()
+	case "sha512":
+		digest = sha512.New()
+	default:
+		return errors.New("Unknown checksum algorithm [" + algorithm + "]")
+	}
+
+	if _, err := io.Copy(digest, content); err != nil {
+		return err
+	}
+
+	actual := hex.EncodeToString(digest.Sum(nil))
+
+	if !strings.EqualFold(actual, expected) {
+		return errors.New("The checksum " + algorithm + ":" + actual + " doesn't match the expected one")
+	}
+
+	return nil
+}
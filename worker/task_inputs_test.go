@@ -0,0 +1,163 @@
+package worker
+
+import (
+	"bytes"
+	"errors"
+	"github.com/ufcg-lsd/arrebol-pb-worker/utils"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+const (
+	//sha256 of "arrebol"
+	arrebolChecksum = "sha256:325b39c482d3d66d9f63d855a95102e1a0470fd2de7217683ee74d550bae2060"
+)
+
+func TestVerifyChecksum(t *testing.T) {
+	//setup
+	content := []byte("arrebol")
+	checksums := map[string]bool{
+		"":              true,
+		arrebolChecksum: true,
+		"325b39c482d3d66d9f63d855a95102e1a0470fd2de7217683ee74d550bae2060":        true,
+		"SHA256:325b39c482d3d66d9f63d855a95102e1a0470fd2de7217683ee74d550bae2060": false,
+		"sha256:8ba2ab16d5d3a1ea53f1f2fb3f1d6e1b7c3ac0b2f09e0c7b7a43b8a34fc0a6e4": false,
+		"md5:68b1b4b4b0fb6c4e31b6e2e8b4f1a9a2":                                    false,
+	}
+
+	for checksum, valid := range checksums {
+		//exercise
+		err := verifyChecksum(bytes.NewReader(content), checksum)
+
+		//verification
+		if valid && err != nil {
+			t.Errorf("The checksum [%s] must be valid: %v", checksum, err)
+		}
+
+		if !valid && err == nil {
+			t.Errorf("The checksum [%s] must be invalid", checksum)
+		}
+	}
+}
+
+func TestTaskExecutor_StageWithInvalidChecksum(t *testing.T) {
+	//setup
+	executor := &TaskExecutor{
+		FetchInput: func(input TaskInput) (io.ReadCloser, error) {
+			return ioutil.NopCloser(strings.NewReader("tampered")), nil
+		},
+	}
+	task := &Task{Id: "1", Inputs: []TaskInput{{Source: "http://datasets/a.csv", Destination: "/data/a.csv", Checksum: arrebolChecksum}}}
+
+	//exercise
+	err := executor.stage(task)
+
+	//verification
+	if err == nil {
+		t.Errorf("The tampered input must not be staged")
+	}
+}
+
+func TestTaskExecutor_StageWithUnreachableSource(t *testing.T) {
+	//setup
+	executor := &TaskExecutor{
+		FetchInput: func(input TaskInput) (io.ReadCloser, error) {
+			return nil, utils.NewRequestError(utils.ErrServerUnavailable, input.Source, nil)
+		},
+	}
+	task := &Task{Id: "1", Inputs: []TaskInput{{Source: "http://datasets/a.csv", Destination: "/data/a.csv"}}}
+
+	//exercise
+	err := executor.stage(task)
+
+	//verification
+	if !errors.Is(err, utils.ErrServerUnavailable) {
+		t.Errorf("The download error must be returned, got [%v]", err)
+	}
+}
+
+func TestTaskExecutor_StageTooBigInput(t *testing.T) {
+	//setup
+	previous := os.Getenv(TaskInputsMaxSizeKey)
+	os.Setenv(TaskInputsMaxSizeKey, "4")
+	defer os.Setenv(TaskInputsMaxSizeKey, previous)
+
+	executor := &TaskExecutor{
+		FetchInput: func(input TaskInput) (io.ReadCloser, error) {
+			return ioutil.NopCloser(strings.NewReader("arrebol")), nil
+		},
+	}
+	task := &Task{Id: "1", Inputs: []TaskInput{{Source: "http://datasets/a.csv", Destination: "/data/a.csv"}}}
+
+	//exercise
+	err := executor.stage(task)
+
+	//verification
+	if !errors.Is(err, utils.ErrSizeLimitExceeded) {
+		t.Errorf("The input bigger than the limit must not be staged, got [%v]", err)
+	}
+}
+
+//It starts a mock source of the "arrebol" content, which records the headers it receives.
+func inputSource(t *testing.T) (*httptest.Server, *http.Header) {
+	received := &http.Header{}
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*received = r.Header.Clone()
+		w.Write([]byte("arrebol"))
+	}))
+
+	return source, received
+}
+
+func TestWorker_InputFetcher(t *testing.T) {
+	//setup
+	server, serverHeader := inputSource(t)
+	defer server.Close()
+	thirdParty, thirdPartyHeader := inputSource(t)
+	defer thirdParty.Close()
+
+	previous := utils.DownloadClient
+	utils.DownloadClient = &http.Client{}
+	defer func() {
+		utils.DownloadClient = previous
+	}()
+	utils.GetSignature = func(message []byte, workerId string) ([]byte, string, error) {
+		return []byte("FAKE-SIGNATURE"), utils.AlgorithmRSAPSS, nil
+	}
+
+	fetch := workerTestInstance.inputFetcher(server.URL + "/v1")
+
+	for _, input := range []TaskInput{{ArtifactId: "42", Destination: "/data/a.csv"}, {Source: thirdParty.URL + "/a.csv", Destination: "/data/a.csv"}} {
+		//exercise
+		content, err := fetch(input)
+
+		//verification
+		if err != nil {
+			t.Fatalf("The input must be fetched, got [%v]", err)
+		}
+
+		body, _ := ioutil.ReadAll(content)
+		content.Close()
+
+		if string(body) != "arrebol" {
+			t.Errorf("The input content is not the expected one, got [%s]", body)
+		}
+	}
+
+	if serverHeader.Get("arrebol-worker-token") == "" || serverHeader.Get(utils.SIGNATURE_KEY_PATTERN) == "" {
+		t.Errorf("The artifact must be downloaded with the worker's credentials, got %v", *serverHeader)
+	}
+
+	if thirdPartyHeader.Get("arrebol-worker-token") != "" || thirdPartyHeader.Get(utils.SIGNATURE_KEY_PATTERN) != "" {
+		t.Errorf("The worker's credentials must not be sent to other sources, got %v", *thirdPartyHeader)
+	}
+
+	if _, err := fetch(TaskInput{Destination: "/data/a.csv"}); err == nil {
+		t.Errorf("An input without source must not be fetched")
+	}
+}
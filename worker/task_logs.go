@@ -0,0 +1,164 @@
+package worker
+
+//This module implements the handling of the task logs, which the executor script
+//writes to the .out and .err files inside the container. They are collected before
+//the container is removed, capped at a configurable size, redacted, uploaded to the
+//server and, if a logs path is configured, kept in the worker host for a retention period.
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ufcg-lsd/arrebol-pb-worker/utils"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	TaskLogsMaxSizeKey   = "TASK_LOGS_MAX_SIZE"
+	TaskLogsPathKey      = "TASK_LOGS_PATH"
+	TaskLogsRetentionKey = "TASK_LOGS_RETENTION"
+
+	//(Bytes) per stream
+	DefaultTaskLogsMaxSize   = 1024 * 1024
+	DefaultTaskLogsRetention = 72 * time.Hour
+
+	TaskStdoutFilePath = "/arrebol/task-id.ts.out"
+	TaskStderrFilePath = "/arrebol/task-id.ts.err"
+	LogsTruncatedKey   = "arrebol-logs-truncated"
+)
+
+//This struct represents the output of the task commands.
+type TaskLogs struct {
+	Stdout []byte
+	Stderr []byte
+	// Whether some stream has exceeded the max size and has been truncated
+	Truncated bool
+}
+
+//It reads the task logs from the container, up to the configured max size.
+//It returns nil if the logs couldn't be read (e.g the container has not been started).
+func (e *TaskExecutor) collectLogs() *TaskLogs {
+	cid := e.containerId()
+
+	if cid == "" {
+		return nil
+	}
+
+	limit := utils.Int64FromEnv(TaskLogsMaxSizeKey, DefaultTaskLogsMaxSize)
+	stdout, stdoutTruncated, err := utils.ReadLimited(e.cli(), cid, TaskStdoutFilePath, limit)
+
+	if err != nil {
+		e.logger().WithError(err).Error("Error on collecting the task's stdout")
+		return nil
+	}
+
+	stderr, stderrTruncated, err := utils.ReadLimited(e.cli(), cid, TaskStderrFilePath, limit)
+
+	if err != nil {
+		e.logger().WithError(err).Error("Error on collecting the task's stderr")
+		return nil
+	}
+
+	return &TaskLogs{Stdout: stdout, Stderr: stderr, Truncated: stdoutTruncated || stderrTruncated}
+}
+
+//It uploads the task logs to the server, one request per stream, and keeps them
+//in the worker host if a logs path is configured. The secrets the commands may
+//have printed are redacted from both.
+func (w *Worker) handleTaskLogs(task *Task, logs *TaskLogs, serverEndPoint string) {
+	if logs == nil {
+		return
+	}
+
+	logs = logs.redacted()
+
+	if err := w.uploadTaskLogs(task, logs, serverEndPoint); err != nil {
+		w.logger().With(utils.TaskIdField, task.Id).WithError(err).Error("Error on uploading the task logs")
+	}
+
+	logsPath := os.Getenv(TaskLogsPathKey)
+
+	if logsPath == "" {
+		return
+	}
+
+	if err := saveTaskLogs(logsPath, task.Id, logs); err != nil {
+		w.logger().With(utils.TaskIdField, task.Id).WithError(err).Error("Error on saving the task logs")
+	}
+
+	pruneTaskLogs(logsPath, utils.DurationFromEnv(TaskLogsRetentionKey, DefaultTaskLogsRetention))
+}
+
+//It returns a copy of the logs whose streams have the secret values and patterns
+//replaced by the utils.RedactedMask.
+func (l *TaskLogs) redacted() *TaskLogs {
+	return &TaskLogs{
+		Stdout:    []byte(utils.Redact(string(l.Stdout))),
+		Stderr:    []byte(utils.Redact(string(l.Stderr))),
+		Truncated: l.Truncated,
+	}
+}
+
+func (w *Worker) uploadTaskLogs(task *Task, logs *TaskLogs, serverEndPoint string) error {
+	token, queueId := w.credentials()
+	url := serverEndPoint + "/workers/" + w.Id + "/queues/" + fmt.Sprint(queueId) + "/tasks/" + task.Id + "/logs/"
+
+	streams := []struct {
+		name    string
+		content []byte
+	}{{"stdout", logs.Stdout}, {"stderr", logs.Stderr}}
+
+	for _, stream := range streams {
+		header := http.Header{}
+		header.Set("arrebol-worker-token", token)
+		header.Set(LogsTruncatedKey, strconv.FormatBool(logs.Truncated))
+
+		if _, err := utils.Upload(w.Id, stream.content, "text/plain", header, url+stream.name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//It saves the task logs in the logs path, as <task id>.out and <task id>.err.
+//It returns an error if the task id is not a plain file name, since it comes from
+//the server and mustn't make the logs be written out of the logs path.
+func saveTaskLogs(logsPath, taskId string, logs *TaskLogs) error {
+	if taskId == "" || taskId == "." || taskId == ".." || filepath.Base(taskId) != taskId || strings.ContainsAny(taskId, `/\`) {
+		return errors.New("The task id [" + taskId + "] is not a valid file name")
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(logsPath, taskId+".out"), logs.Stdout, 0600); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(logsPath, taskId+".err"), logs.Stderr, 0600)
+}
+
+//It removes the saved logs that are older than the retention period.
+func pruneTaskLogs(logsPath string, retention time.Duration) {
+	files, err := ioutil.ReadDir(logsPath)
+
+	if err != nil {
+		utils.Log().WithError(err).Error("Error on listing the saved task logs")
+		return
+	}
+
+	for _, file := range files {
+		ext := filepath.Ext(file.Name())
+
+		if file.IsDir() || (ext != ".out" && ext != ".err") || time.Since(file.ModTime()) < retention {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(logsPath, file.Name())); err != nil {
+			utils.Log().WithError(err).Error("Error on removing expired task logs")
+		}
+	}
+}
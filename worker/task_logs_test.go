@@ -0,0 +1,164 @@
+package worker
+
+import (
+	"bytes"
+	"github.com/ufcg-lsd/arrebol-pb-worker/utils"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSaveAndPruneTaskLogs(t *testing.T) {
+	//setup
+	logsPath, err := ioutil.TempDir("", "task-logs")
+
+	if err != nil {
+		t.Fatal("Error on creating the logs dir")
+	}
+	defer os.RemoveAll(logsPath)
+
+	logs := &TaskLogs{Stdout: []byte("arrebol"), Stderr: []byte("")}
+
+	//exercise
+	if err := saveTaskLogs(logsPath, "old", logs); err != nil {
+		t.Fatal("Error on saving the logs: " + err.Error())
+	}
+
+	if err := saveTaskLogs(logsPath, "new", logs); err != nil {
+		t.Fatal("Error on saving the logs: " + err.Error())
+	}
+
+	expired := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(filepath.Join(logsPath, "old.out"), expired, expired)
+	os.Chtimes(filepath.Join(logsPath, "old.err"), expired, expired)
+
+	pruneTaskLogs(logsPath, time.Hour)
+
+	//verification
+	content, err := ioutil.ReadFile(filepath.Join(logsPath, "new.out"))
+
+	if err != nil || string(content) != "arrebol" {
+		t.Errorf("The recent logs must be kept")
+	}
+
+	if _, err := os.Stat(filepath.Join(logsPath, "old.out")); !os.IsNotExist(err) {
+		t.Errorf("The expired logs must be removed")
+	}
+}
+
+func TestSaveTaskLogsWithInvalidTaskId(t *testing.T) {
+	//setup
+	logsPath, err := ioutil.TempDir("", "task-logs")
+
+	if err != nil {
+		t.Fatal("Error on creating the logs dir")
+	}
+	defer os.RemoveAll(logsPath)
+
+	logs := &TaskLogs{Stdout: []byte("arrebol"), Stderr: []byte("")}
+
+	for _, taskId := range []string{"", ".", "..", "../escaped", "nested/1", "/tmp/1", `..\escaped`} {
+		//exercise
+		err := saveTaskLogs(logsPath, taskId, logs)
+
+		//verification
+		if err == nil {
+			t.Errorf("The logs of the task [%s] must not be saved", taskId)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(filepath.Dir(logsPath), "escaped.out")); !os.IsNotExist(err) {
+		t.Errorf("The logs must not be written out of the logs path")
+	}
+}
+
+func TestWorker_UploadTaskLogs(t *testing.T) {
+	//setup
+	workerTestInstance.QueueId = 932
+	uploads := 0
+	utils.Client = &MockedClient{}
+	utils.GetSignature = func(message []byte, workerId string) ([]byte, string, error) {
+		return []byte("FAKE-SIGNATURE"), utils.AlgorithmRSAPSS, nil
+	}
+
+	GetDo = func() (*http.Response, error) {
+		uploads++
+		resp := &http.Response{
+			StatusCode: 201,
+			Header:     nil,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+		return resp, nil
+	}
+
+	//exercise
+	err := workerTestInstance.uploadTaskLogs(&Task{Id: "1"}, &TaskLogs{Stdout: []byte("out")}, "http://test-server:8000/v1")
+
+	//verification
+	if err != nil {
+		t.Error("Error on uploading the logs: " + err.Error())
+	}
+
+	if uploads != 2 {
+		t.Errorf("Each stream must be uploaded, got %d uploads", uploads)
+	}
+}
+
+func TestWorker_HandleTaskLogsRedactsSecrets(t *testing.T) {
+	//setup
+	logsPath, err := ioutil.TempDir("", "task-logs")
+
+	if err != nil {
+		t.Fatal("Error on creating the logs dir")
+	}
+	defer os.RemoveAll(logsPath)
+
+	previous := os.Getenv(TaskLogsPathKey)
+	os.Setenv(TaskLogsPathKey, logsPath)
+	defer os.Setenv(TaskLogsPathKey, previous)
+
+	var lock sync.Mutex
+	uploaded := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		uploaded = append(uploaded, string(body))
+		lock.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	previousClient := utils.Client
+	utils.Client = &http.Client{}
+	defer func() {
+		utils.Client = previousClient
+	}()
+	utils.GetSignature = func(message []byte, workerId string) ([]byte, string, error) {
+		return []byte("FAKE-SIGNATURE"), utils.AlgorithmRSAPSS, nil
+	}
+
+	utils.RegisterSecret("s3cr3t-logged")
+	logs := &TaskLogs{Stdout: []byte("the password is s3cr3t-logged"), Stderr: []byte("s3cr3t-logged not found")}
+
+	//exercise
+	workerTestInstance.handleTaskLogs(&Task{Id: "1"}, logs, server.URL)
+
+	//verification
+	saved, _ := ioutil.ReadFile(filepath.Join(logsPath, "1.out"))
+
+	if len(uploaded) != 2 || len(saved) == 0 {
+		t.Fatalf("The logs must be uploaded and saved, got %d uploads and [%s]", len(uploaded), saved)
+	}
+
+	for _, content := range append(uploaded, string(saved)) {
+		if strings.Contains(content, "s3cr3t-logged") || !strings.Contains(content, utils.RedactedMask) {
+			t.Errorf("The secret must be redacted from the logs, got [%s]", content)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package worker
+
+//This module implements the mounts the tasks are able to use, such as a shared dataset
+//directory of the node or a scratch space. They are declared by name in the worker
+//configuration, which is the allowlist the task requests are checked against, so the
+//tasks are never able to mount arbitrary host paths.
+
+import (
+	"errors"
+	"github.com/docker/docker/api/types/mount"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	//The work dir of the executor script, which can't be shadowed by a mount
+	WorkDir = "/arrebol"
+)
+
+type MountType string
+
+const (
+	//A directory of the worker host
+	MountBind MountType = "bind"
+	//A scratch space in memory, created empty for each task
+	MountTmpfs MountType = "tmpfs"
+)
+
+//This struct represents a mount declared in the worker configuration.
+type MountConfig struct {
+	//The name by which the tasks request the mount
+	Name string
+	Type MountType
+	//The absolute path in the worker host. It is only used by bind mounts.
+	Source string
+	//The absolute path inside the task's container
+	Target   string
+	ReadOnly bool
+	//The size limit (MegaBytes) of a tmpfs mount. Zero means no limit.
+	Size uint32
+}
+
+//It checks the mounts of the worker configuration.
+//It returns:
+//1. an error if some mount is invalid or they have repeated names or targets
+//2. nil otherwise
+func validateMounts(mounts []MountConfig) error {
+	names := make(map[string]bool)
+	targets := make(map[string]bool)
+
+	for _, m := range mounts {
+		if err := m.validate(); err != nil {
+			return err
+		}
+
+		target := path.Clean(m.Target)
+
+		if names[m.Name] || targets[target] {
+			return errors.New("The mount [" + m.Name + "] repeats the name or the target of another mount")
+		}
+
+		names[m.Name] = true
+		targets[target] = true
+	}
+
+	return nil
+}
+
+func (m MountConfig) validate() error {
+	if m.Name == "" {
+		return errors.New("Every mount must have a name")
+	}
+
+	target := path.Clean(m.Target)
+
+	if !path.IsAbs(target) || target == "/" || isWithin(target, WorkDir) || isWithin(target, SecretsDir) {
+		return errors.New("The mount [" + m.Name + "] must target an absolute path out of " + WorkDir + " and " + SecretsDir)
+	}
+
+	switch m.Type {
+	case MountBind:
+		if !filepath.IsAbs(m.Source) {
+			return errors.New("The bind mount [" + m.Name + "] must have an absolute source path")
+		}
+	case MountTmpfs:
+		if m.Source != "" {
+			return errors.New("The tmpfs mount [" + m.Name + "] can't have a source path")
+		}
+	default:
+		return errors.New("The mount [" + m.Name + "] has an unknown type [" + string(m.Type) + "]")
+	}
+
+	return nil
+}
+
+func isWithin(target, dir string) bool {
+	return target == dir || strings.HasPrefix(target, dir+"/")
+}
+
+//It returns the container mounts requested by the task.
+//It returns:
+//1. nil and an error if the task requests a mount that is not allowed
+//2. the mounts and nil otherwise
+func (e *TaskExecutor) mountsFor(task *Task) ([]mount.Mount, error) {
+	mounts := make([]mount.Mount, 0, len(task.Mounts))
+	requested := make(map[string]bool)
+
+	for _, name := range task.Mounts {
+		if requested[name] {
+			continue
+		}
+
+		m, ok := e.allowedMount(name)
+
+		if !ok {
+			return nil, errors.New("The mount [" + name + "] is not allowed in this worker")
+		}
+
+		requested[name] = true
+		mounts = append(mounts, m.toDocker())
+	}
+
+	return mounts, nil
+}
+
+func (e *TaskExecutor) allowedMount(name string) (MountConfig, bool) {
+	for _, m := range e.Mounts {
+		if m.Name == name {
+			return m, true
+		}
+	}
+
+	return MountConfig{}, false
+}
+
+func (m MountConfig) toDocker() mount.Mount {
+	dockerMount := mount.Mount{
+		Type:     mount.Type(m.Type),
+		Source:   m.Source,
+		Target:   path.Clean(m.Target),
+		ReadOnly: m.ReadOnly,
+	}
+
+	if m.Type == MountTmpfs && m.Size > 0 {
+		dockerMount.TmpfsOptions = &mount.TmpfsOptions{SizeBytes: int64(m.Size) * 1024 * 1024}
+	}
+
+	return dockerMount
+}
@@ -0,0 +1,77 @@
+package worker
+
+import (
+	"github.com/docker/docker/api/types/mount"
+	"testing"
+)
+
+var (
+	mountsTestConfig = []MountConfig{
+		{Name: "datasets", Type: MountBind, Source: "/srv/datasets", Target: "/datasets", ReadOnly: true},
+		{Name: "scratch", Type: MountTmpfs, Target: "/scratch", Size: 512},
+	}
+)
+
+func TestValidateMounts(t *testing.T) {
+	//setup
+	invalid := [][]MountConfig{
+		{{Name: "", Type: MountTmpfs, Target: "/scratch"}},
+		{{Name: "datasets", Type: MountBind, Source: "srv/datasets", Target: "/datasets"}},
+		{{Name: "scratch", Type: MountTmpfs, Source: "/tmp", Target: "/scratch"}},
+		{{Name: "scratch", Type: "volume", Target: "/scratch"}},
+		{{Name: "scratch", Type: MountTmpfs, Target: "/arrebol/scratch"}},
+		{{Name: "root", Type: MountTmpfs, Target: "/"}},
+		{{Name: "a", Type: MountTmpfs, Target: "/scratch"}, {Name: "b", Type: MountTmpfs, Target: "/scratch/"}},
+	}
+
+	//exercise and verification
+	if err := validateMounts(mountsTestConfig); err != nil {
+		t.Errorf("The mounts must be valid: %v", err)
+	}
+
+	for _, mounts := range invalid {
+		if err := validateMounts(mounts); err == nil {
+			t.Errorf("The mounts %+v must be invalid", mounts)
+		}
+	}
+}
+
+func TestTaskExecutor_MountsFor(t *testing.T) {
+	//setup
+	executor := &TaskExecutor{Mounts: mountsTestConfig}
+	task := &Task{Mounts: []string{"scratch", "datasets", "scratch"}}
+
+	//exercise
+	mounts, err := executor.mountsFor(task)
+
+	//verification
+	if err != nil {
+		t.Fatalf("The mounts must be allowed: %v", err)
+	}
+
+	if len(mounts) != 2 {
+		t.Fatalf("Each requested mount must be mounted once, got %d mounts", len(mounts))
+	}
+
+	if mounts[0].Type != mount.TypeTmpfs || mounts[0].TmpfsOptions == nil || mounts[0].TmpfsOptions.SizeBytes != 512*1024*1024 {
+		t.Errorf("The scratch mount %+v must be a limited tmpfs", mounts[0])
+	}
+
+	if mounts[1].Type != mount.TypeBind || mounts[1].Source != "/srv/datasets" || !mounts[1].ReadOnly {
+		t.Errorf("The datasets mount %+v must be a read-only bind", mounts[1])
+	}
+}
+
+func TestTaskExecutor_MountsForNotAllowedMount(t *testing.T) {
+	//setup
+	executor := &TaskExecutor{Mounts: mountsTestConfig}
+	task := &Task{Mounts: []string{"datasets", "/etc"}}
+
+	//exercise
+	_, err := executor.mountsFor(task)
+
+	//verification
+	if err == nil {
+		t.Errorf("A mount out of the allowlist must be refused")
+	}
+}
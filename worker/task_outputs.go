@@ -0,0 +1,242 @@
+package worker
+
+//This module implements the collection of the task outputs, which are the files the
+//task produces inside its container. The output globs are expanded in the container
+//after the commands run, each matched path is archived into a temp file, up to a
+//configurable total size, before the container is removed, and the archives are
+//uploaded to the server in chunks read from these files, which are removed then.
+//The digests of the uploaded archives are sent in the final report.
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/ufcg-lsd/arrebol-pb-worker/utils"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	TaskOutputsMaxSizeKey   = "TASK_OUTPUTS_MAX_SIZE"
+	TaskOutputsChunkSizeKey = "TASK_OUTPUTS_CHUNK_SIZE"
+
+	//(Bytes) of all the task output archives together
+	DefaultTaskOutputsMaxSize = 100 * 1024 * 1024
+	//(Bytes) of each upload request
+	DefaultTaskOutputsChunkSize = 4 * 1024 * 1024
+
+	TaskOutputsFilePath         = "/arrebol/task-id.outputs"
+	ExpandOutputsCommandPattern = "shopt -s nullglob globstar; for f in %s; do [ -e \"$f\" ] && echo \"$f\"; done > " + TaskOutputsFilePath
+	ArtifactPathKey             = "arrebol-artifact-path"
+	ArtifactDigestKey           = "arrebol-artifact-digest"
+)
+
+var (
+	//The output globs are expanded by bash inside the container, so they are
+	//restricted to absolute paths without any shell syntax other than the globs.
+	outputPattern = regexp.MustCompile(`^/[A-Za-z0-9_.*?/\[\]{},+=@%:-]*$`)
+)
+
+//It is a file or directory produced by the task, archived from its container.
+type OutputArchive struct {
+	// Path of the file or directory inside the container
+	Path string
+	// Temp file holding the tar archive of the path, as built by the docker archive API
+	File string
+	// (Bytes) of the tar archive
+	Size int64
+	// Digest of the tar archive, as sha256:<hex>
+	Digest string
+}
+
+//This struct represents a task output that has been uploaded to the server.
+type TaskArtifact struct {
+	// Path of the file or directory inside the container
+	Path string
+	// (Bytes) of the tar archive
+	Size int64
+	// Digest of the tar archive, as sha256:<hex>
+	Digest string
+}
+
+//It archives the paths matched by the task's output globs into temp files,
+//which are removed once the archives are uploaded.
+//It returns:
+//1. nil and an error wrapping utils.ErrSizeLimitExceeded if the archives
+//are bigger than the configured max size
+//2. nil and an error if some glob is invalid or some path couldn't be archived
+//3. the archives and nil otherwise
+func (e *TaskExecutor) collectOutputs(ctx context.Context, task *Task) ([]OutputArchive, error) {
+	if len(task.Outputs) == 0 {
+		return nil, nil
+	}
+
+	paths, err := e.expandOutputs(ctx, task.Outputs)
+
+	if err != nil {
+		return nil, err
+	}
+
+	remaining := utils.Int64FromEnv(TaskOutputsMaxSizeKey, DefaultTaskOutputsMaxSize)
+	archives := make([]OutputArchive, 0, len(paths))
+
+	for _, path := range paths {
+		archive, err := e.archiveOutput(path, remaining)
+
+		if err != nil {
+			removeOutputs(archives)
+			return nil, err
+		}
+
+		remaining -= archive.Size
+		archives = append(archives, archive)
+	}
+
+	return archives, nil
+}
+
+//It archives the path inside the container into a temp file, up to the limit,
+//computing the archive's digest as it is written.
+func (e *TaskExecutor) archiveOutput(path string, limit int64) (OutputArchive, error) {
+	file, err := ioutil.TempFile("", "arrebol-output")
+
+	if err != nil {
+		return OutputArchive{}, err
+	}
+	defer file.Close()
+
+	digest := sha256.New()
+	size, err := utils.ReadArchive(e.cli(), e.containerId(), path, io.MultiWriter(file, digest), limit)
+
+	if err != nil {
+		os.Remove(file.Name())
+		return OutputArchive{}, err
+	}
+
+	return OutputArchive{Path: path, File: file.Name(), Size: size, Digest: "sha256:" + hex.EncodeToString(digest.Sum(nil))}, nil
+}
+
+//It removes the temp files of the output archives.
+func removeOutputs(outputs []OutputArchive) {
+	for _, output := range outputs {
+		os.Remove(output.File)
+	}
+}
+
+//It expands the output globs inside the container.
+//It returns the matched paths, without repetitions, in the globs order.
+func (e *TaskExecutor) expandOutputs(ctx context.Context, globs []string) ([]string, error) {
+	for _, glob := range globs {
+		if !outputPattern.MatchString(glob) {
+			return nil, errors.New("The output [" + glob + "] is not an absolute path glob")
+		}
+	}
+
+	cmd := fmt.Sprintf(ExpandOutputsCommandPattern, strings.Join(globs, " "))
+
+	if _, err := utils.ExecWait(ctx, e.cli(), e.containerId(), cmd); err != nil {
+		return nil, err
+	}
+
+	content, err := utils.Read(e.cli(), e.containerId(), TaskOutputsFilePath, TaskResultsFileMaxSize)
+
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0)
+	seen := make(map[string]bool)
+
+	for _, path := range strings.Split(string(bytes.Trim(content, "\x00")), "\n") {
+		path = strings.TrimSpace(path)
+
+		if path == "" || seen[path] {
+			continue
+		}
+
+		seen[path] = true
+		paths = append(paths, path)
+	}
+
+	return paths, nil
+}
+
+//It uploads the task outputs to the server and returns the uploaded artifacts.
+//The outputs that couldn't be uploaded are not returned.
+//The temp files of the outputs are removed in any case.
+func (w *Worker) handleTaskOutputs(task *Task, outputs []OutputArchive, serverEndPoint string) []TaskArtifact {
+	defer removeOutputs(outputs)
+	artifacts := make([]TaskArtifact, 0, len(outputs))
+
+	for i, output := range outputs {
+		artifact, err := w.uploadTaskOutput(task, i, output, serverEndPoint)
+
+		if err != nil {
+			w.logger().With(utils.TaskIdField, task.Id).With("path", output.Path).WithError(err).Error("Error on uploading the task output")
+			continue
+		}
+
+		artifacts = append(artifacts, artifact)
+	}
+
+	return artifacts
+}
+
+//It uploads the output archive in chunks read from its temp file, each one a
+//signed request whose Content-Range header tells its place in the archive.
+func (w *Worker) uploadTaskOutput(task *Task, index int, output OutputArchive, serverEndPoint string) (TaskArtifact, error) {
+	token, queueId := w.credentials()
+	url := serverEndPoint + "/workers/" + w.Id + "/queues/" + fmt.Sprint(queueId) + "/tasks/" + task.Id + "/artifacts/" + strconv.Itoa(index)
+
+	artifact := TaskArtifact{Path: output.Path, Size: output.Size, Digest: output.Digest}
+	chunkSize := utils.Int64FromEnv(TaskOutputsChunkSizeKey, DefaultTaskOutputsChunkSize)
+
+	if chunkSize <= 0 {
+		chunkSize = DefaultTaskOutputsChunkSize
+	}
+
+	if chunkSize > artifact.Size {
+		chunkSize = artifact.Size
+	}
+
+	file, err := os.Open(output.File)
+
+	if err != nil {
+		return TaskArtifact{}, err
+	}
+	defer file.Close()
+
+	chunk := make([]byte, chunkSize)
+
+	for start := int64(0); start < artifact.Size; start += chunkSize {
+		end := start + chunkSize
+
+		if end > artifact.Size {
+			end = artifact.Size
+		}
+
+		if _, err := io.ReadFull(file, chunk[:end-start]); err != nil {
+			return TaskArtifact{}, fmt.Errorf("Error on reading the archive of [%s]: %w", artifact.Path, err)
+		}
+
+		header := http.Header{}
+		header.Set("arrebol-worker-token", token)
+		header.Set(ArtifactPathKey, artifact.Path)
+		header.Set(ArtifactDigestKey, artifact.Digest)
+		header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, artifact.Size))
+
+		if _, err := utils.Upload(w.Id, chunk[:end-start], "application/x-tar", header, url); err != nil {
+			return TaskArtifact{}, err
+		}
+	}
+
+	return artifact, nil
+}
@@ -0,0 +1,141 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/ufcg-lsd/arrebol-pb-worker/utils"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestTaskExecutor_ExpandOutputsWithInvalidGlob(t *testing.T) {
+	//setup
+	executor := &TaskExecutor{}
+	globs := [][]string{
+		{"results/*.csv"},
+		{"/results/*.csv; rm -rf /"},
+		{"/results/$(whoami)"},
+		{"/results/a b"},
+	}
+
+	for _, glob := range globs {
+		//exercise
+		_, err := executor.expandOutputs(context.Background(), glob)
+
+		//verification
+		if err == nil {
+			t.Errorf("The output %v must be refused", glob)
+		}
+	}
+}
+
+func TestOutputPattern(t *testing.T) {
+	//setup
+	globs := []string{"/results/*.csv", "/results/**/out-?.txt", "/data/{a,b}.json", "/data/[0-9].bin"}
+
+	for _, glob := range globs {
+		//exercise and verification
+		if !outputPattern.MatchString(glob) {
+			t.Errorf("The output [%s] must be accepted", glob)
+		}
+	}
+}
+
+func TestWorker_UploadTaskOutputInChunks(t *testing.T) {
+	//setup
+	os.Setenv(TaskOutputsChunkSizeKey, "4")
+	defer os.Unsetenv(TaskOutputsChunkSizeKey)
+
+	workerTestInstance.QueueId = 932
+	uploads := 0
+	utils.Client = &MockedClient{}
+	utils.GetSignature = func(message []byte, workerId string) ([]byte, string, error) {
+		return []byte("FAKE-SIGNATURE"), utils.AlgorithmRSAPSS, nil
+	}
+
+	GetDo = func() (*http.Response, error) {
+		uploads++
+		resp := &http.Response{
+			StatusCode: 201,
+			Header:     nil,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+		return resp, nil
+	}
+
+	content := []byte("0123456789")
+	sum := sha256.Sum256(content)
+	output := outputTestArchive(t, content)
+
+	//exercise
+	artifacts := workerTestInstance.handleTaskOutputs(&Task{Id: "1"}, []OutputArchive{output}, "http://test-server:8000/v1")
+
+	//verification
+	if uploads != 3 {
+		t.Errorf("The output must be uploaded in 3 chunks, got %d uploads", uploads)
+	}
+
+	if len(artifacts) != 1 {
+		t.Fatalf("The output must be reported as an artifact")
+	}
+
+	if artifacts[0].Size != 10 || artifacts[0].Digest != "sha256:"+hex.EncodeToString(sum[:]) {
+		t.Errorf("The artifact %+v doesn't describe the uploaded output", artifacts[0])
+	}
+
+	if _, err := os.Stat(output.File); !os.IsNotExist(err) {
+		t.Errorf("The archive file must be removed once it is uploaded")
+	}
+}
+
+func TestWorker_UploadTaskOutputWithUnavailableServer(t *testing.T) {
+	//setup
+	utils.Client = &MockedClient{}
+	utils.GetSignature = func(message []byte, workerId string) ([]byte, string, error) {
+		return []byte("FAKE-SIGNATURE"), utils.AlgorithmRSAPSS, nil
+	}
+
+	GetDo = func() (*http.Response, error) {
+		resp := &http.Response{
+			StatusCode: 503,
+			Header:     nil,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+		return resp, nil
+	}
+
+	output := outputTestArchive(t, []byte("out"))
+
+	//exercise
+	artifacts := workerTestInstance.handleTaskOutputs(&Task{Id: "1"}, []OutputArchive{output}, "http://test-server:8000/v1")
+
+	//verification
+	if len(artifacts) != 0 {
+		t.Errorf("An output that hasn't been uploaded must not be reported")
+	}
+
+	if _, err := os.Stat(output.File); !os.IsNotExist(err) {
+		t.Errorf("The archive file must be removed even if it couldn't be uploaded")
+	}
+}
+
+//It writes the content to a temp file, as collectOutputs does with the archives.
+func outputTestArchive(t *testing.T, content []byte) OutputArchive {
+	file, err := ioutil.TempFile("", "arrebol-output")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(content); err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256(content)
+	return OutputArchive{Path: "/results", File: file.Name(), Size: int64(len(content)), Digest: "sha256:" + hex.EncodeToString(sum[:])}
+}
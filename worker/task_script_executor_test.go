@@ -0,0 +1,59 @@
+package worker
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//It runs the executor script in a temporary work dir, returning the exit codes it has written.
+func runTaskScript(t *testing.T, commands []string, flags ...string) []int {
+	workDir, err := ioutil.TempDir("", "arrebol")
+
+	if err != nil {
+		t.Fatal("Error on creating the work dir")
+	}
+	defer os.RemoveAll(workDir)
+
+	taskScriptFilePath := filepath.Join(workDir, "task-id.ts")
+
+	if err := ioutil.WriteFile(taskScriptFilePath, []byte(strings.Join(commands, "\n")), 0600); err != nil {
+		t.Fatal("Error on writing the task script")
+	}
+
+	args := append([]string{filepath.Join("bin", TaskScriptExecutorFileName), "-tsf=" + taskScriptFilePath}, flags...)
+	cmd := exec.Command("/bin/bash", args...)
+	cmd.Env = append(os.Environ(), "ARREBOL_WORK_DIR="+workDir)
+	cmd.Run()
+
+	content, err := ioutil.ReadFile(taskScriptFilePath + ".ec")
+
+	if err != nil {
+		t.Fatal("Error on reading the exit codes: " + err.Error())
+	}
+
+	return toIntArray(strings.Fields(string(content)))
+}
+
+func TestTaskScriptExecutor_ContinueMode(t *testing.T) {
+	//exercise
+	exitCodes := runTaskScript(t, []string{"true", "exit_with() { return $1; }; exit_with 3", "true"})
+
+	//verification
+	if len(exitCodes) != 3 || exitCodes[0] != 0 || exitCodes[1] != 3 || exitCodes[2] != 0 {
+		t.Errorf("Every command must be executed, got the exit codes %v", exitCodes)
+	}
+}
+
+func TestTaskScriptExecutor_FailFastMode(t *testing.T) {
+	//exercise
+	exitCodes := runTaskScript(t, []string{"true", "false", "true"}, "--fail-fast")
+
+	//verification
+	if len(exitCodes) != 2 || exitCodes[1] != 1 {
+		t.Errorf("The execution must stop at the failed command, got the exit codes %v", exitCodes)
+	}
+}
@@ -0,0 +1,207 @@
+package worker
+
+//This module implements the environment variables and secrets of the tasks.
+//The secrets are referenced by name, resolved from the worker secrets store, which
+//is a directory with one file per secret, and delivered either as environment
+//variables or as files of a tmpfs mount, so they never touch the container's disk.
+//Every resolved secret is registered for redaction, so it never shows up in the
+//worker logs nor in the task reports.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/ufcg-lsd/arrebol-pb-worker/utils"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	SecretsPathKey = "SECRETS_PATH"
+
+	//The tmpfs mount in which the file secrets are delivered
+	SecretsDir = "/run/arrebol/secrets"
+	//The secret files are readable by their owner only
+	DeliverSecretCommandPattern = "umask 0277 && mkdir -p %s && cat > %s"
+)
+
+var (
+	secretNamePattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+	envNamePattern    = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+//This struct represents a reference to a secret of the worker secrets store.
+//Exactly one of Env and File must be set.
+type SecretRef struct {
+	// Name of the secret in the store
+	Name string
+	// Name of the environment variable the secret is delivered as
+	Env string
+	// Name of the file, inside SecretsDir, the secret is delivered as
+	File string
+}
+
+//It returns the content of the named secret.
+type SecretResolver func(name string) ([]byte, error)
+
+//It returns the resolver of the secrets kept as files of the path.
+//If the path is empty, no secret can be resolved.
+func FileSecretStore(path string) SecretResolver {
+	return func(name string) ([]byte, error) {
+		if path == "" {
+			return nil, errors.New("The worker has no secrets store; set " + SecretsPathKey)
+		}
+
+		if !secretNamePattern.MatchString(name) {
+			return nil, errors.New("The secret name [" + name + "] is invalid")
+		}
+
+		return ioutil.ReadFile(filepath.Join(path, name))
+	}
+}
+
+//It is a secret delivered as a file.
+type secretFile struct {
+	name    string
+	content []byte
+}
+
+//It resolves the task's secrets, registering them for redaction.
+//It returns:
+//1. the environment of the task's container, as NAME=value, which includes the
+//task's variables and the secrets delivered as variables
+//2. the secrets delivered as files
+//3. an error if some variable or secret reference is invalid, or some secret
+//couldn't be resolved
+func (e *TaskExecutor) resolveSecrets(task *Task) ([]string, []secretFile, error) {
+	env := make([]string, 0, len(task.Env)+len(task.Secrets))
+
+	for _, name := range sortedKeys(task.Env) {
+		if !envNamePattern.MatchString(name) {
+			return nil, nil, errors.New("The environment variable name [" + name + "] is invalid")
+		}
+
+		env = append(env, name+"="+task.Env[name])
+	}
+
+	files := make([]secretFile, 0)
+
+	for _, ref := range task.Secrets {
+		if err := ref.validate(); err != nil {
+			return nil, nil, err
+		}
+
+		if e.ResolveSecret == nil {
+			return nil, nil, errors.New("The executor has no secret resolver")
+		}
+
+		content, err := e.ResolveSecret(ref.Name)
+
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error on resolving the secret [%s]: %w", ref.Name, err)
+		}
+
+		value := strings.TrimRight(string(content), "\r\n")
+		utils.RegisterSecret(value)
+
+		if ref.Env != "" {
+			env = append(env, ref.Env+"="+value)
+		} else {
+			files = append(files, secretFile{name: ref.File, content: content})
+		}
+	}
+
+	return env, files, nil
+}
+
+func (ref SecretRef) validate() error {
+	if (ref.Env == "") == (ref.File == "") {
+		return errors.New("The secret [" + ref.Name + "] must be delivered either as an environment variable or as a file")
+	}
+
+	if ref.Env != "" && !envNamePattern.MatchString(ref.Env) {
+		return errors.New("The environment variable name [" + ref.Env + "] is invalid")
+	}
+
+	if ref.File != "" && !secretNamePattern.MatchString(ref.File) {
+		return errors.New("The secret file name [" + ref.File + "] is invalid")
+	}
+
+	return nil
+}
+
+//It returns the tmpfs mount in which the file secrets are delivered.
+func secretsMount() mount.Mount {
+	return mount.Mount{
+		Type:         mount.TypeTmpfs,
+		Target:       SecretsDir,
+		TmpfsOptions: &mount.TmpfsOptions{Mode: 0700},
+	}
+}
+
+//It writes the file secrets into the secrets tmpfs of the task's container.
+//The content is sent through the stdin of the writing command, so it is never logged.
+func (e *TaskExecutor) deliverSecretFiles(ctx context.Context, files []secretFile) error {
+	for _, file := range files {
+		cmd := fmt.Sprintf(DeliverSecretCommandPattern, SecretsDir, SecretsDir+"/"+file.name)
+		exitCode, err := utils.ExecWithInput(ctx, e.cli(), e.containerId(), cmd, file.content)
+
+		if err != nil {
+			return err
+		}
+
+		if exitCode != 0 {
+			return fmt.Errorf("Error on writing the secret file [%s]: exit code %d", file.name, exitCode)
+		}
+	}
+
+	return nil
+}
+
+//It returns a copy of the task whose commands and environment are redacted,
+//which is the one sent in the reports.
+func (task *Task) redacted() *Task {
+	copied := *task
+
+	if task.Commands != nil {
+		copied.Commands = make([]string, len(task.Commands))
+
+		for i, command := range task.Commands {
+			copied.Commands[i] = utils.Redact(command)
+		}
+	}
+
+	if task.Env != nil {
+		copied.Env = make(map[string]string, len(task.Env))
+
+		for name, value := range task.Env {
+			copied.Env[name] = utils.Redact(value)
+		}
+	}
+
+	if task.Results != nil {
+		copied.Results = make([]CommandResult, len(task.Results))
+
+		for i, result := range task.Results {
+			result.Command = utils.Redact(result.Command)
+			copied.Results[i] = result
+		}
+	}
+
+	return &copied
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+
+	for key := range m {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
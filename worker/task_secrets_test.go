@@ -0,0 +1,113 @@
+package worker
+
+import (
+	"github.com/ufcg-lsd/arrebol-pb-worker/utils"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTaskExecutor_ResolveSecrets(t *testing.T) {
+	//setup
+	store, _ := ioutil.TempDir("", "secrets")
+	defer os.RemoveAll(store)
+	ioutil.WriteFile(filepath.Join(store, "db-password"), []byte("s3cr3t-db\n"), 0600)
+	ioutil.WriteFile(filepath.Join(store, "gcp-key"), []byte("{\"key\": \"s3cr3t-gcp\"}"), 0600)
+
+	executor := &TaskExecutor{ResolveSecret: FileSecretStore(store)}
+	task := &Task{
+		Env: map[string]string{"MODE": "batch", "DEBUG": "0"},
+		Secrets: []SecretRef{
+			{Name: "db-password", Env: "DB_PASSWORD"},
+			{Name: "gcp-key", File: "gcp.json"},
+		},
+	}
+
+	//exercise
+	env, files, err := executor.resolveSecrets(task)
+
+	//verification
+	if err != nil {
+		t.Fatalf("The secrets must be resolved: %v", err)
+	}
+
+	if !reflect.DeepEqual(env, []string{"DEBUG=0", "MODE=batch", "DB_PASSWORD=s3cr3t-db"}) {
+		t.Errorf("The container environment %v is not the expected one", env)
+	}
+
+	if len(files) != 1 || files[0].name != "gcp.json" || string(files[0].content) != "{\"key\": \"s3cr3t-gcp\"}" {
+		t.Errorf("The secret file %+v is not the expected one", files)
+	}
+
+	if strings.Contains(utils.Redact("psql -p s3cr3t-db"), "s3cr3t-db") {
+		t.Errorf("The resolved secrets must be redacted")
+	}
+}
+
+func TestTaskExecutor_ResolveSecretsWithInvalidReference(t *testing.T) {
+	//setup
+	store, _ := ioutil.TempDir("", "secrets")
+	defer os.RemoveAll(store)
+	ioutil.WriteFile(filepath.Join(store, "token"), []byte("s3cr3t-token"), 0600)
+
+	executor := &TaskExecutor{ResolveSecret: FileSecretStore(store)}
+	tasks := []*Task{
+		{Secrets: []SecretRef{{Name: "token"}}},
+		{Secrets: []SecretRef{{Name: "token", Env: "TOKEN", File: "token"}}},
+		{Secrets: []SecretRef{{Name: "token", File: "../token"}}},
+		{Secrets: []SecretRef{{Name: "token", Env: "1TOKEN"}}},
+		{Secrets: []SecretRef{{Name: "../secrets/token", Env: "TOKEN"}}},
+		{Secrets: []SecretRef{{Name: "missing", Env: "TOKEN"}}},
+		{Env: map[string]string{"A=B": "C"}},
+	}
+
+	for _, task := range tasks {
+		//exercise
+		_, _, err := executor.resolveSecrets(task)
+
+		//verification
+		if err == nil {
+			t.Errorf("The task %+v must be refused", task)
+		}
+	}
+}
+
+func TestFileSecretStoreWithoutPath(t *testing.T) {
+	//setup
+	resolve := FileSecretStore("")
+
+	//exercise
+	_, err := resolve("token")
+
+	//verification
+	if err == nil {
+		t.Errorf("No secret can be resolved without a secrets store")
+	}
+}
+
+func TestTask_Redacted(t *testing.T) {
+	//setup
+	utils.RegisterSecret("s3cr3t-report")
+	task := &Task{
+		Id:       "1",
+		Commands: []string{"curl -H 'token: s3cr3t-report' http://data"},
+		Env:      map[string]string{"TOKEN": "s3cr3t-report"},
+		Results:  []CommandResult{{Command: "curl -H 'token: s3cr3t-report' http://data", ExitCode: 0}},
+	}
+
+	//exercise
+	redacted := task.redacted()
+
+	//verification
+	if strings.Contains(redacted.Commands[0], "s3cr3t-report") || strings.Contains(redacted.Env["TOKEN"], "s3cr3t-report") ||
+		strings.Contains(redacted.Results[0].Command, "s3cr3t-report") {
+		t.Errorf("The reported task %+v must not contain the secret", redacted)
+	}
+
+	if !strings.Contains(task.Commands[0], "s3cr3t-report") {
+		t.Errorf("The task itself must not be redacted")
+	}
+}
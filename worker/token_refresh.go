@@ -0,0 +1,87 @@
+package worker
+
+//This module implements the refresh of the worker's token. The token is refreshed,
+//by joining the server again, a margin before it expires, so the worker doesn't
+//learn it has expired from a failed request. The running tasks aren't interrupted,
+//since their reports read the credentials each time they are sent; a report that
+//is refused with an expired token anyway is sent again once the token is refreshed.
+import (
+	"context"
+	"github.com/ufcg-lsd/arrebol-pb-worker/utils"
+	"time"
+)
+
+const (
+	TokenRefreshMarginKey = "TOKEN_REFRESH_MARGIN"
+
+	DefaultTokenRefreshMargin = 5 * time.Minute
+	//How often the refresher checks the token while it is not due, so it notices
+	//the tokens the worker gets from the joins it hasn't done itself
+	TokenCheckInterval = time.Minute
+)
+
+//It returns when the token must be refreshed, which is the margin before it expires.
+//The margin is capped to half of the token lifetime, so the short-lived tokens
+//aren't refreshed as soon as they are received.
+//It returns the zero time if the worker has no token whose expiration is known.
+func (w *Worker) tokenRefreshDue(margin time.Duration) time.Time {
+	w.credentialsLock.RLock()
+	defer w.credentialsLock.RUnlock()
+
+	if w.Token == "" || w.tokenExpiry.IsZero() {
+		return time.Time{}
+	}
+
+	if lifetime := w.tokenExpiry.Sub(w.tokenReceived); margin > lifetime/2 {
+		margin = lifetime / 2
+	}
+
+	return w.tokenExpiry.Add(-margin)
+}
+
+//It refreshes the worker's token by joining the server again, unless it has already
+//been refreshed since the stale token was read, so the slots whose reports are refused
+//at once don't make the worker join many times.
+//Params:
+//serverEndpoint - the server endpoint
+//staleToken - the token the caller has found to be expired
+//It returns the join error, if it has failed.
+func (w *Worker) RefreshToken(serverEndpoint string, staleToken string) error {
+	w.refreshLock.Lock()
+	defer w.refreshLock.Unlock()
+
+	if token, _ := w.credentials(); token != staleToken {
+		return nil
+	}
+
+	return w.Join(serverEndpoint)
+}
+
+//It keeps the worker's token fresh until the context is done, refreshing it a margin
+//before it expires. The failed refreshes are retried after the backoff interval.
+func (w *Worker) KeepTokenFresh(ctx context.Context, serverEndpoint string, margin time.Duration, backoff *utils.Backoff) {
+	for ctx.Err() == nil {
+		due := w.tokenRefreshDue(margin)
+
+		if wait := time.Until(due); due.IsZero() || wait > 0 {
+			if due.IsZero() || wait > TokenCheckInterval {
+				wait = TokenCheckInterval
+			}
+
+			sleep(ctx, wait)
+			continue
+		}
+
+		token, _ := w.credentials()
+		w.logger().Info("Refreshing the token before it expires")
+
+		if err := w.RefreshToken(serverEndpoint, token); err != nil {
+			interval := backoff.Next()
+			w.logger().WithError(err).With("retry_in", interval).Warn("Error on refreshing the token; retrying")
+			sleep(ctx, interval)
+			continue
+		}
+
+		backoff.Reset()
+	}
+}
@@ -0,0 +1,181 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/ufcg-lsd/arrebol-pb-worker/utils"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+//It makes the mocked server answer the responses in order, signing the requests with
+//a fake signature and joining the worker with tokens of the expiry. The worker's keys are
+//generated in a temp dir, which is removed along with the mocks when the returned func is called.
+//It returns the number of requests the server has received.
+func refreshTestServer(t *testing.T, expiry time.Time, responses ...*http.Response) (*int, func()) {
+	keysPath, err := ioutil.TempDir("", "keys")
+
+	if err != nil {
+		t.Fatalf("Error on creating the keys path: %v", err)
+	}
+
+	previousKeysPath, previousKeyType := os.Getenv(utils.KeysPathKey), os.Getenv(utils.KeyTypeKey)
+	os.Setenv(utils.KeysPathKey, keysPath)
+	//the Ed25519 keys are the fastest to generate
+	os.Setenv(utils.KeyTypeKey, string(utils.KeyEd25519))
+	utils.GenAccessKeys(workerTestInstance.Id)
+
+	requests := 0
+	utils.Client = &MockedClient{}
+	GetDo = func() (*http.Response, error) {
+		resp := responses[requests]
+		requests++
+		return resp, nil
+	}
+	utils.GetSignature = func(message []byte, workerId string) ([]byte, string, error) {
+		return []byte("FAKE-SIGNATURE"), utils.AlgorithmRSAPSS, nil
+	}
+	ParseToken = func(tokenStr string) (*TokenClaims, error) {
+		return &TokenClaims{QueueId: 932, ExpiresAt: expiry.Unix()}, nil
+	}
+
+	return &requests, func() {
+		ParseToken = parseToken
+		os.Setenv(utils.KeysPathKey, previousKeysPath)
+		os.Setenv(utils.KeyTypeKey, previousKeyType)
+		os.RemoveAll(keysPath)
+	}
+}
+
+func joinResponse(token string) *http.Response {
+	body, _ := json.Marshal(map[string]string{"arrebol-worker-token": token})
+	return &http.Response{StatusCode: 201, Body: ioutil.NopCloser(bytes.NewReader(body))}
+}
+
+func statusResponse(statusCode int) *http.Response {
+	return &http.Response{StatusCode: statusCode, Body: ioutil.NopCloser(bytes.NewReader(nil))}
+}
+
+func TestWorker_TokenRefreshDue(t *testing.T) {
+	//setup
+	received := time.Now()
+	cases := []struct {
+		expiry   time.Time
+		expected time.Time
+	}{
+		{received.Add(time.Hour), received.Add(time.Hour - DefaultTokenRefreshMargin)},
+		//the margin is capped to half of the token lifetime
+		{received.Add(4 * time.Minute), received.Add(2 * time.Minute)},
+		{time.Time{}, time.Time{}},
+	}
+
+	for _, c := range cases {
+		w := &Worker{Id: "1023", Token: "test-token", QueueId: 932, tokenReceived: received, tokenExpiry: c.expiry}
+
+		//exercise
+		due := w.tokenRefreshDue(DefaultTokenRefreshMargin)
+
+		//verification
+		if !due.Equal(c.expected) {
+			t.Errorf("The token expiring at %v must be refreshed at %v, got %v", c.expiry, c.expected, due)
+		}
+	}
+}
+
+func TestWorker_RefreshToken(t *testing.T) {
+	//setup
+	expiry := time.Now().Add(time.Hour)
+	requests, restore := refreshTestServer(t, expiry, joinResponse("refreshed-token"))
+	defer restore()
+
+	w := &Worker{Id: workerTestInstance.Id, Token: "expired-token", QueueId: 932}
+
+	//exercise
+	err := w.RefreshToken("http://test-server:8000/v1", "expired-token")
+	//the token has already been refreshed since the other caller has read it
+	again := w.RefreshToken("http://test-server:8000/v1", "expired-token")
+
+	//verification
+	if err != nil || again != nil || *requests != 1 {
+		t.Fatalf("The worker must join once, got %d joins and [%v], [%v]", *requests, err, again)
+	}
+
+	if token, _ := w.credentials(); token != "refreshed-token" || !w.tokenExpiry.Equal(time.Unix(expiry.Unix(), 0)) {
+		t.Errorf("The refreshed token and its expiry must be set, got [%s] expiring at %v", token, w.tokenExpiry)
+	}
+}
+
+func TestWorker_KeepTokenFresh(t *testing.T) {
+	//setup
+	requests, restore := refreshTestServer(t, time.Now().Add(time.Hour), statusResponse(503), joinResponse("refreshed-token"))
+	defer restore()
+
+	//the token expires within the refresh margin
+	w := &Worker{Id: workerTestInstance.Id, Token: "expiring-token", QueueId: 932,
+		tokenReceived: time.Now().Add(-time.Hour), tokenExpiry: time.Now().Add(time.Minute)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	waits := make([]time.Duration, 0)
+	sleep = func(ctx context.Context, d time.Duration) {
+		waits = append(waits, d)
+
+		//the token has been refreshed, so it is not due until the next check
+		if len(waits) == 2 {
+			cancel()
+		}
+	}
+	defer func() { sleep = wait }()
+
+	//exercise
+	w.KeepTokenFresh(ctx, "http://test-server:8000/v1", DefaultTokenRefreshMargin, utils.NewBackoff(time.Second, time.Minute, 2, 0))
+
+	//verification
+	if token, _ := w.credentials(); token != "refreshed-token" || *requests != 2 {
+		t.Fatalf("The token must be refreshed after a failed try, got [%s] and %d joins", token, *requests)
+	}
+
+	if waits[0] != time.Second || waits[1] != TokenCheckInterval {
+		t.Errorf("The refresher must back off the failed refresh and then wait the check interval, got %v", waits)
+	}
+}
+
+func TestWorker_SendTaskReportRefreshesExpiredToken(t *testing.T) {
+	//setup
+	body, _ := json.Marshal(ReportResponse{Cancel: true})
+	requests, restore := refreshTestServer(t, time.Now().Add(time.Hour),
+		statusResponse(401),
+		joinResponse("refreshed-token"),
+		&http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewReader(body))})
+	defer restore()
+
+	w := &Worker{Id: workerTestInstance.Id, Token: "expired-token", QueueId: 932}
+
+	//exercise
+	cancel := w.sendTaskReport(&Task{Id: "1", Commands: []string{}}, &TaskExecutor{}, "http://test-server:8000/v1")
+
+	//verification
+	if !cancel || *requests != 3 {
+		t.Errorf("The report must be sent again once the token is refreshed, got %d requests", *requests)
+	}
+}
+
+func TestWorker_SendTaskReportRefreshesOnce(t *testing.T) {
+	//setup
+	requests, restore := refreshTestServer(t, time.Now().Add(time.Hour),
+		statusResponse(401), joinResponse("refreshed-token"), statusResponse(401))
+	defer restore()
+
+	w := &Worker{Id: workerTestInstance.Id, Token: "expired-token", QueueId: 932}
+
+	//exercise
+	cancel := w.sendTaskReport(&Task{Id: "1", Commands: []string{}}, &TaskExecutor{}, "http://test-server:8000/v1")
+
+	//verification
+	if cancel || *requests != 3 {
+		t.Errorf("The report must be retried only once, got %d requests", *requests)
+	}
+}
@@ -1,16 +1,14 @@
 package worker
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/dgrijalva/jwt-go"
 	"github.com/ufcg-lsd/arrebol-pb-worker/utils"
 	"io"
-	"log"
 	"net/http"
-	"os"
-	"strconv"
+	"sync"
 	"time"
 )
 
@@ -39,6 +37,36 @@ type Worker struct {
 	Id string
 	//The queue from which the worker must ask for tasks
 	QueueId uint
+	//The amount of tasks that the worker instance runs at once.
+	//The Vcpu and Ram are split evenly across them.
+	Slots uint
+	//The maximum number of processes inside each task container
+	PidsLimit int64
+	//The maximum number of files each process of a task container can open
+	MaxOpenFiles int64
+	//The mounts the tasks are allowed to request
+	Mounts []MountConfig
+	//The patterns and values redacted from the worker logs and reports
+	Redaction utils.RedactionConfig
+	//When the Token expires, if it is known, and when it has been received
+	tokenExpiry   time.Time
+	tokenReceived time.Time
+	//It guards the Token, the QueueId and their times, which are set by a join
+	//while the slots are reporting their tasks.
+	credentialsLock sync.RWMutex
+	//It serializes the token refreshes
+	refreshLock sync.Mutex
+}
+
+//This struct represents the worker's subscription in the server. It only has the
+//fields the server needs, so the worker's local settings, such as its mounts paths
+//and the redacted secrets, are never sent.
+type JoinRequest struct {
+	Id      string
+	Vcpu    float32
+	Ram     uint32
+	QueueId uint
+	Slots   uint
 }
 
 const (
@@ -52,11 +80,20 @@ const (
 	TaskRunning
 	TaskFinished
 	TaskFailed
+	//The task has been aborted because the worker is shutting down
+	TaskInterrupted
+	//The task has exceeded its timeout
+	TaskTimedOut
+	//The task has been canceled by the server
+	TaskCanceled
 )
 
 var (
+	//The worker hasn't joined the server yet, so it has no queue to ask for tasks
+	ErrNotJoined = errors.New("The QueueId must be set before getting a task")
 	//for test purpose
-	ParseToken func(tokenStr string) (map[string]interface{}, error) = parseToken
+	ParseToken func(tokenStr string) (*TokenClaims, error) = parseToken
+	sleep      func(ctx context.Context, d time.Duration)  = wait
 )
 
 //This struct represents a task, the executable piece of the system.
@@ -71,123 +108,353 @@ type Task struct {
 	// Docker image used to execute the task (e.g library/ubuntu:tag).
 	DockerImage string
 	Id          string
+	// Wall-clock limit (in seconds) for the task execution. Zero means no limit.
+	Timeout int64
+	// Vcpu and Ram (MegaBytes) requested by the task. They are capped by the slot's
+	// share of the worker resources, which is also used if they are zero.
+	Vcpu float32
+	Ram  uint32
+	// Why the task has failed, if it has
+	FailureCause FailureCause
+	// Whether the non-zero exit codes of the commands make the task fail.
+	// If it is not set, the worker's default policy is used.
+	FailurePolicy FailurePolicy
+	// Whether the execution goes on after a command exits non-zero. If it is
+	// not set, the commands are executed no matter the previous exit codes.
+	ExecutionMode ExecutionMode
+	// The results of the executed commands, sent in the final report
+	Results []CommandResult
+	// The index of the command that has stopped a fail-fast execution, if some has
+	FailedCommand *int
+	// Files staged into the task's container before its commands run
+	Inputs []TaskInput
+	// Absolute path globs of the files collected from the task's container after its commands run
+	Outputs []string
+	// The uploaded outputs, sent in the final report
+	Artifacts []TaskArtifact
+	// Names of the worker mounts the task requests
+	Mounts []string
+	// Environment variables of the task's container
+	Env map[string]string
+	// Secrets of the worker secrets store the task's container receives
+	Secrets []SecretRef
+}
+
+type FailureCause string
+
+const (
+	//The task's container has run out of memory
+	CauseOOMKilled FailureCause = "OOMKilled"
+	//Some command has exited non-zero, and the failure policy doesn't ignore it
+	CauseCommandFailed FailureCause = "CommandFailed"
+	//Some input file couldn't be downloaded, verified or written into the container
+	CauseStagingFailed FailureCause = "StagingFailed"
+	//Some output couldn't be collected, e.g the outputs have exceeded the max size
+	CauseOutputsFailed FailureCause = "OutputsFailed"
+	//The task has requested a mount that is not allowed in the worker
+	CauseMountRefused FailureCause = "MountRefused"
+	//Some secret couldn't be resolved or delivered to the task's container
+	CauseSecretsFailed FailureCause = "SecretsFailed"
+	//Some command spans many lines, which the executor script can't run as a single command
+	CauseInvalidCommands FailureCause = "InvalidCommands"
+)
+
+//It represents how a task execution has ended.
+type TaskOutcome struct {
+	State TaskState
+	Cause FailureCause
+	// The output of the task commands, if it could be collected
+	Logs *TaskLogs
+	// The results of the commands executed until the task has ended
+	Results []CommandResult
+	// The index of the command that has stopped a fail-fast execution
+	FailedCommand *int
+	// The archives of the task outputs, collected before the container is removed
+	Outputs []OutputArchive
+}
+
+//This struct represents the server's answer to a task report.
+type ReportResponse struct {
+	// Whether the server wants the worker to cancel the task
+	Cancel bool
 }
 
 func (ts TaskState) String() string {
-	return [...]string{"TaskPending ", "TaskRunning", "TaskFinished", "TaskFailed"}[ts]
+	return [...]string{"TaskPending ", "TaskRunning", "TaskFinished", "TaskFailed", "TaskInterrupted", "TaskTimedOut", "TaskCanceled"}[ts]
+}
+
+//It subscribes the worker in the server, which assigns it a token and a queue.
+//It returns:
+//1. an error of the utils.ErrServerUnavailable kind if the server couldn't be reached,
+//so the join can be retried
+//2. an error if the worker's key couldn't be read, or the server has refused the join
+//3. nil otherwise
+func (w *Worker) Join(serverEndpoint string) error {
+	err := w.join(serverEndpoint)
+	observeJoin(err)
+	return err
 }
 
-func (w *Worker) Join(serverEndpoint string) {
+func (w *Worker) join(serverEndpoint string) error {
 	headers := http.Header{}
 
 	publicKey, err := utils.GetBase64PubKey(w.Id)
 
 	if err != nil {
-		log.Fatal("Error on retrieving key as base64. " + err.Error())
+		return fmt.Errorf("Error on retrieving key as base64: %w", err)
 	}
 
 	headers.Set(PUBLIC_KEY, publicKey)
-	httpResponse, err := utils.Post(w.Id, w, headers, serverEndpoint+"/workers")
+	httpResponse, err := utils.Post(w.Id, w.joinRequest(), headers, serverEndpoint+"/workers")
 
 	if err != nil {
-		log.Fatal("Error on joining the server: " + err.Error())
+		return fmt.Errorf("Error on joining the server: %w", err)
+	}
+
+	return HandleJoinResponse(httpResponse, w)
+}
+
+func (w *Worker) joinRequest() JoinRequest {
+	_, queueId := w.credentials()
+	return JoinRequest{Id: w.Id, Vcpu: w.Vcpu, Ram: w.Ram, QueueId: queueId, Slots: w.Slots}
+}
+
+//It keeps trying to join the server, waiting the backoff interval between the tries.
+//Only the server unavailability is retried.
+//It returns:
+//1. the context error if the context is done before joining
+//2. the join error if it can't be retried
+//3. nil otherwise
+func (w *Worker) JoinWithRetry(ctx context.Context, serverEndpoint string, backoff *utils.Backoff) error {
+	defer backoff.Reset()
+
+	for {
+		err := w.Join(serverEndpoint)
+
+		if err == nil {
+			return nil
+		}
+
+		if !errors.Is(err, utils.ErrServerUnavailable) {
+			return err
+		}
+
+		interval := backoff.Next()
+		w.logger().WithError(err).With("retry_in", interval).Warn("Error on joining the server; retrying")
+		sleep(ctx, interval)
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 	}
+}
+
+//It waits the interval, returning earlier if the context is done.
+func wait(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
 
-	HandleJoinResponse(httpResponse, w)
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
 }
 
-func HandleJoinResponse(response *utils.HttpResponse, w *Worker) {
+//It sets the token and the queue the server has assigned to the worker.
+//It returns:
+//1. an error of the utils.ErrRequestRejected kind if the server hasn't subscribed the worker
+//2. an error of the utils.ErrMalformedPayload kind if the response has no valid token or queue
+//3. nil otherwise
+func HandleJoinResponse(response *utils.HttpResponse, w *Worker) error {
 	if response.StatusCode != 201 {
-		log.Fatal("The work could not be subscribed. Status Code: " + strconv.Itoa(response.StatusCode))
+		return fmt.Errorf("The worker could not be subscribed; status code %d: %w", response.StatusCode, utils.ErrRequestRejected)
 	}
 
 	var parsedBody map[string]string
 	err := json.Unmarshal(response.Body, &parsedBody)
 
 	if err != nil {
-		log.Fatal("Unable to parse the response body")
+		return fmt.Errorf("Unable to parse the response body: %v: %w", err, utils.ErrMalformedPayload)
 	}
 
 	token, ok := parsedBody["arrebol-worker-token"]
 
 	if !ok {
-		log.Fatal("The token is not in the response body")
+		return fmt.Errorf("The token is not in the response body: %w", utils.ErrMalformedPayload)
 	}
 
-	parsedToken, err := ParseToken(token)
+	claims, err := ParseToken(token)
 
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("Unable to parse the token: %v: %w", err, utils.ErrMalformedPayload)
 	}
 
-	queueId, ok := parsedToken["QueueId"]
+	w.credentialsLock.Lock()
+	defer w.credentialsLock.Unlock()
+	w.Token = token
+	w.QueueId = claims.QueueId
+	w.tokenReceived = time.Now()
+	w.tokenExpiry = time.Time{}
 
-	if !ok {
-		log.Fatal("The queue_id is not in the response body")
+	if claims.ExpiresAt != 0 {
+		w.tokenExpiry = time.Unix(claims.ExpiresAt, 0)
 	}
 
-	w.Token = token
-	w.QueueId = queueId.(uint)
+	return nil
+}
+
+//It returns the worker's logger, whose entries carry the worker and queue ids.
+func (w *Worker) logger() *utils.Logger {
+	_, queueId := w.credentials()
+	return utils.Log().With(utils.WorkerIdField, w.Id).With(utils.QueueIdField, queueId)
+}
+
+func (w *Worker) credentials() (string, uint) {
+	w.credentialsLock.RLock()
+	defer w.credentialsLock.RUnlock()
+	return w.Token, w.QueueId
 }
 
 func (w *Worker) GetTask(serverEndPoint string) (*Task, error) {
-	log.Println("Starting GetTask routine")
+	w.logger().Debug("Asking for a task")
+	token, queueId := w.credentials()
 
-	if w.QueueId == 0 {
-		return nil, errors.New("The QueueId must be set before getting a task")
+	if queueId == 0 {
+		return nil, ErrNotJoined
 	}
 
-	url := serverEndPoint + "/workers/" + w.Id + "/queues/" + fmt.Sprint(w.QueueId) + "/tasks"
+	url := serverEndPoint + "/workers/" + w.Id + "/queues/" + fmt.Sprint(queueId) + "/tasks"
 
 	headers := http.Header{}
-	headers.Set("arrebol-worker-token", w.Token)
+	headers.Set("arrebol-worker-token", token)
 
 	httpResp, err := utils.Get(w.Id, url, headers)
 
+	if errors.Is(err, utils.ErrNotFound) {
+		return nil, utils.NewRequestError(utils.ErrNoTask, url, err)
+	}
+
 	if err != nil {
-		return nil, errors.New("Error on GET request: " + err.Error())
+		return nil, fmt.Errorf("Error on GET request: %w", err)
 	}
 
 	respBody := httpResp.Body
 
+	if httpResp.StatusCode == http.StatusNoContent || len(respBody) == 0 {
+		return nil, utils.NewRequestError(utils.ErrNoTask, url, nil)
+	}
+
 	var task Task
 	err = json.Unmarshal(respBody, &task)
 
 	if err != nil {
-		return nil, errors.New("Error on unmarshalling the task: " + err.Error())
+		return nil, utils.NewRequestError(utils.ErrMalformedPayload, url, err)
 	}
 
+	if err := task.validate(); err != nil {
+		return nil, utils.NewRequestError(utils.ErrMalformedPayload, url, err)
+	}
+
+	tasksFetched.Inc()
 	return &task, nil
 }
 
-func ParseWorkerConfiguration(reader io.Reader) Worker {
+//It checks the task fields the worker relies on to run it, so a bad payload is
+//refused before it reaches a slot.
+//It returns an error if the task has no commands or its report interval isn't positive.
+func (t *Task) validate() error {
+	if len(t.Commands) == 0 {
+		return errors.New("The task [" + t.Id + "] has no commands")
+	}
+
+	if t.ReportInterval <= 0 {
+		return errors.New("The task [" + t.Id + "] report interval must be positive")
+	}
+
+	return nil
+}
+
+//It polls the server until it dispatches a task, waiting the backoff interval
+//between the tries while the queue is empty or the server is unavailable.
+//The backoff is reset as soon as a task is received.
+//It returns:
+//1. nil and the error, if it is neither of the ones above (e.g the token has expired)
+//2. nil and the context error, if the context is done before receiving a task
+//3. the task and nil otherwise
+func (w *Worker) WaitForTask(ctx context.Context, serverEndPoint string, backoff *utils.Backoff) (*Task, error) {
+	for {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		task, err := w.GetTask(serverEndPoint)
+
+		if err == nil {
+			backoff.Reset()
+			return task, nil
+		}
+
+		if !errors.Is(err, utils.ErrNoTask) && !errors.Is(err, utils.ErrServerUnavailable) {
+			return nil, err
+		}
+
+		interval := backoff.Next()
+		w.logger().WithError(err).With("retry_in", interval).Debug("No task got; polling again")
+		sleep(ctx, interval)
+	}
+}
+
+func ParseWorkerConfiguration(reader io.Reader) *Worker {
 	decoder := json.NewDecoder(reader)
-	configuration := Worker{}
-	err := decoder.Decode(&configuration)
+	configuration := &Worker{}
+	err := decoder.Decode(configuration)
 	if err != nil {
-		log.Println("Error on decoding configuration file", err.Error())
+		utils.Log().WithError(err).Error("Error on decoding configuration file")
 	}
 
 	return configuration
 }
 
-func (w *Worker) ExecTask(task *Task, serverEndPoint string) {
-	address := os.Getenv(WorkerNodeAddressKey)
-	client := utils.NewDockerClient(address)
-	taskExecutor := &TaskExecutor{Cli: *client}
-
-	stateChanges := make(chan TaskState)
-	go taskExecutor.Execute(task, stateChanges)
+//It runs the task in the slot's executor, reporting its
+//progress to the server until it finishes.
+//The task is killed if it exceeds its timeout, if the server asks
+//for its cancellation in a report response, or if the context is done,
+//which happens when the worker is shutting down.
+func (w *Worker) ExecTask(ctx context.Context, task *Task, slot *Slot, serverEndPoint string) {
+	taskExecutor := slot.Executor
+	taskExecutor.FetchInput = w.inputFetcher(serverEndPoint)
+	taskExecutor.Logger = w.logger().With(utils.TaskIdField, task.Id)
+	taskExecutor.setTask(task.Id)
+	defer taskExecutor.setTask("")
+	taskCtx, cancel := taskContext(ctx, task)
+	defer cancel()
+	start := time.Now()
+
+	outcomes := make(chan TaskOutcome)
+	go taskExecutor.Execute(taskCtx, task, outcomes)
 
 	ticker := time.NewTicker(time.Duration(task.ReportInterval) * time.Second)
 
 	for {
 		select {
 		case <-ticker.C:
-			w.sendTaskReport(task, taskExecutor, serverEndPoint)
-		case state := <-stateChanges:
-			task.State = state
+			if w.sendTaskReport(task, taskExecutor, serverEndPoint) {
+				taskExecutor.logger().Info("The server has canceled the task")
+				cancel()
+			}
+		case outcome := <-outcomes:
+			if outcome.State == TaskCanceled && ctx.Err() != nil {
+				outcome.State = TaskInterrupted
+			}
+
+			task.State = outcome.State
+			task.FailureCause = outcome.Cause
+			task.Results = outcome.Results
+			task.FailedCommand = outcome.FailedCommand
+			task.Artifacts = w.handleTaskOutputs(task, outcome.Outputs, serverEndPoint)
+			w.handleTaskLogs(task, outcome.Logs, serverEndPoint)
 			ticker.Stop()
+			observeTaskEnd(task, time.Since(start))
 			w.sendTaskReport(task, taskExecutor, serverEndPoint)
 			return
 		}
@@ -195,44 +462,78 @@ func (w *Worker) ExecTask(task *Task, serverEndPoint string) {
 	}
 }
 
-func (w *Worker) sendTaskReport(task *Task, executor *TaskExecutor, serverEndPoint string) {
+//It derives the context in which the task runs, which expires after the task's timeout, if it has one.
+func taskContext(ctx context.Context, task *Task) (context.Context, context.CancelFunc) {
+	if task.Timeout > 0 {
+		return context.WithTimeout(ctx, time.Duration(task.Timeout)*time.Second)
+	}
+
+	return context.WithCancel(ctx)
+}
+
+//It reports the task's state and progress to the server.
+//It returns true if the server has asked for the task cancellation.
+func (w *Worker) sendTaskReport(task *Task, executor *TaskExecutor, serverEndPoint string) bool {
 	updateTaskProgress(task, executor)
-	url := serverEndPoint + "/workers/" + w.Id + "/queues/" + fmt.Sprint(w.QueueId) + "/tasks"
+	token, _ := w.credentials()
+	resp, err := w.putTaskReport(task, serverEndPoint)
 
-	header := http.Header{}
-	header.Set("arrebol-worker-token", w.Token)
+	//the token may expire between the refreshes, e.g if the worker's clock is late
+	if errors.Is(err, utils.ErrUnauthorized) {
+		executor.logger().Info("The token has expired; refreshing it to report the task again")
 
-	resp, err := utils.Put(w.Id, task, header, url)
+		if refreshErr := w.RefreshToken(serverEndPoint, token); refreshErr != nil {
+			executor.logger().WithError(refreshErr).Error("Error on refreshing the token")
+		} else {
+			resp, err = w.putTaskReport(task, serverEndPoint)
+		}
+	}
 
-	if err != nil || resp.StatusCode != 200 {
-		log.Println("Error on reporting task: " + err.Error())
+	if err != nil {
+		reportFailures.Inc()
+		executor.logger().WithError(err).Error("Error on reporting task")
+		return false
 	}
-}
 
-func updateTaskProgress(task *Task, executor *TaskExecutor) {
-	executedCmdsLen, err := executor.Track()
+	if resp.StatusCode != http.StatusOK {
+		reportFailures.Inc()
+		executor.logger().With("status_code", resp.StatusCode).Warn("Unexpected status code on reporting task")
+		return false
+	}
 
-	if err != nil {
-		log.Println(err)
+	var reportResponse ReportResponse
+
+	//the server is not required to answer the report with a body
+	if err := json.Unmarshal(resp.Body, &reportResponse); err != nil {
+		return false
 	}
 
-	task.Progress = executedCmdsLen * 100 / len(task.Commands)
+	return reportResponse.Cancel
+}
+
+func (w *Worker) putTaskReport(task *Task, serverEndPoint string) (*utils.HttpResponse, error) {
+	token, queueId := w.credentials()
+	url := serverEndPoint + "/workers/" + w.Id + "/queues/" + fmt.Sprint(queueId) + "/tasks"
+
+	header := http.Header{}
+	header.Set("arrebol-worker-token", token)
 
-	log.Println("progess: " + strconv.Itoa(task.Progress))
+	return utils.Put(w.Id, task.redacted(), header, url)
 }
 
-func parseToken(tokenStr string) (map[string]interface{}, error) {
-	token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
-		return utils.GetPublicKey("server"), nil
-	})
+func updateTaskProgress(task *Task, executor *TaskExecutor) {
+	executedCmdsLen, err := executor.Track()
 
 	if err != nil {
-		return nil, err
+		//the last known progress is kept
+		return
 	}
 
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		return claims, nil
-	} else {
-		return nil, errors.New("Error on parsing token")
+	if len(task.Commands) == 0 {
+		return
 	}
+
+	task.Progress = executedCmdsLen * 100 / len(task.Commands)
+	executor.setProgress(task.Progress)
+	executor.logger().With("progress", task.Progress).Debug("Task progress updated")
 }
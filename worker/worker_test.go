@@ -2,12 +2,18 @@ package worker
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"github.com/dgrijalva/jwt-go"
 	"github.com/ufcg-lsd/arrebol-pb-worker/utils"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 var (
@@ -32,7 +38,7 @@ func (c *MockedClient) Do(req *http.Request) (*http.Response, error) {
 }
 
 func TestParseWorkerConfiguration(t *testing.T) {
-	testingWorkerAsByte, err := json.Marshal(workerTestInstance)
+	testingWorkerAsByte, err := json.Marshal(&workerTestInstance)
 
 	if err != nil {
 
@@ -42,7 +48,7 @@ func TestParseWorkerConfiguration(t *testing.T) {
 
 	parsedWorker := ParseWorkerConfiguration(bytes.NewReader(testingWorkerAsByte))
 	log.Println(parsedWorker)
-	log.Println(workerTestInstance)
+	log.Println(&workerTestInstance)
 
 	expectedWorker := Worker{
 		Vcpu:    workerTestInstance.Vcpu,
@@ -51,11 +57,45 @@ func TestParseWorkerConfiguration(t *testing.T) {
 		QueueId: workerTestInstance.QueueId,
 	}
 
-	if parsedWorker != expectedWorker {
+	if !reflect.DeepEqual(parsedWorker, &expectedWorker) {
 		t.Errorf("The parsed worked is different from the expected one")
 	}
 }
 
+func TestWorker_JoinRequest(t *testing.T) {
+	//setup
+	w := Worker{
+		Id:        "1023",
+		Vcpu:      2,
+		Ram:       1024,
+		Slots:     2,
+		Mounts:    []MountConfig{{Name: "datasets", Type: MountBind, Source: "/srv/datasets", Target: "/data"}},
+		Redaction: utils.RedactionConfig{Patterns: []string{"password=(\\S+)"}, Values: []string{"s3cr3t"}},
+	}
+
+	//exercise
+	body, err := json.Marshal(w.joinRequest())
+
+	//verification
+	if err != nil {
+		t.Fatalf("Error on marshalling the join request: %v", err)
+	}
+
+	for _, local := range []string{"/srv/datasets", "s3cr3t", "password", "Mounts", "Redaction"} {
+		if strings.Contains(string(body), local) {
+			t.Errorf("The join request must not carry the worker's local settings, got %s", body)
+		}
+	}
+
+	expected := JoinRequest{Id: "1023", Vcpu: 2, Ram: 1024, Slots: 2}
+	var request JoinRequest
+	json.Unmarshal(body, &request)
+
+	if request != expected {
+		t.Errorf("The join request must be %+v, got %+v", expected, request)
+	}
+}
+
 func TestHandleSubscriptionResponse(t *testing.T) {
 	//setup
 	body := make(map[string]string)
@@ -63,8 +103,8 @@ func TestHandleSubscriptionResponse(t *testing.T) {
 
 	bodyAsByte, _ := json.Marshal(body)
 
-	ParseToken = func(tokenStr string) (map[string]interface{}, error) {
-		return map[string]interface{}{"QueueId": uint(192038)}, nil
+	ParseToken = func(tokenStr string) (*TokenClaims, error) {
+		return &TokenClaims{QueueId: 192038}, nil
 	}
 
 	//exercise
@@ -82,8 +122,7 @@ func TestHandleSubscriptionResponse(t *testing.T) {
 
 func TestWorker_GetTask(t *testing.T) {
 	//setup
-	task := make(map[string]string)
-	task["Id"] = "1"
+	task := map[string]interface{}{"Id": "1", "Commands": []string{"true"}, "ReportInterval": 5}
 
 	byteTask, err := json.Marshal(&task)
 
@@ -104,9 +143,8 @@ func TestWorker_GetTask(t *testing.T) {
 
 	utils.Client = &MockedClient{}
 
-	utils.GetSignature = func(payload interface{}, workerId string) []byte {
-		fakeSignature, _ := json.Marshal("FAKE-SIGNATURE")
-		return fakeSignature
+	utils.GetSignature = func(message []byte, workerId string) ([]byte, string, error) {
+		return []byte("FAKE-SIGNATURE"), utils.AlgorithmRSAPSS, nil
 	}
 
 	//exercise
@@ -122,6 +160,37 @@ func TestWorker_GetTask(t *testing.T) {
 	}
 }
 
+func TestWorker_GetTaskWithInvalidTask(t *testing.T) {
+	//setup
+	workerTestInstance.QueueId = 932
+	utils.Client = &MockedClient{}
+	utils.GetSignature = func(message []byte, workerId string) ([]byte, string, error) {
+		return []byte("FAKE-SIGNATURE"), utils.AlgorithmRSAPSS, nil
+	}
+
+	tasks := []map[string]interface{}{
+		{"Id": "1", "ReportInterval": 5},
+		{"Id": "1", "Commands": []string{}, "ReportInterval": 5},
+		{"Id": "1", "Commands": []string{"true"}},
+		{"Id": "1", "Commands": []string{"true"}, "ReportInterval": -1},
+	}
+
+	for _, task := range tasks {
+		byteTask, _ := json.Marshal(task)
+		GetDo = func() (*http.Response, error) {
+			return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewReader(byteTask))}, nil
+		}
+
+		//exercise
+		mockedTask, err := workerTestInstance.GetTask("http://test-server:8000/v1")
+
+		//verify
+		if !errors.Is(err, utils.ErrMalformedPayload) || mockedTask != nil {
+			t.Errorf("The task %v must be refused as malformed, got [%v]", task, err)
+		}
+	}
+}
+
 func TestWorker_GetTaskWithEmptyQueue(t *testing.T) {
 	//setup
 	workerTestInstance.QueueId = 0
@@ -138,3 +207,413 @@ func TestWorker_GetTaskWithEmptyQueue(t *testing.T) {
 		t.Error("The expected error has not occurred")
 	}
 }
+
+func TestWorker_GetTaskWithNoTaskAvailable(t *testing.T) {
+	//setup
+	workerTestInstance.QueueId = 932
+
+	GetDo = func() (*http.Response, error) {
+		resp := &http.Response{
+			StatusCode: 204,
+			Header:     nil,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+		return resp, nil
+	}
+
+	//exercise
+	mockedTask, err := workerTestInstance.GetTask("http://test-server:8000/v1")
+
+	//verify
+	if !errors.Is(err, utils.ErrNoTask) {
+		t.Errorf("The error must be classified as no task available, got [%v]", err)
+	}
+
+	if mockedTask != nil {
+		t.Error("No task must be returned")
+	}
+}
+
+func TestWorker_GetTaskWithExpiredToken(t *testing.T) {
+	//setup
+	workerTestInstance.QueueId = 932
+
+	GetDo = func() (*http.Response, error) {
+		resp := &http.Response{
+			StatusCode: 401,
+			Header:     nil,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+		return resp, nil
+	}
+
+	//exercise
+	_, err := workerTestInstance.GetTask("http://test-server:8000/v1")
+
+	//verify
+	if !errors.Is(err, utils.ErrUnauthorized) {
+		t.Errorf("The error must be classified as unauthorized, got [%v]", err)
+	}
+}
+
+func TestWorker_WaitForTask(t *testing.T) {
+	//setup
+	workerTestInstance.QueueId = 932
+	statusCodes := []int{204, 503, 204, 200}
+	calls := 0
+
+	GetDo = func() (*http.Response, error) {
+		byteTask, _ := json.Marshal(map[string]interface{}{"Id": "1", "Commands": []string{"true"}, "ReportInterval": 5})
+		resp := &http.Response{
+			StatusCode: statusCodes[calls],
+			Header:     nil,
+			Body:       ioutil.NopCloser(bytes.NewReader(byteTask)),
+		}
+		calls++
+		return resp, nil
+	}
+
+	var intervals []time.Duration
+	sleep = func(ctx context.Context, d time.Duration) {
+		intervals = append(intervals, d)
+	}
+	defer func() { sleep = wait }()
+
+	backoff := utils.NewBackoff(time.Second, time.Minute, 2, 0)
+
+	//exercise
+	task, err := workerTestInstance.WaitForTask(context.Background(), "http://test-server:8000/v1", backoff)
+
+	//verify
+	if err != nil {
+		t.Fatal("Error on waiting for task: " + err.Error())
+	}
+
+	if task.Id != "1" {
+		t.Error("The task Id is different from the expected one")
+	}
+
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}
+
+	if len(intervals) != len(expected) {
+		t.Fatalf("The worker has waited %d times, expected %d", len(intervals), len(expected))
+	}
+
+	for i := range expected {
+		if intervals[i] != expected[i] {
+			t.Errorf("The interval %v is different from the expected %v", intervals[i], expected[i])
+		}
+	}
+
+	if interval := backoff.Next(); interval != time.Second {
+		t.Error("The backoff must be reset after receiving a task")
+	}
+}
+
+func TestWorker_WaitForTaskWithExpiredToken(t *testing.T) {
+	//setup
+	workerTestInstance.QueueId = 932
+
+	GetDo = func() (*http.Response, error) {
+		resp := &http.Response{
+			StatusCode: 401,
+			Header:     nil,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+		return resp, nil
+	}
+
+	sleep = func(ctx context.Context, d time.Duration) {
+		t.Error("The worker must not wait when the token has expired")
+	}
+	defer func() { sleep = wait }()
+
+	//exercise
+	_, err := workerTestInstance.WaitForTask(context.Background(), "http://test-server:8000/v1", utils.NewBackoff(time.Second, time.Minute, 2, 0))
+
+	//verify
+	if !errors.Is(err, utils.ErrUnauthorized) {
+		t.Errorf("The error must be returned to the caller, got [%v]", err)
+	}
+}
+
+func TestWorker_JoinWithRetry(t *testing.T) {
+	//setup
+	utils.GenAccessKeys(workerTestInstance.Id)
+	failures := 2
+
+	GetDo = func() (*http.Response, error) {
+		if failures > 0 {
+			failures--
+			return nil, errors.New("connection refused")
+		}
+
+		body, _ := json.Marshal(map[string]string{"arrebol-worker-token": "joined-token"})
+		resp := &http.Response{
+			StatusCode: 201,
+			Header:     nil,
+			Body:       ioutil.NopCloser(bytes.NewReader(body)),
+		}
+		return resp, nil
+	}
+
+	ParseToken = func(tokenStr string) (*TokenClaims, error) {
+		return &TokenClaims{QueueId: 932}, nil
+	}
+
+	waits := 0
+	sleep = func(ctx context.Context, d time.Duration) {
+		waits++
+	}
+	defer func() { sleep = wait }()
+
+	//exercise
+	workerTestInstance.JoinWithRetry(context.Background(), "http://test-server:8000/v1", utils.NewBackoff(time.Second, time.Minute, 2, 0))
+
+	//verify
+	if waits != 2 {
+		t.Errorf("The worker has waited %d times, expected 2", waits)
+	}
+
+	if workerTestInstance.Token != "joined-token" {
+		t.Error("The token is not the expected one")
+	}
+}
+
+func TestWorker_JoinWithRetryRejected(t *testing.T) {
+	//setup
+	utils.GenAccessKeys(workerTestInstance.Id)
+	utils.Client = &MockedClient{}
+
+	GetDo = func() (*http.Response, error) {
+		resp := &http.Response{
+			StatusCode: 403,
+			Header:     nil,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+		return resp, nil
+	}
+
+	waits := 0
+	sleep = func(ctx context.Context, d time.Duration) {
+		waits++
+	}
+	defer func() { sleep = wait }()
+
+	//exercise
+	err := workerTestInstance.JoinWithRetry(context.Background(), "http://test-server:8000/v1", utils.NewBackoff(time.Second, time.Minute, 2, 0))
+
+	//verify
+	if !errors.Is(err, utils.ErrForbidden) {
+		t.Errorf("The refused join must be returned to the caller, got [%v]", err)
+	}
+
+	if waits != 0 {
+		t.Errorf("A refused join must not be retried")
+	}
+}
+
+func TestWorker_JoinWithServerError(t *testing.T) {
+	//setup
+	utils.GenAccessKeys(workerTestInstance.Id)
+	utils.Client = &MockedClient{}
+
+	GetDo = func() (*http.Response, error) {
+		resp := &http.Response{
+			StatusCode: 500,
+			Header:     nil,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+		return resp, nil
+	}
+
+	//exercise
+	err := workerTestInstance.Join("http://test-server:8000/v1")
+
+	//verify
+	if !errors.Is(err, utils.ErrServerUnavailable) {
+		t.Errorf("The server error must be returned to the caller, got [%v]", err)
+	}
+}
+
+func TestWorker_JoinWithMissingKey(t *testing.T) {
+	//setup
+	worker := Worker{Id: "worker-without-keys"}
+
+	//exercise
+	err := worker.Join("http://test-server:8000/v1")
+
+	//verify
+	if err == nil {
+		t.Errorf("The missing key must be returned to the caller")
+	}
+}
+
+func TestHandleJoinResponseWithInvalidResponse(t *testing.T) {
+	//setup
+	validBody, _ := json.Marshal(map[string]string{"arrebol-worker-token": "test-token"})
+	responses := map[string]*utils.HttpResponse{
+		"not subscribed": {Body: validBody, StatusCode: 200},
+		"invalid body":   {Body: []byte("not json"), StatusCode: 201},
+		"missing token":  {Body: []byte("{}"), StatusCode: 201},
+		"invalid token":  {Body: validBody, StatusCode: 201},
+	}
+
+	ParseToken = func(tokenStr string) (*TokenClaims, error) {
+		return nil, errors.New("signature is invalid")
+	}
+	defer func() { ParseToken = parseToken }()
+
+	worker := Worker{Id: "1"}
+
+	for name, response := range responses {
+		//exercise
+		err := HandleJoinResponse(response, &worker)
+
+		//verification
+		if err == nil {
+			t.Errorf("The %s response must be returned as an error", name)
+		}
+	}
+
+	if worker.Token != "" || worker.QueueId != 0 {
+		t.Errorf("The credentials must not be set by an invalid response")
+	}
+}
+
+func TestHandleJoinResponseQueueIdClaim(t *testing.T) {
+	//setup
+	jwksURL, privateKey, closeServer := jwksServer(t)
+	defer closeServer()
+	defer ConfigureTokenVerifier(tokenVerifier)
+	ConfigureTokenVerifier(NewTokenVerifier(utils.NewKeySet(utils.KeySetConfig{URL: jwksURL}), DefaultTokenAlgorithms, ""))
+
+	claims := map[interface{}]bool{
+		932:          true,
+		float64(932): true,
+		-1:           false,
+		1.5:          false,
+		"932":        false,
+		nil:          false,
+	}
+
+	for claim, valid := range claims {
+		worker := Worker{Id: "1"}
+		token := signToken(t, privateKey, jwt.MapClaims{"QueueId": claim, "exp": time.Now().Add(time.Hour).Unix()})
+		body, _ := json.Marshal(map[string]string{"arrebol-worker-token": token})
+
+		//exercise
+		err := HandleJoinResponse(&utils.HttpResponse{Body: body, StatusCode: 201}, &worker)
+
+		//verification
+		if valid && (err != nil || worker.QueueId != 932) {
+			t.Errorf("The queue id claim [%v] must be accepted, got [%v]", claim, err)
+		}
+
+		if !valid && !errors.Is(err, utils.ErrMalformedPayload) {
+			t.Errorf("The queue id claim [%v] must be refused, got [%v]", claim, err)
+		}
+	}
+}
+
+func TestWorker_WaitForTaskWithDoneContext(t *testing.T) {
+	//setup
+	workerTestInstance.QueueId = 932
+
+	GetDo = func() (*http.Response, error) {
+		resp := &http.Response{
+			StatusCode: 204,
+			Header:     nil,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+		return resp, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sleep = func(ctx context.Context, d time.Duration) {
+		cancel()
+	}
+	defer func() { sleep = wait }()
+
+	//exercise
+	task, err := workerTestInstance.WaitForTask(ctx, "http://test-server:8000/v1", utils.NewBackoff(time.Second, time.Minute, 2, 0))
+
+	//verify
+	if err != context.Canceled {
+		t.Errorf("The polling must stop once the context is done, got [%v]", err)
+	}
+
+	if task != nil {
+		t.Error("No task must be returned")
+	}
+}
+
+func TestWorker_SendTaskReportWithCancellation(t *testing.T) {
+	//setup
+	workerTestInstance.QueueId = 932
+	task := &Task{Id: "1", Commands: []string{"echo 'arrebol'"}, Progress: 50}
+
+	GetDo = func() (*http.Response, error) {
+		body, _ := json.Marshal(ReportResponse{Cancel: true})
+		resp := &http.Response{
+			StatusCode: 200,
+			Header:     nil,
+			Body:       ioutil.NopCloser(bytes.NewReader(body)),
+		}
+		return resp, nil
+	}
+
+	//exercise
+	canceled := workerTestInstance.sendTaskReport(task, &TaskExecutor{}, "http://test-server:8000/v1")
+
+	//verify
+	if !canceled {
+		t.Error("The cancellation asked by the server has been ignored")
+	}
+
+	if task.Progress != 50 {
+		t.Error("The last known progress must be kept when the task can't be tracked")
+	}
+}
+
+func TestWorker_SendTaskReportWithoutBody(t *testing.T) {
+	//setup
+	workerTestInstance.QueueId = 932
+
+	GetDo = func() (*http.Response, error) {
+		resp := &http.Response{
+			StatusCode: 200,
+			Header:     nil,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+		return resp, nil
+	}
+
+	//exercise
+	canceled := workerTestInstance.sendTaskReport(&Task{Id: "1", Commands: []string{}}, &TaskExecutor{}, "http://test-server:8000/v1")
+
+	//verify
+	if canceled {
+		t.Error("The task must not be canceled if the server doesn't ask for it")
+	}
+}
+
+func TestTaskContext(t *testing.T) {
+	//exercise
+	ctx, cancel := taskContext(context.Background(), &Task{Id: "1", Timeout: 1})
+	defer cancel()
+
+	//verify
+	deadline, ok := ctx.Deadline()
+
+	if !ok || time.Until(deadline) > time.Second {
+		t.Error("The task context must expire after the task timeout")
+	}
+
+	ctx, cancel = taskContext(context.Background(), &Task{Id: "1"})
+	defer cancel()
+
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("A task without timeout must have no deadline")
+	}
+}